@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/validate"
+)
+
+// runBatch sends every message of an mbox-style stream over a single MHRS connection.
+// Messages are separated by lines starting with "From " and take their recipients from their To, Cc and Bcc
+// headers plus any recipients given as arguments. Lines of the form ">From " are unquoted by one level.
+// A result line is printed per message followed by a summary. Returns EX_OK when every message was delivered,
+// otherwise the exit code of the first failure.
+func runBatch(input io.Reader, args []string, subject, from, fullName string, cfg *config.Config) int {
+	if from != "" {
+		if err := validate.Address(from); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid sender address: %v\n", err)
+			return EX_USAGE
+		}
+	}
+
+	messages, err := splitMessages(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading messages: %v\n", err)
+		return EX_USAGE
+	}
+	if len(messages) == 0 {
+		fmt.Fprintln(os.Stderr, "No messages in batch")
+		return EX_USAGE
+	}
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	code, failed := EX_OK, 0
+	for i, raw := range messages {
+		err := sendBatchMessage(&conn, raw, args, subject, from, fullName, cfg)
+		if err != nil {
+			failed++
+			if code == EX_OK {
+				code = exitCode(err)
+			}
+			fmt.Fprintf(os.Stderr, "Message %d/%d failed: %v\n", i+1, len(messages), err)
+			continue
+		}
+		fmt.Printf("Message %d/%d sent\n", i+1, len(messages))
+	}
+
+	fmt.Printf("Batch complete: %d sent, %d failed\n", len(messages)-failed, failed)
+	return code
+}
+
+// sendBatchMessage parses and sends one message over *conn, dialing MHRS when there is no open connection.
+// The connection is dropped after a transport error so the next message reconnects.
+func sendBatchMessage(conn *net.Conn, raw []byte, args []string, subject, from, fullName string, cfg *config.Config) error {
+	msg, err := parseMessage(bytes.NewReader(raw), true)
+	if err != nil {
+		return err
+	}
+	to, cc, bcc, err := collectRecipients(args, msg, true)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRecipient, err)
+	}
+	if len(to)+len(cc)+len(bcc) == 0 {
+		return fmt.Errorf("%w: no recipient specified", errRecipient)
+	}
+	req := buildRequest(msg, to, cc, bcc, subject, from, fullName, cfg)
+
+	if *conn == nil {
+		if *conn, err = dialMHRS(cfg); err != nil {
+			return err
+		}
+	}
+	ack, err := roundTrip(*conn, req, cfg)
+	if err != nil {
+		(*conn).Close()
+		*conn = nil
+		return err
+	}
+	return ackError(ack)
+}
+
+// splitMessages splits an mbox-style stream into raw messages, dropping the "From " separator lines
+func splitMessages(r io.Reader) ([][]byte, error) {
+	var messages [][]byte
+	var current bytes.Buffer
+	flush := func() {
+		if len(bytes.TrimSpace(current.Bytes())) > 0 {
+			messages = append(messages, bytes.Clone(current.Bytes()))
+		}
+		current.Reset()
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "From ") {
+			flush()
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return messages, nil
+}
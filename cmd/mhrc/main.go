@@ -7,19 +7,27 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/textproto"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/validate"
 )
 
 const appName = "mhrc"
 
+// configPath is the configuration file in use, from the -config flag or config.Resolve
+var configPath string
+
 // Exit codes following FreeBSD's sendmail conventions
 const (
 	EX_OK          = 0  // Successful completion
@@ -27,12 +35,26 @@ const (
 	EX_NOUSER      = 67 // Recipient address invalid
 	EX_UNAVAILABLE = 69 // Service unavailable
 	EX_TEMPFAIL    = 75 // Temporary failure
+	EX_NOPERM      = 77 // Permission denied
 )
 
-type EmailRequest struct {
-	Recipient string `json:"recipient"`
-	Subject   string `json:"subject"`
-	Body      []byte `json:"body"`
+// stdinProbeTimeout is how long mhrc -file waits for stdin to deliver data before treating it as empty
+const stdinProbeTimeout = 100 * time.Millisecond
+
+// errDeliveryFailed is returned when MHRS acknowledges the request with an error status
+var errDeliveryFailed = errors.New("delivery failed")
+
+// errUnauthorized is returned when MHRS rejects the request's client token
+var errUnauthorized = errors.New("rejected by MHRS")
+
+// errRecipient is returned for batch messages whose recipients are missing or invalid
+var errRecipient = errors.New("invalid recipient")
+
+// forwardedHeaders are copied from the message into the request so MHRS re-applies them, together with
+// every X- header. Reply-To is forwarded through the request's ReplyTo field instead.
+var forwardedHeaders = []string{
+	"In-Reply-To", "References", "Keywords", "Importance", "Priority", "Sensitivity",
+	"List-Id", "List-Unsubscribe", "List-Unsubscribe-Post", "Auto-Submitted", "Precedence",
 }
 
 // EmailMessage represents a parsed email with headers and body
@@ -44,79 +66,232 @@ type EmailMessage struct {
 
 func main() {
 	var (
-		_          = flag.String("f", "", "from address ") // fromAddr: (ignored, always uses mhrs default sender)
+		fromAddr   = flag.String("f", "", "sender address, honored only when MHRS allows sender overrides")
+		fullName   = flag.String("F", "", "sender full name, honored only when MHRS allows sender overrides")
 		useHeaders = flag.Bool("t", false, "extract recipients from message headers")
 		ignoreDots = flag.Bool("i", false, "ignore dots alone on lines")
 		subject    = flag.String("s", "", "specify subject")
-		bpFlag     = flag.Bool("bp", false, "print mail queue (disabled)")
+		msgFile    = flag.String("file", "", "read the message from an RFC 822 file instead of stdin")
+		bpFlag     = flag.Bool("bp", false, "print the MHRS mail queue")
 		biFlag     = flag.Bool("bi", false, "initialize aliases (disabled)")
 		bhFlag     = flag.Bool("bh", false, "print persistent host status (disabled)")
 		bpurgFlag  = flag.Bool("bpurg", false, "purge host status (disabled)")
+		checkCfg   = flag.Bool("check-config", false, "validate the configuration and exit")
+		testMode   = flag.Bool("test", false, "send a canned test email to the recipients given as arguments and print the MHRS acknowledgement")
+		batchMode  = flag.Bool("batch", false, "send every message of an mbox-style stream (messages start with a \"From \" line) over one connection")
+		verbose    = flag.Bool("v", false, "verbose: print the delivery attempts MHRS made")
 	)
+	flag.StringVar(&configPath, "config", "", "path to the configuration file, overriding $"+config.EnvPath(appName)+" and the default search")
 
 	flag.Parse()
+	configPath = config.Resolve(appName, configPath)
+
+	if *checkCfg {
+		os.Exit(runCheckConfig())
+	}
 
-	cfg, _, err := config.Load(appName)
+	cfg, _, err := config.Load(appName, configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
 		os.Exit(EX_UNAVAILABLE)
 	}
 
 	switch {
-	case *bpFlag || *biFlag || *bhFlag || *bpurgFlag:
+	case *bpFlag:
+		os.Exit(runQueueStatus(cfg))
+	case *biFlag || *bhFlag || *bpurgFlag:
 		fmt.Println("Mail queue is empty")
 		os.Exit(EX_OK)
+	case *testMode:
+		os.Exit(runTest(flag.Args(), *verbose, cfg))
 	}
 
-	msg, err := parseMessage(os.Stdin, *ignoreDots)
+	input := io.Reader(os.Stdin)
+	if *msgFile != "" {
+		if stdinHasInput() {
+			fmt.Fprintln(os.Stderr, "Message given both on stdin and with -file, use only one")
+			os.Exit(EX_USAGE)
+		}
+		f, err := os.Open(*msgFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening message file: %v\n", err)
+			os.Exit(EX_USAGE)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	if *batchMode {
+		os.Exit(runBatch(input, flag.Args(), *subject, *fromAddr, *fullName, cfg))
+	}
+
+	msg, err := parseMessage(input, *ignoreDots)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading message: %v\n", err)
 		os.Exit(EX_USAGE)
 	}
 
-	// Determine recipient
-	var recipient string
-	if *useHeaders {
-		recipient = msg.headers["To"]
-		if recipient == "" {
-			fmt.Fprintln(os.Stderr, "No recipient specified in headers")
-			os.Exit(EX_NOUSER)
-		}
-	} else if len(flag.Args()) > 0 {
-		recipient = flag.Arg(0)
-	} else {
+	to, cc, bcc, err := collectRecipients(flag.Args(), msg, *useHeaders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid recipient: %v\n", err)
+		os.Exit(EX_NOUSER)
+	}
+	if len(to)+len(cc)+len(bcc) == 0 {
 		fmt.Fprintln(os.Stderr, "No recipient specified")
-		os.Exit(EX_USAGE)
+		os.Exit(EX_NOUSER)
 	}
 
-	// Build email request
-	emailSubject := *subject
-	if emailSubject == "" {
-		emailSubject = msg.headers["Subject"]
+	if *fromAddr != "" {
+		if err := validate.Address(*fromAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid sender address: %v\n", err)
+			os.Exit(EX_USAGE)
+		}
 	}
-	if emailSubject == "" {
-		emailSubject = "Message from mhrc"
+
+	req := buildRequest(msg, to, cc, bcc, *subject, *fromAddr, *fullName, cfg)
+	if err := sendToMHRS(req, *verbose, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error sending email: %v\n", err)
+		os.Exit(exitCode(err))
 	}
 
-	// Trim any trailing newline from body
-	bodyBytes := bytes.TrimRight(msg.body.Bytes(), "\n")
+	os.Exit(EX_OK)
+}
 
-	req := EmailRequest{
-		Recipient: recipient,
-		Subject:   emailSubject,
-		Body:      bodyBytes, // msg.body.Bytes(),
+// buildRequest assembles the request for a parsed message. subject, from and fullName come from the command line
+// and may be empty; the subject then falls back to the Subject header.
+func buildRequest(msg *EmailMessage, to, cc, bcc []string, subject, from, fullName string, cfg *config.Config) protocol.EmailRequest {
+	if subject == "" {
+		subject = msg.headers["Subject"]
+	}
+	if subject == "" {
+		subject = "Message from mhrc"
 	}
 
-	if err := sendToMHRS(req, cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Error sending email: %v\n", err)
-		os.Exit(EX_TEMPFAIL)
+	replyTo, headers := messageHeaders(msg)
+
+	return protocol.EmailRequest{
+		Recipient: strings.Join(to, ", "),
+		Cc:        cc,
+		Bcc:       bcc,
+		From:      from,
+		FromName:  fullName,
+		ReplyTo:   replyTo,
+		Subject:   subject,
+		Body:      bytes.TrimRight(msg.body.Bytes(), "\n"), // Trim any trailing newline from body
+		Headers:   headers,
+		AuthToken: cfg.Server.ClientToken,
 	}
+}
 
-	os.Exit(EX_OK)
+// exitCode maps an error returned by sendToMHRS or a batch send to a sendmail exit status
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return EX_OK
+	case errors.Is(err, errUnauthorized):
+		return EX_NOPERM
+	case errors.Is(err, errRecipient):
+		return EX_NOUSER
+	case errors.Is(err, errDeliveryFailed):
+		return EX_UNAVAILABLE
+	default:
+		return EX_TEMPFAIL
+	}
+}
+
+// collectRecipients gathers recipients from all command line arguments and, when useHeaders is set,
+// from the To, Cc and Bcc message headers. Each argument or header may hold a comma-separated list,
+// and every address is validated.
+func collectRecipients(args []string, msg *EmailMessage, useHeaders bool) (to, cc, bcc []string, err error) {
+	for _, arg := range args {
+		addrs, err := validate.AddressList(arg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		to = append(to, addrs...)
+	}
+
+	if !useHeaders {
+		return to, cc, bcc, nil
+	}
+
+	headers := []struct {
+		name string
+		dst  *[]string
+	}{
+		{"To", &to},
+		{"Cc", &cc},
+		{"Bcc", &bcc},
+	}
+	for _, h := range headers {
+		value := msg.headers[h.name]
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		addrs, err := validate.AddressList(value)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s header: %w", h.name, err)
+		}
+		*h.dst = append(*h.dst, addrs...)
+	}
+
+	return to, cc, bcc, nil
+}
+
+// messageHeaders returns the Reply-To address and the headers of msg that are forwarded to MHRS
+func messageHeaders(msg *EmailMessage) (replyTo string, headers map[string]string) {
+	for key, value := range msg.headers {
+		if value == "" {
+			continue
+		}
+		if key == "Reply-To" {
+			replyTo = value
+			continue
+		}
+		if strings.HasPrefix(key, "X-") || slices.Contains(forwardedHeaders, key) {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[key] = value
+		}
+	}
+	return replyTo, headers
+}
+
+// stdinHasInput reports whether a message was given on stdin
+func stdinHasInput() bool {
+	return hasInput(os.Stdin, stdinProbeTimeout)
+}
+
+// hasInput reports whether f yields data within timeout. Cron, systemd and CI runners often connect stdin to an
+// empty file or a pipe nobody writes to, so only data actually read counts; a terminal or /dev/null never does.
+// A byte read by the probe is consumed, which is fine as f is not read afterwards.
+func hasInput(f *os.File, timeout time.Duration) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return false
+	}
+
+	// The read may block until the writer closes the pipe, so it is left running if the timeout expires first
+	read := make(chan bool, 1)
+	go func() {
+		n, _ := f.Read(make([]byte, 1))
+		read <- n > 0
+	}()
+	select {
+	case got := <-read:
+		return got
+	case <-time.After(timeout):
+		return false
+	}
 }
 
+// addressHeaders may appear more than once in a message; repeated fields are combined into one list
+var addressHeaders = map[string]bool{"To": true, "Cc": true, "Bcc": true}
+
 // parseMessage reads and parses an email message from stdin
-// Supports standard sendmail input format with optional dot-termination
+// Supports standard sendmail input format with optional dot-termination.
+// Folded header lines are unfolded, and input that does not start with a header field is taken as body only.
 func parseMessage(r io.Reader, ignoreDots bool) (*EmailMessage, error) {
 	msg := &EmailMessage{
 		headers: make(map[string]string),
@@ -125,6 +300,7 @@ func parseMessage(r io.Reader, ignoreDots bool) (*EmailMessage, error) {
 
 	scanner := bufio.NewScanner(r)
 	inHeaders := true
+	lastKey := ""
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -135,13 +311,26 @@ func parseMessage(r io.Reader, ignoreDots bool) (*EmailMessage, error) {
 				continue
 			}
 
-			if strings.Contains(line, ":") {
-				parts := strings.SplitN(line, ":", 2)
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
+			// A line starting with whitespace continues the previous header (RFC 5322 section 2.2.3):
+			// unfolding only removes the line break, so the leading whitespace stays part of the value
+			if line[0] == ' ' || line[0] == '\t' {
+				if lastKey != "" {
+					msg.headers[lastKey] = strings.TrimSpace(msg.headers[lastKey] + line)
+					continue
+				}
+			} else if name, value, ok := strings.Cut(line, ":"); ok && validFieldName(name) {
+				key := textproto.CanonicalMIMEHeaderKey(name)
+				value = strings.TrimSpace(value)
+				if prev := msg.headers[key]; addressHeaders[key] && prev != "" && value != "" {
+					value = prev + ", " + value
+				}
 				msg.headers[key] = value
+				lastKey = key
+				continue
 			}
-			continue
+
+			// Not a header line, so the message has no (further) header block and this line starts the body
+			inHeaders = false
 		}
 
 		if !ignoreDots && line == "." {
@@ -159,35 +348,189 @@ func parseMessage(r io.Reader, ignoreDots bool) (*EmailMessage, error) {
 	return msg, nil
 }
 
-// sendToMHRS forwards an email request to the Mail Hub Relay Server over TCP.
-// It establishes a connection with timeout, marshals the request to JSON, and sends the data.
-// Returns an error if connection, marshaling, or sending fails.
-func sendToMHRS(req EmailRequest, cfg *config.Config) error {
-	dialer := net.Dialer{
-		Timeout: 30 * time.Second,
+// validFieldName reports whether name is a header field name: printable ASCII other than space and colon
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// sendToMHRS forwards an email request to the Mail Hub Relay Server and waits for delivery to complete.
+// Returns an error wrapping errDeliveryFailed if MHRS reports a failure, errUnauthorized if it rejects the
+// client token, or another error if MHRS is busy or the exchange itself fails.
+// With verbose set MHRS is asked for its delivery attempts, which are printed.
+func sendToMHRS(req protocol.EmailRequest, verbose bool, cfg *config.Config) error {
+	req.AttemptHistory = verbose
+	ack, err := exchange(req, cfg)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		printAttempts(os.Stdout, ack.Attempts)
+	}
+	return ackError(ack)
+}
+
+// printAttempts writes one line per delivery attempt, followed by the SMTP reply to it when there was one
+func printAttempts(w io.Writer, attempts []protocol.Attempt) {
+	for _, attempt := range attempts {
+		outcome := "sent"
+		if attempt.Error != "" {
+			outcome = "failed: " + attempt.Error
+		}
+		fmt.Fprintf(w, "Attempt %d at %s: %s\n", attempt.Number, attempt.Time.Format(time.RFC3339), outcome)
+		if attempt.Response != "" {
+			fmt.Fprintf(w, "  SMTP reply: %s\n", attempt.Response)
+		}
 	}
+}
 
-	conn, err := dialer.Dial("tcp", cfg.Server.InternalAddr)
+// exchange sends an email request to MHRS over a new connection and returns its acknowledgement
+func exchange(req protocol.EmailRequest, cfg *config.Config) (protocol.Ack, error) {
+	conn, err := dialMHRS(cfg)
 	if err != nil {
-		return fmt.Errorf("error connecting to MHRS: %w", err)
+		return protocol.Ack{}, err
 	}
 	defer conn.Close()
+	return roundTrip(conn, req, cfg)
+}
+
+// dialMHRS connects to MHRS at Server.InternalAddr, or at Server.InternalSocket when no address is set
+func dialMHRS(cfg *config.Config) (net.Conn, error) {
+	addr := cfg.Server.InternalAddr
+	if addr == "" {
+		addr = cfg.Server.InternalSocket
+	}
+
+	conn, err := protocol.Dial(addr, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to MHRS: %w", err)
+	}
+	return conn, nil
+}
+
+// roundTrip marshals the request to JSON, sends it as a length-prefixed frame on conn, and waits for
+// the acknowledgement MHRS returns once delivery has completed. The connection can be reused afterwards.
+func roundTrip(conn net.Conn, req protocol.EmailRequest, cfg *config.Config) (protocol.Ack, error) {
+	var ack protocol.Ack
 
 	// Set deadline for the write operation
 	if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
-		return fmt.Errorf("error setting write deadline: %w", err)
+		return ack, fmt.Errorf("error setting write deadline: %w", err)
 	}
 
 	jsonData, err := json.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("error creating JSON: %w", err)
+		return ack, fmt.Errorf("error creating JSON: %w", err)
 	}
 
-	jsonData = append(jsonData, '\n')
+	if err := protocol.WriteFrame(conn, jsonData); err != nil {
+		return ack, fmt.Errorf("error sending data: %w", err)
+	}
 
-	if _, err := conn.Write(jsonData); err != nil {
-		return fmt.Errorf("error sending data: %w", err)
+	// MHRS replies after all delivery attempts, so allow for its full processing timeout
+	if err := conn.SetReadDeadline(time.Now().Add(cfg.Server.Timeout + 30*time.Second)); err != nil {
+		return ack, fmt.Errorf("error setting read deadline: %w", err)
 	}
 
-	return nil
+	ackData, err := protocol.ReadFrame(conn, cfg.Server.MaxMessageBytes)
+	if err != nil {
+		return ack, fmt.Errorf("error reading acknowledgement: %w", err)
+	}
+
+	if err := json.Unmarshal(ackData, &ack); err != nil {
+		return ack, fmt.Errorf("error decoding acknowledgement: %w", err)
+	}
+	return ack, nil
+}
+
+// ackError converts an acknowledgement into the error sendToMHRS reports, or nil when delivery succeeded
+func ackError(ack protocol.Ack) error {
+	switch ack.Status {
+	case protocol.StatusOK:
+		return nil
+	case protocol.StatusBusy:
+		return fmt.Errorf("MHRS is busy: %s", ack.Message)
+	case protocol.StatusUnauthorized:
+		return fmt.Errorf("%w: %s", errUnauthorized, ack.Message)
+	case protocol.StatusError:
+		// A permanent unknown-user bounce maps to the sendmail exit status for an invalid recipient
+		if bounce := ack.Bounce; bounce != nil && bounce.Permanent && bounce.Category == protocol.BounceUserUnknown {
+			return fmt.Errorf("%w, %w: %s (request ID %s)", errDeliveryFailed, errRecipient, ack.Message, ack.RequestID)
+		}
+		return fmt.Errorf("%w: %s (request ID %s)", errDeliveryFailed, ack.Message, ack.RequestID)
+	default:
+		return fmt.Errorf("%w: %s (request ID %s)", errDeliveryFailed, ack.Message, ack.RequestID)
+	}
+}
+
+// runTest sends a canned test email to recipients without reading a message, then prints the
+// acknowledgement and how long the round trip through MHRS took, and with verbose set the delivery attempts.
+// Returns the process exit code.
+func runTest(recipients []string, verbose bool, cfg *config.Config) int {
+	if len(recipients) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: mhrc -test recipient...")
+		return EX_USAGE
+	}
+	to, _, _, err := collectRecipients(recipients, &EmailMessage{headers: map[string]string{}, body: &bytes.Buffer{}}, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid recipient: %v\n", err)
+		return EX_NOUSER
+	}
+
+	hostname, _ := os.Hostname()
+	sent := time.Now()
+	req := protocol.EmailRequest{
+		Recipient: strings.Join(to, ", "),
+		Subject:   "MailHubRelay test message",
+		Body: []byte(fmt.Sprintf("This is a test message sent with mhrc -test from %s at %s.\n"+
+			"Its arrival confirms that MHRC, MHRS and the SMTP server are working together.\n",
+			hostname, sent.Format(time.RFC1123Z))),
+		AuthToken:      cfg.Server.ClientToken,
+		AttemptHistory: verbose,
+	}
+
+	addr := cfg.Server.InternalAddr
+	if addr == "" {
+		addr = cfg.Server.InternalSocket
+	}
+	fmt.Printf("Sending test message to %s via %s\n", req.Recipient, addr)
+
+	ack, err := exchange(req, cfg)
+	elapsed := time.Since(sent).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error after %s: %v\n", elapsed, err)
+		return EX_TEMPFAIL
+	}
+
+	fmt.Printf("Status:     %s\n", ack.Status)
+	if ack.Message != "" {
+		fmt.Printf("Message:    %s\n", ack.Message)
+	}
+	fmt.Printf("Request ID: %s\n", ack.RequestID)
+	fmt.Printf("Elapsed:    %s\n", elapsed)
+	printAttempts(os.Stdout, ack.Attempts)
+	return exitCode(ackError(ack))
+}
+
+// runCheckConfig loads and validates the configuration without sending mail.
+// Returns the process exit code: 0 when the configuration is valid, 1 otherwise.
+func runCheckConfig() int {
+	_, configExists, err := config.Load(appName, configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration\n%v\n", configPath, err)
+		return 1
+	}
+	if !configExists {
+		fmt.Printf("%s: not found, default configuration is valid\n", configPath)
+		return 0
+	}
+	fmt.Printf("%s: configuration is valid\n", configPath)
+	return 0
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"mailhubrelay/internal/protocol"
+)
+
+func TestParseMessageFoldedSubject(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unfolded", "Subject: Quarterly report\n\nbody\n", "Quarterly report"},
+		{"space continuation", "Subject: Quarterly\n report\n\nbody\n", "Quarterly report"},
+		{"tab continuation", "Subject: Quarterly\n\treport\n\nbody\n", "Quarterly\treport"},
+		{"several continuations", "Subject: Quarterly\n report\n for\n  Q3\n\nbody\n", "Quarterly report for  Q3"},
+		{"crlf line endings", "Subject: Quarterly\r\n report\r\n\r\nbody\r\n", "Quarterly report"},
+		{"folded after other header", "From: a@example.com\nSubject:\n Quarterly report\nX-Mailer: cron\n\nbody\n", "Quarterly report"},
+		{"encoded word kept", "Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\n =?UTF-8?Q?_aus_Wien?=\n\nbody\n", "=?UTF-8?Q?Gr=C3=BC=C3=9Fe?= =?UTF-8?Q?_aus_Wien?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage(strings.NewReader(tt.input), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.headers["Subject"]; got != tt.want {
+				t.Errorf("Subject = %q, want %q", got, tt.want)
+			}
+			if got := msg.body.String(); got != "body\n" {
+				t.Errorf("body = %q, want %q", got, "body\n")
+			}
+		})
+	}
+}
+
+func TestParseMessageFoldedAddressLists(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		to, cc []string
+	}{
+		{
+			name:  "folded to",
+			input: "To: a@example.com,\n b@example.com,\n\tc@example.com\nSubject: s\n\nbody\n",
+			to:    []string{"a@example.com", "b@example.com", "c@example.com"},
+		},
+		{
+			name:  "folded display names",
+			input: "To: \"Doe, Jane\"\n <jane@example.com>, John\n Smith <john@example.com>\n\nbody\n",
+			to:    []string{`"Doe, Jane" <jane@example.com>`, `"John Smith" <john@example.com>`},
+		},
+		{
+			name:  "folded cc",
+			input: "To: a@example.com\nCc: b@example.com,\n  c@example.com\n\nbody\n",
+			to:    []string{"a@example.com"},
+			cc:    []string{"b@example.com", "c@example.com"},
+		},
+		{
+			name:  "repeated folded to",
+			input: "To: a@example.com,\n b@example.com\nTo: c@example.com\nCc:\n d@example.com\n\nbody\n",
+			to:    []string{"a@example.com", "b@example.com", "c@example.com"},
+			cc:    []string{"d@example.com"},
+		},
+		{
+			name:  "crlf line endings",
+			input: "To: a@example.com,\r\n b@example.com\r\nCc: c@example.com,\r\n\td@example.com\r\n\r\nbody\r\n",
+			to:    []string{"a@example.com", "b@example.com"},
+			cc:    []string{"c@example.com", "d@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage(strings.NewReader(tt.input), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to, cc, bcc, err := collectRecipients(nil, msg, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(to, tt.to) || !slices.Equal(cc, tt.cc) || len(bcc) != 0 {
+				t.Errorf("recipients = to %q, cc %q, bcc %q, want to %q, cc %q", to, cc, bcc, tt.to, tt.cc)
+			}
+		})
+	}
+}
+
+func TestParseMessageBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		ignoreDots bool
+		headers    int
+		body       string
+	}{
+		{"dot terminates", "Subject: s\n\nline\n.\nafter\n", false, 1, "line\n"},
+		{"dot kept with ignore dots", "Subject: s\n\nline\n.\nafter\n", true, 1, "line\n.\nafter\n"},
+		{"body only", "just text\nmore\n", false, 0, "just text\nmore\n"},
+		{"leading continuation is body", " indented\n\nrest\n", false, 0, " indented\n\nrest\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage(strings.NewReader(tt.input), tt.ignoreDots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.headers) != tt.headers || msg.body.String() != tt.body {
+				t.Errorf("headers %q, body %q, want %d headers and body %q", msg.headers, msg.body, tt.headers, tt.body)
+			}
+		})
+	}
+}
+
+func TestPrintAttempts(t *testing.T) {
+	start := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	var out bytes.Buffer
+	printAttempts(&out, []protocol.Attempt{
+		{Number: 1, Time: start, Error: `failed to send email: 451 "try again later"`, Response: "451 try again later"},
+		{Number: 2, Time: start.Add(time.Minute), Error: "connection refused"},
+		{Number: 3, Time: start.Add(2 * time.Minute), Response: "250 2.0.0 Ok: queued as 4F2A1"},
+	})
+
+	want := `Attempt 1 at 2026-10-16T09:30:00Z: failed: failed to send email: 451 "try again later"
+  SMTP reply: 451 try again later
+Attempt 2 at 2026-10-16T09:31:00Z: failed: connection refused
+Attempt 3 at 2026-10-16T09:32:00Z: sent
+  SMTP reply: 250 2.0.0 Ok: queued as 4F2A1
+`
+	if out.String() != want {
+		t.Errorf("printAttempts wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHasInput(t *testing.T) {
+	pipe := func(t *testing.T, write func(w *os.File)) *os.File {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close(); w.Close() })
+		write(w)
+		return r
+	}
+	file := func(t *testing.T, content string) *os.File {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "stdin")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	tests := []struct {
+		name  string
+		input func(t *testing.T) *os.File
+		want  bool
+	}{
+		{"pipe with data", func(t *testing.T) *os.File { return pipe(t, func(w *os.File) { w.WriteString("Subject: x\n") }) }, true},
+		{"closed empty pipe", func(t *testing.T) *os.File { return pipe(t, func(w *os.File) { w.Close() }) }, false},
+		{"idle open pipe", func(t *testing.T) *os.File { return pipe(t, func(*os.File) {}) }, false},
+		{"file with data", func(t *testing.T) *os.File { return file(t, "Subject: x\n") }, true},
+		{"empty file", func(t *testing.T) *os.File { return file(t, "") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasInput(tt.input(t), 50*time.Millisecond); got != tt.want {
+				t.Errorf("hasInput = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	if hasInput(devNull, 50*time.Millisecond) {
+		t.Error("hasInput(/dev/null) = true, want false")
+	}
+}
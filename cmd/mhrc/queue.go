@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/protocol"
+)
+
+// runQueueStatus asks MHRS for the contents of its persistent queue and prints them in the format of
+// sendmail -bp. Returns the process exit code.
+func runQueueStatus(cfg *config.Config) int {
+	ack, err := exchange(protocol.EmailRequest{Command: protocol.CommandQueueStatus, AuthToken: cfg.Server.ClientToken}, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying mail queue: %v\n", err)
+		return EX_TEMPFAIL
+	}
+	if err := ackError(ack); err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying mail queue: %v\n", err)
+		return exitCode(err)
+	}
+	if ack.Queue == nil {
+		fmt.Fprintln(os.Stderr, "Error querying mail queue: MHRS does not support queue status queries")
+		return EX_UNAVAILABLE
+	}
+
+	printQueue(os.Stdout, ack.Queue)
+	return EX_OK
+}
+
+// printQueue writes a queue listing: one block per message with its ID, size, queue time and sender,
+// the state of its delivery in parentheses, and one line per recipient
+func printQueue(w io.Writer, status *protocol.QueueStatus) {
+	switch {
+	case !status.Enabled:
+		fmt.Fprintln(w, "Mail queue is empty (MHRS runs without a persistent queue)")
+		return
+	case status.Count == 0:
+		fmt.Fprintln(w, "Mail queue is empty")
+		return
+	}
+
+	requests := "requests"
+	if status.Count == 1 {
+		requests = "request"
+	}
+	fmt.Fprintf(w, "\t\tMHRS mail queue (%d %s)\n", status.Count, requests)
+	fmt.Fprintf(w, "%-32s %8s %-16s %s\n", "--------------Q-ID--------------", "--Size--", "-----Q-Time-----", "------------Sender/Recipient-----------")
+
+	const indent = 32 + 1 + 8 + 1 + 16 + 1
+	for _, msg := range status.Messages {
+		fmt.Fprintf(w, "%-32s %8d %-16s <%s>\n", msg.ID, msg.Size, msg.QueuedAt.Local().Format("Mon Jan _2 15:04"), msg.Sender)
+		state := msg.State
+		if msg.State == protocol.QueueStateScheduled && msg.SendAt != nil {
+			state = "scheduled for " + msg.SendAt.Local().Format("Mon Jan _2 15:04:05 2006")
+		}
+		switch {
+		case msg.Attempts == 1:
+			state += ", 1 attempt"
+		case msg.Attempts > 1:
+			state = fmt.Sprintf("%s, %d attempts", state, msg.Attempts)
+		}
+		if msg.LastError != "" {
+			state += ": " + strings.Join(strings.Fields(msg.LastError), " ")
+		}
+		fmt.Fprintf(w, "%*s(%s)\n", 8, "", state)
+		for _, recipient := range msg.Recipients {
+			fmt.Fprintf(w, "%*s<%s>\n", indent, "", recipient)
+		}
+	}
+	if len(status.Messages) < status.Count {
+		fmt.Fprintf(w, "\t\t... %d more not listed\n", status.Count-len(status.Messages))
+	}
+	fmt.Fprintf(w, "\t\tTotal requests: %d\n", status.Count)
+}
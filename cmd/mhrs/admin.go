@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+)
+
+// startAdminServers starts the optional HTTP endpoints (metrics, health, events).
+// Endpoints configured on the same address share a single listener.
+func startAdminServers(ctx context.Context, cfg *config.Config) {
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(addr string) *http.ServeMux {
+		if mux, ok := muxes[addr]; ok {
+			return mux
+		}
+		mux := http.NewServeMux()
+		muxes[addr] = mux
+		return mux
+	}
+
+	if cfg.Server.MetricsAddr != "" {
+		muxFor(cfg.Server.MetricsAddr).Handle("/metrics", metricsRegistry.Handler())
+	}
+
+	if cfg.Server.HealthAddr != "" {
+		mux := muxFor(cfg.Server.HealthAddr)
+		mux.HandleFunc("/healthz", handleLiveness)
+		mux.Handle("/readyz", newReadinessProbe(cfg))
+	}
+
+	if events != nil {
+		muxFor(cfg.Server.EventsAddr).Handle("/events", events)
+	}
+
+	for addr, mux := range muxes {
+		go serveHTTP(ctx, addr, mux)
+	}
+}
+
+// serveHTTP runs an HTTP server on addr until the context is cancelled
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info(ctx, "Admin HTTP server started", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(ctx, "Admin HTTP server error", "error", err.Error(), "addr", addr)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+
+	"github.com/jordan-wright/email"
+)
+
+// Audit log formats
+const (
+	auditFormatJSON = "json" // One JSON object per line
+	auditFormatText = "text" // One line of key=value pairs, values with spaces or quotes quoted
+)
+
+// Audit outcomes of a send attempt
+const (
+	auditSent   = "sent"
+	auditFailed = "failed"
+	auditDryRun = "dry-run"
+)
+
+// audit records every send attempt when Server.AuditLog is set; nil disables it
+var audit *auditLog
+
+// auditRecord is the metadata logged for one send attempt. Message content is never recorded.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"` // Address of the client connection that submitted the request
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Cc        []string  `json:"cc,omitempty"`
+	Bcc       []string  `json:"bcc,omitempty"`
+	Subject   string    `json:"subject"`
+	Size      int64     `json:"size"` // Bytes of text body, HTML body and attachments
+	Attempt   int       `json:"attempt"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditLog appends records to an append-only file that is rotated by size. Rotated files are renamed
+// path.1 (newest) to path.N, and the oldest is removed.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	format   string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// openAuditLog opens the audit log configured in Server.AuditLog
+func openAuditLog(cfg *config.Config) (*auditLog, error) {
+	a := &auditLog{}
+	if err := a.reopen(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reopen applies the audit settings of cfg and reopens the file, so a file moved away by an external
+// rotation tool is replaced by a new one. It does nothing when a is nil.
+func (a *auditLog) reopen(cfg *config.Config) error {
+	if a == nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(cfg.Server.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.path, a.format = cfg.Server.AuditLog, cfg.Server.AuditLogFormat
+	a.maxBytes, a.maxFiles = cfg.Server.AuditMaxBytes, cfg.Server.AuditMaxFiles
+	a.file, a.size = file, info.Size()
+	return nil
+}
+
+// close closes the file; it does nothing when a is nil
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// record appends the outcome of a send attempt. Write failures are logged but never fail the send.
+func (a *auditLog) record(ctx context.Context, e *email.Email, attempt int, result error) {
+	rec := auditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: requestID(ctx),
+		Client:    clientAddr(ctx),
+		From:      e.From,
+		To:        e.To,
+		Cc:        e.Cc,
+		Bcc:       e.Bcc,
+		Subject:   e.Subject,
+		Size:      emailSize(e),
+		Attempt:   attempt,
+		Outcome:   auditSent,
+	}
+	switch {
+	case result != nil:
+		rec.Outcome, rec.Error = auditFailed, result.Error()
+	case dryRun:
+		rec.Outcome = auditDryRun
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	line, err := a.encode(rec)
+	if err == nil {
+		err = a.write(line)
+	}
+	if err != nil {
+		logger.Error(ctx, "Failed to write audit record", "request_id", requestID(ctx), "error", err.Error(), "audit_log", a.path)
+	}
+}
+
+// encode renders rec as a single line in the configured format
+func (a *auditLog) encode(rec auditRecord) ([]byte, error) {
+	if a.format == auditFormatJSON {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+
+	var b strings.Builder
+	field := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		if value == "" || strings.ContainsAny(value, " \t\"=\\") || !strconv.CanBackquote(value) {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(key + "=" + value)
+	}
+	field("time", rec.Time.Format(time.RFC3339Nano))
+	field("request_id", rec.RequestID)
+	field("client", rec.Client)
+	field("from", rec.From)
+	field("to", strings.Join(rec.To, ","))
+	if len(rec.Cc) > 0 {
+		field("cc", strings.Join(rec.Cc, ","))
+	}
+	if len(rec.Bcc) > 0 {
+		field("bcc", strings.Join(rec.Bcc, ","))
+	}
+	field("subject", rec.Subject)
+	field("size", strconv.FormatInt(rec.Size, 10))
+	field("attempt", strconv.Itoa(rec.Attempt))
+	field("outcome", rec.Outcome)
+	if rec.Error != "" {
+		field("error", rec.Error)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String()), nil
+}
+
+// write appends line, rotating first when it would take the file past maxBytes; the caller must hold a.mu
+func (a *auditLog) write(line []byte) error {
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated files up by one, moves the current file to path.1 and starts a new one;
+// the caller must hold a.mu
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log for rotation: %w", err)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log after rotation: %w", err)
+	}
+	a.file, a.size = file, 0
+	return nil
+}
+
+// auditSender records every send attempt of one request in the audit log
+type auditSender struct {
+	next     Sender
+	log      *auditLog
+	attempts int
+}
+
+// auditing wraps sender so its attempts are audited; sender is returned unchanged when auditing is disabled
+func auditing(sender Sender) Sender {
+	if audit == nil {
+		return sender
+	}
+	return &auditSender{next: sender, log: audit}
+}
+
+// Send forwards to the wrapped sender and records the outcome
+func (s *auditSender) Send(ctx context.Context, e *email.Email) error {
+	s.attempts++
+	err := s.next.Send(ctx, e)
+	s.log.record(ctx, e, s.attempts, err)
+	return err
+}
+
+// emailSize returns the size of an email's text body, HTML body and attachments
+func emailSize(e *email.Email) int64 {
+	size := int64(len(e.Text) + len(e.HTML))
+	for _, attachment := range e.Attachments {
+		size += int64(len(attachment.Content))
+	}
+	return size
+}
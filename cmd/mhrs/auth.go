@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+)
+
+const (
+	authMethodAuto    = "auto"
+	authMethodPlain   = "plain"
+	authMethodLogin   = "login"
+	authMethodCRAMMD5 = "cram-md5"
+	authMethodXOAuth2 = "xoauth2"
+
+	// tokenRefreshMargin is how long before expiry a cached access token is considered stale
+	tokenRefreshMargin = time.Minute
+)
+
+// authMechanisms maps configured auth methods to their SASL mechanism names
+var authMechanisms = map[string]string{
+	authMethodPlain:   "PLAIN",
+	authMethodLogin:   "LOGIN",
+	authMethodCRAMMD5: "CRAM-MD5",
+	authMethodXOAuth2: "XOAUTH2",
+}
+
+// autoAuthOrder is the preference order for password mechanisms when SMTP.AuthMethod is "auto"
+var autoAuthOrder = []string{authMethodPlain, authMethodLogin, authMethodCRAMMD5}
+
+// oauth2Tokens caches the access token used for XOAUTH2 across send attempts
+var oauth2Tokens tokenSource
+
+// selectAuthMethod picks the auth method to use from the mechanisms the server advertised in its AUTH extension.
+// A specific SMTP.AuthMethod must be advertised; "auto" takes the first supported password mechanism.
+func selectAuthMethod(configured string, advertised string) (string, error) {
+	offered := make(map[string]bool)
+	for _, mech := range strings.Fields(advertised) {
+		offered[strings.ToUpper(mech)] = true
+	}
+
+	if configured != authMethodAuto {
+		if !offered[authMechanisms[configured]] {
+			return "", fmt.Errorf("SMTP server does not support %s authentication (offers: %s)", authMechanisms[configured], advertised)
+		}
+		return configured, nil
+	}
+
+	for _, method := range autoAuthOrder {
+		if offered[authMechanisms[method]] {
+			return method, nil
+		}
+	}
+	return "", fmt.Errorf("no mutually supported SMTP auth mechanism (server offers: %s)", advertised)
+}
+
+// buildAuth returns the SMTP authentication mechanism for method
+func buildAuth(ctx context.Context, smtpCfg *config.SMTPConfig, method string) (smtp.Auth, error) {
+	switch method {
+	case authMethodPlain:
+		return smtp.PlainAuth("", smtpCfg.AuthUser, smtpCfg.AuthPass, smtpCfg.Host), nil
+	case authMethodLogin:
+		return &loginAuth{username: smtpCfg.AuthUser, password: smtpCfg.AuthPass}, nil
+	case authMethodCRAMMD5:
+		return smtp.CRAMMD5Auth(smtpCfg.AuthUser, smtpCfg.AuthPass), nil
+	case authMethodXOAuth2:
+		token, err := oauth2Tokens.get(ctx, smtpCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain OAuth2 access token: %w", err)
+		}
+		return &xoauth2Auth{username: smtpCfg.AuthUser, token: token}, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth method %q", method)
+	}
+}
+
+// loginAuth implements the LOGIN mechanism, answering the username and password prompts in turn
+type loginAuth struct {
+	username string
+	password string
+}
+
+// Start begins the LOGIN exchange. Like smtp.PlainAuth it refuses to send credentials over an unencrypted connection.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers the server's Username and Password prompts
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 SASL mechanism using a bearer access token
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+// Start sends the initial XOAUTH2 client response containing the user and bearer token
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+// Next answers a server challenge, which for XOAUTH2 only happens on failure.
+// An empty response is sent so the server completes the exchange with its error status.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// tokenSource fetches access tokens with the OAuth2 client credentials grant and caches them until shortly before expiry
+type tokenSource struct {
+	mu        sync.Mutex
+	key       string
+	token     string
+	expiresAt time.Time
+}
+
+// tokenResponse is the subset of the OAuth2 token endpoint response used here
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// get returns a valid access token, requesting a new one when the cache is empty, stale,
+// or was issued for a different endpoint or client
+func (s *tokenSource) get(ctx context.Context, cfg *config.SMTPConfig) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := cfg.OAuthTokenURL + "|" + cfg.OAuthClientID
+	if s.key == key && s.token != "" && time.Now().Add(tokenRefreshMargin).Before(s.expiresAt) {
+		return s.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {cfg.OAuthClientID},
+		"client_secret": {cfg.OAuthClientSecret},
+	}
+	if cfg.OAuthScope != "" {
+		form.Set("scope", cfg.OAuthScope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.OAuthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned no access token")
+	}
+
+	s.key = key
+	s.token = tr.AccessToken
+	s.expiresAt = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return s.token, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"regexp"
+
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+// enhancedCodePattern matches the RFC 3463 status code servers put at the start of a reply, e.g. "5.1.1 User unknown"
+var enhancedCodePattern = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// enhancedCategories maps the subject and detail of an RFC 3463 status code to a bounce category.
+// An entry for a whole subject ("7") applies to every detail without an entry of its own.
+var enhancedCategories = map[string]string{
+	"1.0": protocol.BounceUserUnknown, // Other address status
+	"1.1": protocol.BounceUserUnknown, // Bad destination mailbox address
+	"1.2": protocol.BounceUserUnknown, // Bad destination system address
+	"1.3": protocol.BounceUserUnknown, // Bad destination mailbox address syntax
+	"1.6": protocol.BounceUserUnknown, // Destination mailbox has moved
+	"2.1": protocol.BounceUserUnknown, // Mailbox disabled, not accepting messages
+	"2.2": protocol.BounceMailboxFull, // Mailbox full
+	"2.3": protocol.BounceMessageTooLarge,
+	"3.4": protocol.BounceMessageTooLarge,
+	"5.3": protocol.BouncePolicy, // Too many recipients
+	"7":   protocol.BouncePolicy, // Security or policy status
+}
+
+// replyCategories maps basic SMTP reply codes to a bounce category for replies without an enhanced status code
+var replyCategories = map[int]string{
+	452: protocol.BounceMailboxFull, // Insufficient system storage
+	550: protocol.BounceUserUnknown, // Mailbox unavailable
+	551: protocol.BounceUserUnknown, // User not local
+	552: protocol.BounceMailboxFull, // Exceeded storage allocation
+	553: protocol.BounceUserUnknown, // Mailbox name not allowed
+	554: protocol.BouncePolicy,      // Transaction failed
+}
+
+// classifyBounce returns the SMTP rejection behind err, or nil when err does not contain an SMTP reply.
+// The enhanced status code takes precedence over the basic reply code, since servers use 550 for
+// unknown users and policy rejections alike.
+func classifyBounce(err error) *protocol.Bounce {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return nil
+	}
+
+	bounce := &protocol.Bounce{
+		Category:  protocol.BounceOther,
+		Code:      tpErr.Code,
+		Permanent: tpErr.Code >= 500,
+		Response:  tpErr.Msg,
+	}
+	if category, ok := replyCategories[tpErr.Code]; ok {
+		bounce.Category = category
+	}
+
+	if match := enhancedCodePattern.FindStringSubmatch(tpErr.Msg); match != nil {
+		bounce.EnhancedCode = match[1] + "." + match[2] + "." + match[3]
+		if category, ok := enhancedCategories[match[2]+"."+match[3]]; ok {
+			bounce.Category = category
+		} else if category, ok := enhancedCategories[match[2]]; ok {
+			bounce.Category = category
+		} else {
+			bounce.Category = protocol.BounceOther
+		}
+	}
+	return bounce
+}
+
+// recordBounce counts and logs the SMTP rejection behind a failed email, if there is one
+func recordBounce(ctx context.Context, err error) {
+	bounce := classifyBounce(err)
+	if bounce == nil {
+		return
+	}
+	bounces.Inc(bounce.Category)
+	logger.Info(ctx, "Email bounced by SMTP server",
+		"request_id", requestID(ctx),
+		"category", bounce.Category,
+		"code", bounce.Code,
+		"enhanced_code", bounce.EnhancedCode,
+		"permanent", bounce.Permanent)
+}
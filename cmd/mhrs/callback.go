@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+
+	"github.com/jordan-wright/email"
+)
+
+// callbackQueueSize bounds the number of callbacks waiting for a worker; further results are dropped
+const callbackQueueSize = 1000
+
+// callbacks delivers final send results to request callback URLs; nil until startCallbacks is called
+var callbacks *callbackPool
+
+// callbackJob is a result waiting to be posted
+type callbackJob struct {
+	ctx    context.Context
+	url    string
+	result protocol.CallbackResult
+}
+
+// callbackPool posts results from a fixed number of workers so slow callback endpoints never hold up mail processing
+type callbackPool struct {
+	jobs    chan callbackJob
+	client  *http.Client
+	retries int
+	delay   time.Duration
+	wg      sync.WaitGroup
+}
+
+// startCallbacks starts the callback workers configured in Server.CallbackWorkers
+func startCallbacks(ctx context.Context, cfg *config.Config) *callbackPool {
+	p := &callbackPool{
+		jobs:    make(chan callbackJob, callbackQueueSize),
+		client:  &http.Client{Timeout: cfg.Server.CallbackTimeout},
+		retries: cfg.Server.CallbackMaxRetries,
+		delay:   cfg.Server.RetryDelay,
+	}
+	for i := 0; i < cfg.Server.CallbackWorkers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	logger.Debug(ctx, "Callback workers started", "workers", cfg.Server.CallbackWorkers)
+	return p
+}
+
+// notify schedules the final result of req for posting to its callback URL.
+// It does nothing when p is nil or the request has no callback URL, and never blocks.
+func (p *callbackPool) notify(ctx context.Context, req protocol.EmailRequest, attempts int, result error) {
+	if p == nil || req.CallbackURL == "" {
+		return
+	}
+	if err := validateCallbackURL(req.CallbackURL); err != nil {
+		return
+	}
+
+	job := callbackJob{
+		ctx: ctx,
+		url: req.CallbackURL,
+		result: protocol.CallbackResult{
+			RequestID: requestID(ctx),
+			Recipient: req.Recipient,
+			Outcome:   protocol.OutcomeSent,
+			Attempts:  attempts,
+			Timestamp: time.Now().UTC(),
+		},
+	}
+	if result != nil {
+		job.result.Outcome, job.result.Error = protocol.OutcomeFailed, result.Error()
+		job.result.Bounce = classifyBounce(result)
+	}
+
+	select {
+	case p.jobs <- job:
+	default:
+		logger.Warn(ctx, "Callback queue full, dropping callback", "request_id", requestID(ctx), "callback_url", req.CallbackURL)
+	}
+}
+
+// close stops accepting callbacks and waits up to timeout for queued ones to be posted
+func (p *callbackPool) close(timeout time.Duration) bool {
+	if p == nil {
+		return true
+	}
+	close(p.jobs)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// work posts queued callbacks until the pool is closed
+func (p *callbackPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		p.deliver(job)
+	}
+}
+
+// deliver posts a single result, retrying failed attempts with a growing delay
+func (p *callbackPool) deliver(job callbackJob) {
+	body, err := json.Marshal(job.result)
+	if err != nil {
+		logger.Error(job.ctx, "Failed to encode callback", "request_id", job.result.RequestID, "error", err.Error())
+		return
+	}
+
+	for attempt := 1; attempt <= p.retries; attempt++ {
+		err = p.post(job.url, body)
+		if err == nil {
+			logger.Debug(job.ctx, "Callback delivered", "request_id", job.result.RequestID, "callback_url", job.url, "attempt", attempt)
+			return
+		}
+		if attempt < p.retries {
+			time.Sleep(time.Duration(attempt) * p.delay)
+		}
+	}
+	logger.Warn(job.ctx, "Callback delivery failed",
+		"request_id", job.result.RequestID,
+		"callback_url", job.url,
+		"attempts", p.retries,
+		"error", err.Error())
+}
+
+// post sends body to target and treats any non-2xx response as a failure
+func (p *callbackPool) post(target string, body []byte) error {
+	resp, err := p.client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// validateCallbackURL checks that raw is an absolute http or https URL
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback URL must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// countingSender counts the Send calls made through it so callbacks can report the number of attempts
+type countingSender struct {
+	next     Sender
+	attempts int
+}
+
+// Send forwards to the wrapped sender
+func (s *countingSender) Send(ctx context.Context, e *email.Email) error {
+	s.attempts++
+	return s.next.Send(ctx, e)
+}
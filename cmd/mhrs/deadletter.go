@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+// ErrDeadLetterFull is returned when the dead-letter directory has reached its file count or size cap
+var ErrDeadLetterFull = errors.New("dead-letter directory is full")
+
+// DeadLetter is the on-disk record of an email that could not be delivered
+type DeadLetter struct {
+	RequestID string                `json:"request_id"` // ID the request was logged under
+	FailedAt  time.Time             `json:"failed_at"`  // Time delivery was given up
+	Reason    string                `json:"reason"`     // Final delivery error
+	Request   protocol.EmailRequest `json:"request"`    // Original email request, suitable for resending
+}
+
+// DeadLetters stores permanently failed emails as JSON files for an operator to inspect and resend.
+// New records are refused once maxFiles or maxBytes is reached so a failing relay cannot fill the disk.
+type DeadLetters struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+	mu       sync.Mutex
+}
+
+// OpenDeadLetters prepares the dead-letter directory and returns a store bound to it
+func OpenDeadLetters(dir string, maxFiles int, maxBytes int64) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+	return &DeadLetters{dir: dir, maxFiles: maxFiles, maxBytes: maxBytes}, nil
+}
+
+// Add records a failed request and returns the path of the written file
+func (d *DeadLetters) Add(requestID string, req protocol.EmailRequest, reason error) (string, error) {
+	data, err := json.MarshalIndent(DeadLetter{
+		RequestID: requestID,
+		FailedAt:  time.Now(),
+		Reason:    reason.Error(),
+		Request:   req,
+	}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count, size, err := d.usage()
+	if err != nil {
+		return "", err
+	}
+	if count >= d.maxFiles || size+int64(len(data)) > d.maxBytes {
+		return "", ErrDeadLetterFull
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(d.dir, id+queueFileExt)
+	tmpPath := filepath.Join(d.dir, "."+id+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to commit dead letter: %w", err)
+	}
+	return path, nil
+}
+
+// record stores a request that failed permanently and logs the outcome.
+// It does nothing when d is nil, which is how dead-lettering is disabled.
+func (d *DeadLetters) record(ctx context.Context, req protocol.EmailRequest, reason error) {
+	if d == nil {
+		return
+	}
+
+	path, err := d.Add(requestID(ctx), req, reason)
+	if err != nil {
+		logger.Error(ctx, "Failed to write dead letter", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+		return
+	}
+	logger.Warn(ctx, "Failed email written to dead-letter directory", "request_id", requestID(ctx), "file", path, "recipient", req.Recipient)
+}
+
+// usage returns the number and total size of stored records; the caller must hold d.mu
+func (d *DeadLetters) usage() (int, int64, error) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read dead-letter directory: %w", err)
+	}
+
+	count := 0
+	var size int64
+	for _, file := range files {
+		if file.IsDir() || !isQueueFile(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		count++
+		size += info.Size()
+	}
+	return count, size, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+)
+
+// dkimHeaders are the headers covered by the signature, when present in the message
+var dkimHeaders = []string{"From", "To", "Subject", "Date", "Message-ID"}
+
+// dkimSigner adds DKIM-Signature headers using the key configured in Server.DKIMKeyFile.
+// The key is loaded on first use and again whenever the file path or modification time changes.
+type dkimSigner struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	key     crypto.Signer
+}
+
+// sign returns msg with a DKIM-Signature header prepended, or msg unchanged when no key is configured.
+// The signature uses relaxed/relaxed canonicalization and rsa-sha256 or ed25519-sha256 depending on the key.
+func (d *dkimSigner) sign(msg []byte, cfg *config.Config) ([]byte, error) {
+	if cfg.Server.DKIMKeyFile == "" {
+		return msg, nil
+	}
+	key, err := d.load(cfg.Server.DKIMKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = msg, nil
+	}
+	fields := parseHeaderFields(header)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	algorithm := "rsa-sha256"
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+
+	// Sign the last instance of each listed header, as verifiers select them bottom-up
+	var signed []string
+	hash := sha256.New()
+	for _, name := range dkimHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				hash.Write([]byte(relaxedHeader(fields[i].name, fields[i].value) + "\r\n"))
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, cfg.Server.DKIMDomain, cfg.Server.DKIMSelector, time.Now().Unix(),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	hash.Write([]byte(relaxedHeader("DKIM-Signature", value)))
+
+	var signature []byte
+	if algorithm == "ed25519-sha256" {
+		signature, err = key.Sign(rand.Reader, hash.Sum(nil), crypto.Hash(0))
+	} else {
+		signature, err = key.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute signature: %w", err)
+	}
+
+	out := make([]byte, 0, len(msg)+len(value)+512)
+	out = append(out, "DKIM-Signature: "+value+base64.StdEncoding.EncodeToString(signature)+"\r\n"...)
+	return append(out, msg...), nil
+}
+
+// load returns the signing key at path, reading it again when the file has changed since the last call
+func (d *dkimSigner) load(path string) (crypto.Signer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM key: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.key != nil && d.path == path && d.modTime.Equal(info.ModTime()) {
+		return d.key, nil
+	}
+
+	key, err := loadDKIMKey(path)
+	if err != nil {
+		return nil, err
+	}
+	d.path, d.modTime, d.key = path, info.ModTime(), key
+	return key, nil
+}
+
+// loadDKIMKey reads a PEM-encoded RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private key
+func loadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("DKIM key %s is not PEM encoded", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM key %s: %w", path, err)
+	}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, errors.New("DKIM key must be an RSA or Ed25519 private key")
+	}
+}
+
+// headerField is a single message header with continuation lines still attached to value
+type headerField struct {
+	name  string
+	value string
+}
+
+// parseHeaderFields splits a CRLF-separated header block into fields, keeping folded lines with their field
+func parseHeaderFields(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1].value += "\r\n" + line
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields = append(fields, headerField{name: name, value: value})
+		}
+	}
+	return fields
+}
+
+// relaxedHeader applies the relaxed header canonicalization of RFC 6376 section 3.4.2, without the trailing CRLF
+func relaxedHeader(name, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+// relaxedBody applies the relaxed body canonicalization of RFC 6376 section 3.4.4
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWSP replaces every run of spaces and tabs in line with a single space
+func collapseWSP(line string) string {
+	var b strings.Builder
+	inWSP := false
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
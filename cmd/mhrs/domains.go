@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"mailhubrelay/internal/config"
+
+	"github.com/jordan-wright/email"
+)
+
+// checkRecipientDomains rejects the email when a recipient's domain is listed in Server.BlockedRecipientDomains,
+// or when Server.AllowedRecipientDomains is set and does not list it. Empty lists place no restriction.
+func checkRecipientDomains(e *email.Email, cfg *config.Config) error {
+	allowed, blocked := cfg.Server.AllowedRecipientDomains, cfg.Server.BlockedRecipientDomains
+	if len(allowed) == 0 && len(blocked) == 0 {
+		return nil
+	}
+
+	for _, addr := range slices.Concat(e.To, e.Cc, e.Bcc) {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("invalid recipient: %w", err)
+		}
+		_, domain, _ := strings.Cut(parsed.Address, "@")
+		domain = strings.ToLower(domain)
+
+		if matchDomain(domain, blocked) {
+			return fmt.Errorf("recipient domain %q is blocked", domain)
+		}
+		if len(allowed) > 0 && !matchDomain(domain, allowed) {
+			return fmt.Errorf("recipient domain %q is not allowed", domain)
+		}
+	}
+	return nil
+}
+
+// matchDomain reports whether domain matches any pattern. Patterns match a domain exactly and case-insensitively,
+// except "*.example.com" which matches any subdomain of example.com but not example.com itself.
+func matchDomain(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if len(domain) > len(suffix) && strings.HasSuffix(domain, suffix) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeRequests tracks every request being processed so shutdown can wait for them to finish
+var activeRequests inflight
+
+// inflight counts running request handlers and lets shutdown wait for them with a deadline
+type inflight struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+
+	mu    sync.Mutex
+	drain chan struct{} // Closed when shutdown starts draining; created on first use
+}
+
+// add registers a request; it must be called before the handling goroutine starts
+func (t *inflight) add() {
+	t.wg.Add(1)
+	t.active.Add(1)
+}
+
+// tryAdd registers a request unless shutdown has started draining, and reports whether it did.
+// Work the service starts on its own, such as resumed queue entries, uses it so none can begin after drain
+// has stopped waiting.
+func (t *inflight) tryAdd() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.drain != nil {
+		select {
+		case <-t.drain:
+			return false
+		default:
+		}
+	}
+	t.add()
+	return true
+}
+
+// done marks a registered request as finished
+func (t *inflight) done() {
+	t.active.Add(-1)
+	t.wg.Done()
+}
+
+// count returns the number of requests still being processed
+func (t *inflight) count() int64 {
+	return t.active.Load()
+}
+
+// draining returns a channel that is closed once shutdown starts draining
+func (t *inflight) draining() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.drain == nil {
+		t.drain = make(chan struct{})
+	}
+	return t.drain
+}
+
+// startDrain signals that shutdown has begun, so spooled emails waiting to be retried stop waiting
+func (t *inflight) startDrain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.drain == nil {
+		t.drain = make(chan struct{})
+	}
+	select {
+	case <-t.drain:
+	default:
+		close(t.drain)
+	}
+}
+
+// wait blocks until all registered requests finish or timeout expires.
+// Returns true if every request finished in time.
+func (t *inflight) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-finished:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+const (
+	eventBufferSize   = 64               // Events buffered per subscriber; one falling further behind is disconnected
+	eventWriteTimeout = 10 * time.Second // Time allowed for writing a single event to a subscriber
+	eventKeepAlive    = 30 * time.Second // Interval of comment lines that keep idle streams open through proxies
+)
+
+// Event types
+const (
+	eventAccepted = "accepted" // The request passed validation and delivery starts
+	eventSent     = "sent"     // The email was delivered to the SMTP server
+	eventFailed   = "failed"   // The email could not be delivered and was given up
+)
+
+// events streams email events to live monitoring clients; nil unless Server.EventsAddr is set
+var events *eventHub
+
+// Event describes a step in the processing of an email. It carries metadata only, never message content.
+type Event struct {
+	Type      string           `json:"type"`                // One of the event type constants
+	RequestID string           `json:"request_id"`          // ID the request is logged under
+	Time      time.Time        `json:"time"`                // Time the event occurred
+	Recipient string           `json:"recipient,omitempty"` // Recipient field of the request
+	CcCount   int              `json:"cc_count,omitempty"`  // Number of Cc recipients
+	BccCount  int              `json:"bcc_count,omitempty"` // Number of Bcc recipients
+	Subject   string           `json:"subject,omitempty"`   // Subject line
+	Size      int64            `json:"size"`                // Decoded size of bodies and attachments in bytes
+	Attempts  int              `json:"attempts,omitempty"`  // Send attempts made, set on sent and failed events
+	Error     string           `json:"error,omitempty"`     // Failure reason of a failed event
+	Bounce    *protocol.Bounce `json:"bounce,omitempty"`    // SMTP rejection behind a failed event, if any
+}
+
+// eventHub fans events out to the connected server-sent events subscribers. Publishing never blocks:
+// a subscriber whose buffer is full is disconnected instead of holding up mail processing.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+	max         int
+	done        <-chan struct{} // Closed on shutdown to end all streams
+}
+
+// eventSubscriber is a connected stream
+type eventSubscriber struct {
+	events  chan []byte   // Encoded server-sent events waiting to be written
+	dropped chan struct{} // Closed when the hub disconnects the subscriber for falling behind
+}
+
+// newEventHub creates a hub accepting up to max subscribers; streams end when ctx is cancelled
+func newEventHub(ctx context.Context, max int) *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]struct{}), max: max, done: ctx.Done()}
+}
+
+// accepted publishes that req was accepted for delivery
+func (h *eventHub) accepted(ctx context.Context, req protocol.EmailRequest) {
+	if h == nil {
+		return
+	}
+	h.publish(ctx, newEvent(ctx, eventAccepted, req))
+}
+
+// finished publishes the final outcome of req after attempts send attempts; result is nil when it was sent
+func (h *eventHub) finished(ctx context.Context, req protocol.EmailRequest, attempts int, result error) {
+	if h == nil {
+		return
+	}
+	event := newEvent(ctx, eventSent, req)
+	event.Attempts = attempts
+	if result != nil {
+		event.Type, event.Error = eventFailed, result.Error()
+		event.Bounce = classifyBounce(result)
+	}
+	h.publish(ctx, event)
+}
+
+// publish sends event to every subscriber, disconnecting those that cannot take it
+func (h *eventHub) publish(ctx context.Context, event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Error(ctx, "Failed to encode event", "request_id", requestID(ctx), "error", err.Error())
+		return
+	}
+	message := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data))
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- message:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.dropped)
+			logger.Warn(ctx, "Disconnecting slow event subscriber", "buffered_events", eventBufferSize)
+		}
+	}
+}
+
+// subscribe registers a new subscriber, or returns nil when the subscriber limit is reached
+func (h *eventHub) subscribe() *eventSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) >= h.max {
+		return nil
+	}
+	sub := &eventSubscriber{events: make(chan []byte, eventBufferSize), dropped: make(chan struct{})}
+	h.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe removes a subscriber that disconnected; subscribers dropped by publish are already gone
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// ServeHTTP streams events to the client as server-sent events until it disconnects, falls behind or MHRS shuts down
+func (h *eventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub := h.subscribe()
+	if sub == nil {
+		logger.Warn(r.Context(), "Rejected event subscriber, limit reached", "remote_addr", r.RemoteAddr, "max_event_subscribers", h.max)
+		http.Error(w, "Too many event subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(sub)
+	logger.Info(r.Context(), "Event subscriber connected", "remote_addr", r.RemoteAddr)
+	defer logger.Info(r.Context(), "Event subscriber disconnected", "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// Each write gets its own deadline, so a client that stops reading cannot block the handler forever
+	rc := http.NewResponseController(w)
+	write := func(data []byte) bool {
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := w.Write(data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !write([]byte(": connected\n\n")) {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		case <-sub.dropped:
+			return
+		case data := <-sub.events:
+			if !write(data) {
+				return
+			}
+		case <-keepAlive.C:
+			if !write([]byte(": keep-alive\n\n")) {
+				return
+			}
+		}
+	}
+}
+
+// newEvent returns an event of type typ describing req
+func newEvent(ctx context.Context, typ string, req protocol.EmailRequest) Event {
+	return Event{
+		Type:      typ,
+		RequestID: requestID(ctx),
+		Time:      time.Now().UTC(),
+		Recipient: req.Recipient,
+		CcCount:   len(req.Cc),
+		BccCount:  len(req.Bcc),
+		Subject:   req.Subject,
+		Size:      bodySize(req),
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/protocol/mhrspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer implements the MailRelay gRPC service on top of the request handling of the framed JSON protocol.
+// Like connections on the internal listener, every call holds a concurrency slot and is processed under sendCtx,
+// so shutdown drains calls in progress. A deadline set by the client also bounds the processing of its emails.
+type grpcServer struct {
+	mhrspb.UnimplementedMailRelayServer
+
+	ctx     context.Context // Cancelled when MHRS stops accepting requests
+	sendCtx context.Context // Context requests are processed under
+	queue   *Queue
+	dead    *DeadLetters
+	slots   chan struct{}
+	sender  Sender
+	cfg     *config.Config
+}
+
+// serveGRPC serves the MailRelay service on listener until ctx is cancelled. Calls in progress are given the
+// drain timeout to finish before the server is stopped.
+func serveGRPC(ctx context.Context, listener net.Listener, s *grpcServer) {
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(int(s.cfg.Server.MaxMessageBytes)))
+	mhrspb.RegisterMailRelayServer(server, s)
+
+	go func() {
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(s.cfg.Server.DrainTimeout + drainCancelGrace):
+			server.Stop()
+		}
+	}()
+
+	logger.Info(ctx, "gRPC server started", "addr", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		logger.Error(ctx, "gRPC server error", "error", err.Error(), "addr", listener.Addr().String())
+	}
+}
+
+// SendEmail delivers a single email and answers once it was sent or has finally failed
+func (s *grpcServer) SendEmail(ctx context.Context, in *mhrspb.SendEmailRequest) (*mhrspb.SendEmailResponse, error) {
+	release, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	reqCtx, cancel := s.requestContext(ctx)
+	defer cancel()
+	logger.Info(reqCtx, "gRPC email request received", "request_id", requestID(reqCtx), "remote_addr", clientAddr(reqCtx))
+	return responseFromAck(processRequest(reqCtx, requestFromProto(in), s.queue, s.dead, s.sender, s.cfg)), nil
+}
+
+// SendEmails delivers the emails sent on the stream one after another and answers each in order.
+// A stream left idle for Server.IdleTimeout is closed, as are idle streams on shutdown.
+func (s *grpcServer) SendEmails(stream mhrspb.MailRelay_SendEmailsServer) error {
+	release, err := s.begin(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for {
+		in, err := s.receive(stream)
+		if err != nil {
+			return err
+		}
+		if in == nil {
+			return nil
+		}
+
+		reqCtx, cancel := s.requestContext(stream.Context())
+		logger.Info(reqCtx, "gRPC stream email request received", "request_id", requestID(reqCtx), "remote_addr", clientAddr(reqCtx))
+		ack := processRequest(reqCtx, requestFromProto(in), s.queue, s.dead, s.sender, s.cfg)
+		cancel()
+		if err := stream.Send(responseFromAck(ack)); err != nil {
+			logger.Debug(reqCtx, "Failed to send gRPC response", "request_id", requestID(reqCtx), "error", err.Error())
+			return err
+		}
+	}
+}
+
+// begin authenticates a call and takes a concurrency slot for it. The returned function gives the slot back.
+func (s *grpcServer) begin(ctx context.Context) (func(), error) {
+	if !validClientToken(bearerToken(ctx), s.cfg) {
+		logger.Warn(ctx, "Rejected gRPC call with missing or invalid client token", "remote_addr", peerAddr(ctx))
+		return nil, status.Error(codes.Unauthenticated, errUnauthorized.Error())
+	}
+
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			connsRejected.Inc()
+			logger.Warn(ctx, "Concurrency limit reached, rejecting gRPC call", "remote_addr", peerAddr(ctx), "max_concurrent", cap(s.slots))
+			return nil, status.Error(codes.ResourceExhausted, errServerBusy.Error())
+		}
+	}
+
+	// Drain waits only for calls registered before it began, so later calls are turned away
+	if !activeRequests.tryAdd() {
+		if s.slots != nil {
+			<-s.slots
+		}
+		logger.Info(ctx, "Shutting down, rejecting gRPC call", "remote_addr", peerAddr(ctx))
+		return nil, status.Error(codes.Unavailable, errServerBusy.Error())
+	}
+	return func() {
+		activeRequests.done()
+		if s.slots != nil {
+			<-s.slots
+		}
+	}, nil
+}
+
+// receive waits up to Server.IdleTimeout for the next request on stream. It returns nil without an error
+// when the client has closed its side of the stream, and an error when the stream stays idle or MHRS shuts down.
+func (s *grpcServer) receive(stream mhrspb.MailRelay_SendEmailsServer) (*mhrspb.SendEmailRequest, error) {
+	type result struct {
+		in  *mhrspb.SendEmailRequest
+		err error
+	}
+	// Recv cannot be interrupted; it returns once the handler has returned and the stream is cancelled
+	received := make(chan result, 1)
+	go func() {
+		in, err := stream.Recv()
+		received <- result{in, err}
+	}()
+
+	idle := time.NewTimer(s.cfg.Server.IdleTimeout)
+	defer idle.Stop()
+	select {
+	case r := <-received:
+		if errors.Is(r.err, io.EOF) {
+			return nil, nil
+		}
+		return r.in, r.err
+	case <-idle.C:
+		logger.Debug(stream.Context(), "Closing idle gRPC stream", "remote_addr", peerAddr(stream.Context()), "idle_timeout", s.cfg.Server.IdleTimeout)
+		return nil, status.Error(codes.DeadlineExceeded, "stream idle for too long")
+	case <-s.ctx.Done():
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+}
+
+// requestContext returns the context a request received on a call with context ctx is processed under.
+// It derives from sendCtx so shutdown cancels it, and expires with the deadline of the call when it has one.
+func (s *grpcServer) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	reqCtx := withClientAddr(withRequestID(s.sendCtx, newRequestID()), peerAddr(ctx))
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(reqCtx, deadline)
+	}
+	return context.WithCancel(reqCtx)
+}
+
+// bearerToken returns the token of the "authorization: Bearer <token>" metadata of a call, or an empty string
+func bearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// peerAddr returns the address of the client making a call
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// requestFromProto converts a gRPC request to the email request of the framed protocol
+func requestFromProto(in *mhrspb.SendEmailRequest) protocol.EmailRequest {
+	req := protocol.EmailRequest{
+		Recipient:      in.GetRecipient(),
+		Cc:             in.GetCc(),
+		Bcc:            in.GetBcc(),
+		ReplyTo:        in.GetReplyTo(),
+		From:           in.GetFrom(),
+		FromName:       in.GetFromName(),
+		EnvelopeFrom:   in.GetEnvelopeFrom(),
+		Subject:        in.GetSubject(),
+		Body:           in.GetBody(),
+		HTMLBody:       in.GetHtmlBody(),
+		Headers:        in.GetHeaders(),
+		CallbackURL:    in.GetCallbackUrl(),
+		IdempotencyKey: in.GetIdempotencyKey(),
+		AttemptHistory: in.GetAttemptHistory(),
+	}
+	if in.GetSendAt() != nil {
+		sendAt := in.GetSendAt().AsTime()
+		req.SendAt = &sendAt
+	}
+	for _, attachment := range in.GetAttachments() {
+		req.Attachments = append(req.Attachments, protocol.Attachment{
+			Filename:    attachment.GetFilename(),
+			ContentType: attachment.GetContentType(),
+			Content:     attachment.GetContent(),
+			Inline:      attachment.GetInline(),
+			ContentID:   attachment.GetContentId(),
+		})
+	}
+	return req
+}
+
+// responseFromAck converts an acknowledgement to a gRPC response
+func responseFromAck(ack protocol.Ack) *mhrspb.SendEmailResponse {
+	resp := &mhrspb.SendEmailResponse{
+		Status:    ack.Status,
+		Message:   ack.Message,
+		RequestId: ack.RequestID,
+		Duplicate: ack.Duplicate,
+	}
+	if ack.Bounce != nil {
+		resp.Bounce = &mhrspb.Bounce{
+			Category:     ack.Bounce.Category,
+			Code:         int32(ack.Bounce.Code),
+			EnhancedCode: ack.Bounce.EnhancedCode,
+			Permanent:    ack.Bounce.Permanent,
+			Response:     ack.Bounce.Response,
+		}
+	}
+	for _, attempt := range ack.Attempts {
+		resp.Attempts = append(resp.Attempts, &mhrspb.Attempt{
+			Number:   int32(attempt.Number),
+			Time:     timestamppb.New(attempt.Time),
+			Error:    attempt.Error,
+			Response: attempt.Response,
+		})
+	}
+	return resp
+}
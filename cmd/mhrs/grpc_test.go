@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/protocol/mhrspb"
+)
+
+// TestGRPCRequestContext checks that a request follows the deadline of its call and is still cancelled on shutdown
+func TestGRPCRequestContext(t *testing.T) {
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
+	s := &grpcServer{sendCtx: sendCtx}
+
+	deadline := time.Now().Add(time.Hour)
+	callCtx, cancelCall := context.WithDeadline(context.Background(), deadline)
+	defer cancelCall()
+	reqCtx, cancel := s.requestContext(callCtx)
+	defer cancel()
+	if got, ok := reqCtx.Deadline(); !ok || !got.Equal(deadline) {
+		t.Errorf("request deadline = %v (set %t), want the call deadline %v", got, ok, deadline)
+	}
+
+	noDeadline, cancel := s.requestContext(context.Background())
+	defer cancel()
+	if _, ok := noDeadline.Deadline(); ok {
+		t.Error("request of a call without deadline has one")
+	}
+
+	cancelSends()
+	for _, ctx := range []context.Context{reqCtx, noDeadline} {
+		if ctx.Err() == nil {
+			t.Error("request context not cancelled on shutdown")
+		}
+	}
+}
+
+// TestGRPCAttemptHistory checks that a gRPC request can ask for the attempt history and gets it in its response
+func TestGRPCAttemptHistory(t *testing.T) {
+	if req := requestFromProto(&mhrspb.SendEmailRequest{AttemptHistory: true}); !req.AttemptHistory {
+		t.Error("attempt_history not carried over to the request")
+	}
+
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	resp := responseFromAck(protocol.Ack{Status: protocol.StatusOK, Attempts: []protocol.Attempt{
+		{Number: 1, Time: start, Error: `451 "4.7.1 try again later"`, Response: "451 4.7.1 try again later"},
+		{Number: 2, Time: start.Add(time.Minute), Response: "250 2.0.0 Ok: queued as 4F2A1"},
+	}})
+	attempts := resp.GetAttempts()
+	if len(attempts) != 2 {
+		t.Fatalf("response has %d attempts, want 2", len(attempts))
+	}
+	if a := attempts[0]; a.GetNumber() != 1 || !a.GetTime().AsTime().Equal(start) || a.GetError() == "" || a.GetResponse() != "451 4.7.1 try again later" {
+		t.Errorf("first attempt = %v", a)
+	}
+	if a := attempts[1]; a.GetNumber() != 2 || a.GetError() != "" || a.GetResponse() != "250 2.0.0 Ok: queued as 4F2A1" {
+		t.Errorf("second attempt = %v", a)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// protectedHeaders are generated by MHRS from the request and configuration.
+// Clients may only override them when the header is listed in Server.AllowedHeaderOverrides.
+var protectedHeaders = map[string]bool{
+	"From":       true,
+	"To":         true,
+	"Cc":         true,
+	"Date":       true,
+	"Message-Id": true,
+}
+
+// reservedHeaders describe the MIME structure of the message or would leak blind recipients,
+// so they can never be set by clients.
+var reservedHeaders = map[string]bool{
+	"Bcc":                       true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// addressHeaders hold address lists. Their display names must be encoded word by word, so values are
+// normalized here rather than encoded as a whole like unstructured headers.
+var addressHeaders = map[string]bool{
+	"Reply-To": true,
+	"Sender":   true,
+}
+
+// maxHeaderLine is the line length RFC 5322 recommends; longer header lines are folded where possible
+const maxHeaderLine = 78
+
+// applyHeaders copies custom request headers onto the email after checking names and values.
+// Values containing line breaks are rejected so a header cannot inject further headers.
+func applyHeaders(e *email.Email, headers map[string]string, allowedOverrides []string) error {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool, len(allowedOverrides))
+	for _, name := range allowedOverrides {
+		allowed[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	if e.Headers == nil {
+		e.Headers = textproto.MIMEHeader{}
+	}
+
+	for name, value := range headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if reservedHeaders[key] {
+			return fmt.Errorf("header %q cannot be set", key)
+		}
+		if protectedHeaders[key] && !allowed[key] {
+			return fmt.Errorf("header %q is protected", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %q contains a line break", key)
+		}
+		if addressHeaders[key] {
+			list, err := formatAddressList(value)
+			if err != nil {
+				return fmt.Errorf("header %q: %w", key, err)
+			}
+			value = list
+		}
+		e.Headers.Set(key, value)
+	}
+
+	return nil
+}
+
+// setMessageHeaders adds a Message-ID and Date unless the request supplied them as custom headers.
+// They are set once before the first attempt so every retry and failover backend sends the same message identity.
+// The Message-ID domain is Server.MessageIDDomain, falling back to the domain of the sender address.
+func setMessageHeaders(e *email.Email, domain string, now time.Time) error {
+	if e.Headers == nil {
+		e.Headers = textproto.MIMEHeader{}
+	}
+
+	if e.Headers.Get("Message-Id") == "" {
+		if domain == "" {
+			if addr, err := mail.ParseAddress(e.From); err == nil {
+				_, domain, _ = strings.Cut(addr.Address, "@")
+			}
+		}
+		if domain == "" {
+			return fmt.Errorf("no domain for Message-ID, set server.message_id_domain")
+		}
+
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("failed to generate Message-ID: %w", err)
+		}
+		e.Headers.Set("Message-Id", fmt.Sprintf("<%d.%s@%s>", now.UnixNano(), hex.EncodeToString(b), domain))
+	}
+
+	if e.Headers.Get("Date") == "" {
+		e.Headers.Set("Date", now.Format(time.RFC1123Z))
+	}
+	return nil
+}
+
+// validHeaderName reports whether name consists only of printable ASCII characters other than colon and space (RFC 5322)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c >= 0x7f || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// formatAddressList parses an address list and renders it with RFC 2047 encoded display names where needed
+func formatAddressList(value string) (string, error) {
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil {
+		return "", err
+	}
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = addr.String()
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+// foldHeaders folds top-level header lines longer than maxHeaderLine at spaces, so long encoded subjects and
+// address lists stay within line length limits. Lines without a space to fold at are left as they are.
+func foldHeaders(msg []byte) []byte {
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return msg
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(msg) + 64)
+	for i, line := range bytes.Split(header, []byte("\r\n")) {
+		if i > 0 {
+			out.WriteString("\r\n")
+		}
+		// The first fold normally leaves the field name and the first word of the value on the first line
+		colon := bytes.IndexByte(line, ':')
+		minAt := colon + 2
+		for len(line) > maxHeaderLine {
+			// Fold at the last space that fits, or else at the first one beyond the limit
+			at := bytes.LastIndexByte(line[:maxHeaderLine], ' ')
+			// A first word too long to follow the field name, such as a full 75 character encoded word,
+			// instead starts the field body on a continuation line of its own
+			afterName := minAt > 1 && at == colon+1 && firstWordFits(line[at:])
+			if at < minAt && !afterName {
+				next := bytes.IndexByte(line[max(maxHeaderLine, minAt):], ' ')
+				if next < 0 {
+					break
+				}
+				at = max(maxHeaderLine, minAt) + next
+			}
+			out.Write(line[:at])
+			out.WriteString("\r\n")
+			line = line[at:]
+			// Continuation lines start with the space folded at, so the next fold must come after it
+			minAt = 1
+		}
+		out.Write(line)
+	}
+	out.WriteString("\r\n\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
+
+// firstWordFits reports whether the first word of rest, which starts with the space before it, fits on a line of its own
+func firstWordFits(rest []byte) bool {
+	end := bytes.IndexByte(rest[1:], ' ')
+	if end < 0 {
+		end = len(rest) - 1
+	}
+	return 1+end <= maxHeaderLine
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestFormatAddressListRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		encoded bool // The display names need RFC 2047 encoding
+		want    []mail.Address
+	}{
+		{"ascii name", "Jane Doe <jane@example.com>", false, []mail.Address{{Name: "Jane Doe", Address: "jane@example.com"}}},
+		{"bare address", "jane@example.com", false, []mail.Address{{Address: "jane@example.com"}}},
+		{"accented name", "Zoë Ångström <zoe@example.com>", true, []mail.Address{{Name: "Zoë Ångström", Address: "zoe@example.com"}}},
+		{"quoted accented name", `"Müller, Jürgen" <j@example.com>`, true, []mail.Address{{Name: "Müller, Jürgen", Address: "j@example.com"}}},
+		{"emoji name", "Rocket 🚀 Team <team@example.com>", true, []mail.Address{{Name: "Rocket 🚀 Team", Address: "team@example.com"}}},
+		{"mixed list", "Zoë <zoe@example.com>, plain@example.com, 🎉 Party <party@example.com>", true, []mail.Address{
+			{Name: "Zoë", Address: "zoe@example.com"},
+			{Address: "plain@example.com"},
+			{Name: "🎉 Party", Address: "party@example.com"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatAddressList(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isASCII(got) {
+				t.Errorf("formatAddressList(%q) = %q, want 7-bit output", tt.in, got)
+			}
+			if encoded := strings.Contains(got, "=?utf-8?"); encoded != tt.encoded {
+				t.Errorf("formatAddressList(%q) = %q, RFC 2047 encoded %v, want %v", tt.in, got, encoded, tt.encoded)
+			}
+
+			addrs, err := mail.ParseAddressList(got)
+			if err != nil {
+				t.Fatalf("formatted list %q does not parse: %v", got, err)
+			}
+			if len(addrs) != len(tt.want) {
+				t.Fatalf("formatted list %q has %d addresses, want %d", got, len(addrs), len(tt.want))
+			}
+			for i, addr := range addrs {
+				if *addr != tt.want[i] {
+					t.Errorf("address %d = %q <%s>, want %q <%s>", i, addr.Name, addr.Address, tt.want[i].Name, tt.want[i].Address)
+				}
+			}
+		})
+	}
+}
+
+func TestFoldHeadersRoundTrip(t *testing.T) {
+	subject := "Wöchentlicher Bericht 🚀📈 über die Ergebnisse des dritten Quartals für das gesamte Team in Zürich ✅"
+	from := formatAddress("Zoë Ångström-Lefèvre", "zoe@example.com")
+	to, err := formatAddressList("José Müller <jose@example.com>, 🎉 Party Planning Committee <party@example.com>, " +
+		"Ærøskøbing Façade Café <cafe@example.com>, Ünïcödé Tëst <test@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := email.NewEmail()
+	e.From = from
+	e.To = []string{to}
+	e.Subject = subject
+	e.Text = []byte("body\n")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	folded := foldHeaders(raw)
+
+	header, _, _ := bytes.Cut(folded, []byte("\r\n\r\n"))
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("header line is %d characters, limit %d: %q", len(line), maxHeaderLine, line)
+		}
+		if !isASCII(line) {
+			t.Errorf("header line is not 7-bit: %q", line)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(folded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != subject {
+		t.Errorf("Subject round trip = %q, want %q", decoded, subject)
+	}
+
+	fromAddr, err := msg.Header.AddressList("From")
+	if err != nil || len(fromAddr) != 1 || fromAddr[0].Name != "Zoë Ångström-Lefèvre" {
+		t.Errorf("From round trip = %v (%v)", fromAddr, err)
+	}
+	toAddrs, err := msg.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, addr := range toAddrs {
+		names = append(names, addr.Name)
+	}
+	want := []string{"José Müller", "🎉 Party Planning Committee", "Ærøskøbing Façade Café", "Ünïcödé Tëst"}
+	if strings.Join(names, "|") != strings.Join(want, "|") {
+		t.Errorf("To names round trip = %q, want %q", names, want)
+	}
+}
+
+func TestFoldHeadersLongWord(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	msg := []byte("Subject: " + long + "\r\nX-Short: yes\r\n\r\nbody")
+	got := foldHeaders(msg)
+	if !bytes.Equal(got, msg) {
+		t.Errorf("a header without a space to fold at was changed: %q", got)
+	}
+}
+
+// isASCII reports whether s only holds 7-bit characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+)
+
+const (
+	// readinessCacheTTL bounds how often the readiness probe contacts the SMTP server
+	readinessCacheTTL = 5 * time.Second
+	// readinessTimeout bounds a single SMTP readiness check
+	readinessTimeout = 5 * time.Second
+)
+
+// handleLiveness reports that the process is up and serving requests
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// readinessProbe checks that the upstream SMTP server accepts connections and caches the result briefly
+type readinessProbe struct {
+	cfg *config.Config
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+func newReadinessProbe(cfg *config.Config) *readinessProbe {
+	return &readinessProbe{cfg: cfg}
+}
+
+// ServeHTTP returns 200 when the SMTP server is reachable and 503 otherwise
+func (p *readinessProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := p.check(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "smtp unavailable: %v\n", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// check returns the cached result if it is recent enough, otherwise probes the SMTP server
+func (p *readinessProbe) check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < readinessCacheTTL {
+		return p.lastErr
+	}
+
+	p.lastErr = probeSMTP(&p.cfg.SMTP)
+	p.checkedAt = time.Now()
+	return p.lastErr
+}
+
+// probeSMTP connects to the SMTP server, waits for its greeting and issues a NOOP.
+// No authentication is performed and no mail transaction is started.
+func probeSMTP(smtpCfg *config.SMTPConfig) error {
+	addr := net.JoinHostPort(smtpCfg.Host, smtpCfg.Port)
+	dialer := &net.Dialer{Timeout: readinessTimeout}
+
+	var conn net.Conn
+	var err error
+	if smtpCfg.Encryption == encryptionTLS {
+		tlsConfig, err := smtpTLSConfig(smtpCfg)
+		if err != nil {
+			return err
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(readinessTimeout)); err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, smtpCfg.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/protocol"
+)
+
+// attemptHistory collects the send attempts of a request that asked for them in its acknowledgement.
+// Only the most recent limit attempts are kept, so a long retry deadline cannot bloat the reply.
+type attemptHistory struct {
+	limit    int
+	attempts []protocol.Attempt
+	reply    string // Reply that accepted the email in the attempt in progress
+}
+
+// deadlineAttemptHistory is the number of attempts kept when server.retry_deadline rather than a retry count
+// bounds the attempts, since a deadline gives no count to size the history by
+const deadlineAttemptHistory = 20
+
+// attemptHistoryKey is the context key holding the attempt history of a request
+type attemptHistoryKey struct{}
+
+// newAttemptHistory returns a history keeping at most limit attempts, and at least one
+func newAttemptHistory(limit int) *attemptHistory {
+	return &attemptHistory{limit: max(limit, 1)}
+}
+
+// attemptHistoryLimit returns the number of attempts a history keeps under cfg: every attempt under a retry count,
+// and the most recent deadlineAttemptHistory under a retry deadline
+func attemptHistoryLimit(cfg *config.Config) int {
+	if cfg.Server.RetryDeadline > 0 {
+		return deadlineAttemptHistory
+	}
+	return cfg.Server.MaxRetries
+}
+
+// withAttemptHistory returns a copy of ctx carrying the attempt history
+func withAttemptHistory(ctx context.Context, h *attemptHistory) context.Context {
+	return context.WithValue(ctx, attemptHistoryKey{}, h)
+}
+
+// attemptHistoryFrom returns the attempt history stored in ctx, or nil when the request did not ask for one
+func attemptHistoryFrom(ctx context.Context) *attemptHistory {
+	h, _ := ctx.Value(attemptHistoryKey{}).(*attemptHistory)
+	return h
+}
+
+// accepted notes the SMTP reply that accepted the email in the attempt in progress.
+// It does nothing when h is nil.
+func (h *attemptHistory) accepted(code int, msg string) {
+	if h == nil {
+		return
+	}
+	h.reply = fmt.Sprintf("%d %s", code, msg)
+}
+
+// record adds the outcome of attempt number n, started at start. The SMTP reply of a failed attempt is taken from err.
+// It does nothing when h is nil.
+func (h *attemptHistory) record(n int, start time.Time, err error) {
+	if h == nil {
+		return
+	}
+
+	attempt := protocol.Attempt{Number: n, Time: start, Response: h.reply}
+	h.reply = ""
+	if err != nil {
+		attempt.Error = err.Error()
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			attempt.Response = fmt.Sprintf("%d %s", tpErr.Code, tpErr.Msg)
+		}
+	}
+
+	if len(h.attempts) == h.limit {
+		h.attempts = h.attempts[1:]
+	}
+	h.attempts = append(h.attempts, attempt)
+}
+
+// list returns the recorded attempts, oldest first, or nil when h is nil
+func (h *attemptHistory) list() []protocol.Attempt {
+	if h == nil {
+		return nil
+	}
+	return h.attempts
+}
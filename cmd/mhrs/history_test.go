@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"mailhubrelay/internal/protocol"
+)
+
+func TestAttemptHistory(t *testing.T) {
+	cfg := queueTestConfig()
+	cfg.Server.RetryDelay = time.Millisecond
+
+	// Greylisted first, then a dropped connection, then accepted
+	newSender := func() Sender {
+		calls := 0
+		return &scriptedSender{reply: func(ctx context.Context, _ string) error {
+			calls++
+			switch calls {
+			case 1:
+				return &textproto.Error{Code: 451, Msg: "4.7.1 try again later"}
+			case 2:
+				return errors.New("connection reset by peer")
+			}
+			attemptHistoryFrom(ctx).accepted(250, "2.0.0 Ok: queued as 4F2A1")
+			return nil
+		}}
+	}
+	all := []protocol.Attempt{
+		{Number: 1, Error: `451 "4.7.1 try again later"`, Response: "451 4.7.1 try again later"},
+		{Number: 2, Error: "connection reset by peer"},
+		{Number: 3, Response: "250 2.0.0 Ok: queued as 4F2A1"},
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []protocol.Attempt
+	}{
+		{"all attempts", 3, all},
+		{"bounded to the most recent", 2, all[1:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := newAttemptHistory(tt.limit)
+			ctx := withAttemptHistory(context.Background(), history)
+			start := time.Now()
+			if err := processEmail(ctx, queueTestRequest("history"), newSender(), cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			got := ackFor(ctx, nil).Attempts
+			if len(got) != len(tt.want) {
+				t.Fatalf("ack has %d attempts %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i, attempt := range got {
+				if attempt.Time.Before(start) || (i > 0 && attempt.Time.Before(got[i-1].Time)) {
+					t.Errorf("attempt %d time %v is out of order", attempt.Number, attempt.Time)
+				}
+				attempt.Time = time.Time{}
+				if attempt != tt.want[i] {
+					t.Errorf("attempt %d = %+v, want %+v", i, attempt, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAttemptHistoryNotRequested(t *testing.T) {
+	ctx := context.Background()
+	if err := processEmail(ctx, queueTestRequest("no history"), &scriptedSender{}, queueTestConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := ackFor(ctx, nil).Attempts; attempts != nil {
+		t.Errorf("ack carries attempts %+v without attempt_history", attempts)
+	}
+}
+
+func TestAttemptHistoryLimit(t *testing.T) {
+	cfg := queueTestConfig()
+	if got := attemptHistoryLimit(cfg); got != 3 {
+		t.Errorf("limit under max_retries 3 = %d, want 3", got)
+	}
+
+	// Under a retry deadline max_retries is 0, which must not shrink the history to a single attempt
+	cfg.Server.MaxRetries = 0
+	cfg.Server.RetryDeadline = time.Hour
+	if got := attemptHistoryLimit(cfg); got != deadlineAttemptHistory {
+		t.Errorf("limit under retry_deadline = %d, want %d", got, deadlineAttemptHistory)
+	}
+}
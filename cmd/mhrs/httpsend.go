@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+// httpSendServer accepts email requests as JSON over HTTP for clients that cannot speak the framed protocol.
+// Like connections on the internal listener, every request holds a concurrency slot and is processed under
+// sendCtx, so an email keeps being delivered when the client disconnects and shutdown drains requests in progress.
+type httpSendServer struct {
+	sendCtx context.Context // Context requests are processed under
+	queue   *Queue
+	dead    *DeadLetters
+	slots   chan struct{}
+	sender  Sender
+	cfg     *config.Config
+}
+
+// serveSendHTTP serves POST /send on listener until ctx is cancelled. Requests in progress are given the
+// drain timeout to finish before the server is closed.
+func serveSendHTTP(ctx context.Context, listener net.Listener, s *httpSendServer) {
+	mux := http.NewServeMux()
+	mux.Handle("/send", s)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       s.cfg.Server.ReadTimeout,
+		IdleTimeout:       s.cfg.Server.IdleTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.Server.DrainTimeout+drainCancelGrace)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+	}()
+
+	logger.Info(ctx, "HTTP send server started", "addr", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(ctx, "HTTP send server error", "error", err.Error(), "addr", listener.Addr().String())
+	}
+}
+
+// ServeHTTP decodes an email request, processes it like one received on the internal listener and answers
+// with the acknowledgement as JSON once the email was sent or has finally failed
+func (s *httpSendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := withClientAddr(withRequestID(s.sendCtx, newRequestID()), r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPAck(ctx, w, http.StatusMethodNotAllowed, ackFor(ctx, errors.New("method not allowed, use POST")))
+		return
+	}
+
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			connsRejected.Inc()
+			logger.Warn(ctx, "Concurrency limit reached, rejecting HTTP request", "request_id", requestID(ctx), "remote_addr", r.RemoteAddr, "max_concurrent", cap(s.slots))
+			writeHTTPAck(ctx, w, http.StatusServiceUnavailable, ackFor(ctx, errServerBusy))
+			return
+		}
+	}
+	// Drain waits only for requests registered before it began, so later requests are turned away
+	if !activeRequests.tryAdd() {
+		logger.Info(ctx, "Shutting down, rejecting HTTP request", "request_id", requestID(ctx), "remote_addr", r.RemoteAddr)
+		writeHTTPAck(ctx, w, http.StatusServiceUnavailable, ackFor(ctx, errServerBusy))
+		return
+	}
+	defer activeRequests.done()
+
+	logger.Info(ctx, "HTTP email request received", "request_id", requestID(ctx), "remote_addr", r.RemoteAddr)
+
+	var req protocol.EmailRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.Server.MaxMessageBytes)).Decode(&req); err != nil {
+		code := http.StatusBadRequest
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		logger.Error(ctx, "Failed to decode email request", "request_id", requestID(ctx), "error", err.Error(), "remote_addr", r.RemoteAddr)
+		writeHTTPAck(ctx, w, code, ackFor(ctx, fmt.Errorf("invalid request: %w", err)))
+		return
+	}
+
+	// The token may also be sent as "Authorization: Bearer <token>", which keeps it out of request bodies
+	token := req.AuthToken
+	if bearer, ok := bearerHeader(r); ok {
+		token = bearer
+	}
+	if !validClientToken(token, s.cfg) {
+		logger.Warn(ctx, "Rejected HTTP request with missing or invalid client token", "request_id", requestID(ctx), "remote_addr", r.RemoteAddr)
+		writeHTTPAck(ctx, w, http.StatusUnauthorized, ackFor(ctx, errUnauthorized))
+		return
+	}
+	req.AuthToken = ""
+
+	if req.Command != "" {
+		logger.Warn(ctx, "Rejected command sent over HTTP", "request_id", requestID(ctx), "command", req.Command)
+		writeHTTPAck(ctx, w, http.StatusBadRequest, ackFor(ctx, fmt.Errorf("command %q is not supported over HTTP", req.Command)))
+		return
+	}
+
+	ack := processRequest(ctx, req, s.queue, s.dead, s.sender, s.cfg)
+	writeHTTPAck(ctx, w, httpStatus(ack), ack)
+}
+
+// bearerHeader returns the token of an "Authorization: Bearer <token>" request header
+func bearerHeader(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return auth[len("Bearer "):], true
+}
+
+// httpStatus returns the HTTP status code answering a request acknowledged with ack.
+// Rejections by the SMTP server are reported as a bad gateway, every other failure as an unprocessable request.
+func httpStatus(ack protocol.Ack) int {
+	switch {
+	case ack.Status == protocol.StatusOK:
+		return http.StatusOK
+	case ack.Status == protocol.StatusBusy:
+		return http.StatusServiceUnavailable
+	case ack.Status == protocol.StatusUnauthorized:
+		return http.StatusUnauthorized
+	case ack.Bounce != nil:
+		return http.StatusBadGateway
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// writeHTTPAck answers an HTTP request with ack as JSON. The client may have gone away, so failures are only logged at debug level.
+func writeHTTPAck(ctx context.Context, w http.ResponseWriter, code int, ack protocol.Ack) {
+	data, err := json.Marshal(ack)
+	if err != nil {
+		logger.Error(ctx, "Failed to encode acknowledgement", "request_id", requestID(ctx), "error", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		logger.Debug(ctx, "Failed to send acknowledgement", "request_id", requestID(ctx), "error", err.Error(), "remote_addr", clientAddr(ctx))
+		return
+	}
+	logger.Debug(ctx, "Acknowledgement sent", "request_id", requestID(ctx), "status", ack.Status, "http_status", code, "remote_addr", clientAddr(ctx))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+const (
+	idempotencyDirName       = "idempotency" // Subdirectory of the queue directory holding the remembered keys
+	idempotencySweepInterval = time.Minute   // Minimum time between removals of expired keys
+)
+
+// idempotency remembers the results of requests carrying an idempotency key; nil when Server.IdempotencyTTL is 0
+var idempotency *IdempotencyStore
+
+// IdempotencyStore remembers the acknowledgement of every successful request carrying an idempotency key for
+// the TTL, so a client that retries after losing the acknowledgement does not send the email twice. Keys are
+// kept in memory and, when a directory is given, also written to disk so they survive a restart.
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	dir       string
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+// idempotencyEntry tracks a key from the start of its first request
+type idempotencyEntry struct {
+	done    chan struct{} // Closed once the request holding the key has finished
+	ack     protocol.Ack  // Result of that request, valid once done is closed
+	expires time.Time     // Time the key is forgotten; zero while the request is in progress
+}
+
+// idempotencyRecord is the on-disk representation of a remembered key
+type idempotencyRecord struct {
+	Key       string       `json:"key"`
+	Ack       protocol.Ack `json:"ack"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+// OpenIdempotencyStore creates a store remembering keys for ttl. When dir is not empty it is created if needed,
+// unexpired keys written by a previous run are loaded and expired or unreadable ones are removed.
+func OpenIdempotencyStore(ctx context.Context, dir string, ttl time.Duration) (*IdempotencyStore, error) {
+	s := &IdempotencyStore{ttl: ttl, dir: dir, entries: make(map[string]*idempotencyEntry), lastSweep: time.Now()}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create idempotency directory: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency directory: %w", err)
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		if file.IsDir() || !isQueueFile(file.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		var record idempotencyRecord
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &record)
+		}
+		if err != nil || s.path(record.Key) != path || !now.Before(record.ExpiresAt) {
+			if err != nil {
+				logger.Warn(ctx, "Removing unreadable idempotency key", "file", path)
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Error(ctx, "Failed to remove idempotency key", "file", path, "error", err.Error())
+			}
+			continue
+		}
+		s.entries[record.Key] = completedEntry(record.Ack, record.ExpiresAt)
+	}
+	return s, nil
+}
+
+// Do returns the result of deliver, which is only called when no earlier request with key has succeeded within
+// the TTL. Otherwise the earlier acknowledgement is returned with Duplicate set. A request arriving while
+// another with the same key is in progress waits for it. Failed requests are not remembered, so a retry after
+// a failure is delivered again. Without a store or key deliver is always called.
+func (s *IdempotencyStore) Do(ctx context.Context, key string, deliver func() protocol.Ack) protocol.Ack {
+	if s == nil || key == "" {
+		return deliver()
+	}
+
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		if now.Sub(s.lastSweep) > idempotencySweepInterval {
+			s.sweep(ctx, now)
+		}
+		entry, ok := s.entries[key]
+		if ok && !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(s.entries, key)
+			ok = false
+		}
+		if !ok {
+			entry = &idempotencyEntry{done: make(chan struct{})}
+			s.entries[key] = entry
+			s.mu.Unlock()
+			return s.run(ctx, key, entry, deliver)
+		}
+		inProgress := entry.expires.IsZero()
+		s.mu.Unlock()
+
+		if inProgress {
+			logger.Info(ctx, "Waiting for request with the same idempotency key", "request_id", requestID(ctx), "idempotency_key", key)
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return ackFor(ctx, fmt.Errorf("gave up waiting for request with the same idempotency key: %w", ctx.Err()))
+		}
+		if entry.ack.Status == protocol.StatusOK {
+			duplicateRequests.Inc()
+			logger.Info(ctx, "Duplicate email request answered with earlier result", "request_id", requestID(ctx),
+				"idempotency_key", key, "original_request_id", entry.ack.RequestID)
+			ack := entry.ack
+			ack.Duplicate = true
+			return ack
+		}
+		// The earlier request failed and gave up the key; try to take it over
+	}
+}
+
+// Remember records key as successfully handled with ack, as for requests spooled by a previous run
+func (s *IdempotencyStore) Remember(ctx context.Context, key string, ack protocol.Ack) {
+	if s == nil || key == "" {
+		return
+	}
+	expires := time.Now().Add(s.ttl)
+	s.mu.Lock()
+	s.entries[key] = completedEntry(ack, expires)
+	s.mu.Unlock()
+	s.save(ctx, key, ack, expires)
+}
+
+// run delivers the request holding key and records its result for requests waiting on or repeating it
+func (s *IdempotencyStore) run(ctx context.Context, key string, entry *idempotencyEntry, deliver func() protocol.Ack) protocol.Ack {
+	ack := deliver()
+
+	s.mu.Lock()
+	entry.ack = ack
+	if ack.Status == protocol.StatusOK {
+		entry.expires = time.Now().Add(s.ttl)
+	} else {
+		delete(s.entries, key)
+	}
+	close(entry.done)
+	s.mu.Unlock()
+
+	if ack.Status == protocol.StatusOK {
+		s.save(ctx, key, ack, entry.expires)
+	}
+	return ack
+}
+
+// save writes a remembered key to disk when the store has a directory.
+// The file is written under a temporary name and renamed so a partially written key is never loaded.
+func (s *IdempotencyStore) save(ctx context.Context, key string, ack protocol.Ack, expires time.Time) {
+	if s.dir == "" {
+		return
+	}
+
+	data, err := json.Marshal(idempotencyRecord{Key: key, Ack: ack, ExpiresAt: expires})
+	if err == nil {
+		path := s.path(key)
+		tmp := filepath.Join(s.dir, "."+filepath.Base(path)+".tmp")
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			if err = os.Rename(tmp, path); err != nil {
+				os.Remove(tmp)
+			}
+		}
+	}
+	if err != nil {
+		logger.Error(ctx, "Failed to save idempotency key, it is only kept until restart", "request_id", requestID(ctx), "idempotency_key", key, "error", err.Error())
+	}
+}
+
+// sweep forgets expired keys and removes their files; the caller must hold s.mu
+func (s *IdempotencyStore) sweep(ctx context.Context, now time.Time) {
+	for key, entry := range s.entries {
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			continue
+		}
+		delete(s.entries, key)
+		if s.dir == "" {
+			continue
+		}
+		if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error(ctx, "Failed to remove idempotency key", "idempotency_key", key, "error", err.Error())
+		}
+	}
+	s.lastSweep = now
+}
+
+// path returns the file holding key. Keys are client-chosen, so the file is named after their hash.
+func (s *IdempotencyStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+queueFileExt)
+}
+
+// completedEntry returns an entry for a key whose request succeeded with ack
+func completedEntry(ack protocol.Ack, expires time.Time) *idempotencyEntry {
+	entry := &idempotencyEntry{done: make(chan struct{}), ack: ack, expires: expires}
+	close(entry.done)
+	return entry
+}
+
+// checkIdempotencyKey rejects keys that are too long or contain control characters, as they are logged and stored
+func checkIdempotencyKey(key string) error {
+	if len(key) > protocol.MaxIdempotencyKeyLength {
+		return fmt.Errorf("idempotency key is %d bytes, limit is %d", len(key), protocol.MaxIdempotencyKeyLength)
+	}
+	if strings.ContainsFunc(key, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return errors.New("idempotency key contains control characters")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"sync"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/protocol"
+)
+
+// listenAddrs returns the internal listener addresses: InternalAddr (host:port or a socket path) and InternalSocket.
+// Either may be empty, but not both.
+func listenAddrs(cfg *config.Config) []string {
+	var addrs []string
+	for _, addr := range []string{cfg.Server.InternalAddr, cfg.Server.InternalSocket} {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// listenerSet runs an acceptor for each internal listener and rebinds them when the configured addresses change
+type listenerSet struct {
+	serve func(ctx context.Context, listener net.Listener) // Accept loop, returns once ctx is cancelled and the listener closed
+
+	mu        sync.Mutex
+	running   map[string]*runningListener // Keyed by address
+	acceptors sync.WaitGroup
+}
+
+// runningListener is an open listener together with the cancel function of its acceptor
+type runningListener struct {
+	listener net.Listener
+	cancel   context.CancelFunc
+}
+
+// newListenerSet returns an empty set whose listeners are served by serve
+func newListenerSet(serve func(ctx context.Context, listener net.Listener)) *listenerSet {
+	return &listenerSet{serve: serve, running: make(map[string]*runningListener)}
+}
+
+// update binds every address in addrs that is not yet listening and closes listeners for addresses no longer
+// in addrs. New listeners are opened first, so on error nothing is changed. Connections already accepted on
+// a closed listener are left to finish. Returns the addresses opened and closed.
+func (ls *listenerSet) update(ctx context.Context, addrs []string) (opened, closed []string, err error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	listeners := make(map[string]net.Listener)
+	for _, addr := range addrs {
+		if _, ok := ls.running[addr]; ok {
+			continue
+		}
+		listener, err := listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners[addr] = listener
+	}
+
+	for addr, running := range ls.running {
+		if !slices.Contains(addrs, addr) {
+			running.cancel()
+			running.listener.Close()
+			delete(ls.running, addr)
+			closed = append(closed, addr)
+		}
+	}
+
+	for addr, listener := range listeners {
+		acceptCtx, cancel := context.WithCancel(ctx)
+		ls.running[addr] = &runningListener{listener: listener, cancel: cancel}
+		ls.acceptors.Add(1)
+		go func() {
+			defer ls.acceptors.Done()
+			ls.serve(acceptCtx, listener)
+		}()
+		opened = append(opened, addr)
+	}
+	return opened, closed, nil
+}
+
+// close stops all listeners and waits for their acceptors to return
+func (ls *listenerSet) close() {
+	ls.mu.Lock()
+	for addr, running := range ls.running {
+		running.cancel()
+		running.listener.Close()
+		delete(ls.running, addr)
+	}
+	ls.mu.Unlock()
+	ls.acceptors.Wait()
+}
+
+// listen opens a TCP listener for host:port addresses and a Unix domain socket for paths
+func listen(addr string) (net.Listener, error) {
+	if protocol.Network(addr) == "tcp" {
+		return net.Listen("tcp", addr)
+	}
+	return listenUnix(addr)
+}
+
+// listenUnix creates a Unix domain socket at path that only the service user can connect to.
+// A stale socket left by an unclean exit is replaced; any other file at path is an error.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	return listener, nil
+}
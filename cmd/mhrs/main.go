@@ -3,75 +3,251 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
-	"net/smtp"
+	"net/mail"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/validate"
 
-	"github.com/LixenWraith/logger"
 	"github.com/jordan-wright/email"
 )
 
 const appName = "mhrs"
 
-// EmailRequest represents the structure of an incoming email sending request
-type EmailRequest struct {
-	Recipient string `json:"recipient"` // Email address of the recipient
-	Subject   string `json:"subject"`   // Subject line of the email
-	Body      []byte `json:"body"`      // Body content of the email
-}
+// configPath is the configuration file in use, from the -config flag or config.Resolve
+var configPath string
+
+// drainCancelGrace is how long shutdown waits for requests to wind down after the drain timeout cancels them
+const drainCancelGrace = 5 * time.Second
+
+// dryRun is set by the -dry-run flag; requests are validated and checked against the SMTP server but never sent
+var dryRun bool
+
+// rejectReadTimeout bounds how long a rejected connection may take to send its request before the busy reply
+const rejectReadTimeout = 5 * time.Second
+
+// maxRetryBackoff caps the exponentially growing delay between attempts when Server.RetryDeadline is set
+const maxRetryBackoff = 5 * time.Minute
+
+// maxQueueSummaries caps the messages listed in a queue status reply so it stays well within a frame
+const maxQueueSummaries = 1000
+
+// errUnauthorized is reported to clients whose request lacks the configured client token
+var errUnauthorized = errors.New("unauthorized: missing or invalid client token")
+
+// errServerBusy is reported to clients whose connection arrives while all processing slots are in use
+var errServerBusy = errors.New("server busy, retry later")
+
+// SMTP transport encryption modes
+const (
+	encryptionStartTLS = "starttls"
+	encryptionTLS      = "tls"
+	encryptionNone     = "none"
+)
 
 // main initializes and runs the email service
 func main() {
+	flag.StringVar(&configPath, "config", "", "Path to the configuration file, overriding $"+config.EnvPath(appName)+" and the default search")
+	flag.BoolVar(&dryRun, "dry-run", false, "Validate requests and test SMTP connectivity without sending mail")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	flag.Parse()
+	configPath = config.Resolve(appName, configPath)
+
+	if *checkConfig {
+		os.Exit(runCheckConfig())
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cfg, configExists, err := config.Load(appName)
+	cfg, configExists, err := config.Load(appName, configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
 		os.Exit(1)
 	}
 	if !configExists {
-		if config.Save(cfg, appName) != nil {
+		if err := config.Save(cfg, configPath); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to save configuration: %v\n", err)
 		}
 	}
 
-	if err := logger.Init(ctx, &cfg.Logging); err != nil {
+	if err := logger.Init(ctx, &cfg.Logging, cfg.Server.LogFormat); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
 		os.Exit(1)
 	}
 	defer logger.Shutdown(ctx)
 
-	logger.Info(ctx, "Starting Mail Hub Relay Service", "listen_addr", cfg.Server.InternalAddr, "smtp_host", cfg.SMTP.Host, "smtp_port", cfg.SMTP.Port)
+	logger.Info(ctx, "Starting Mail Hub Relay Service", "listen_addr", cfg.Server.InternalAddr, "listen_socket", cfg.Server.InternalSocket, "smtp_host", cfg.SMTP.Host, "smtp_port", cfg.SMTP.Port, "dry_run", dryRun, "config_path", configPath)
 
-	// Setup TCP listener
-	listener, err := net.Listen("tcp", cfg.Server.InternalAddr)
-	if err != nil {
-		logger.Error(ctx, "Failed to start TCP listener", "error", err.Error())
+	if cfg.SMTP.InsecureSkipVerify {
+		logger.Warn(ctx, "SMTP TLS certificate verification is DISABLED, connections can be intercepted; only use on trusted internal networks",
+			"smtp_host", cfg.SMTP.Host)
+	}
+
+	if cfg.SMTP.HeloHost == "" {
+		if err := validate.Hostname(machineHostname()); err != nil {
+			logger.Warn(ctx, "Machine host name is used in EHLO but is not a fully qualified domain name, some SMTP servers reject it; set smtp.helo_host",
+				"helo_host", machineHostname(), "error", err.Error())
+		}
+	}
+
+	if cfg.Server.DKIMKeyFile != "" {
+		if _, err := loadDKIMKey(cfg.Server.DKIMKeyFile); err != nil {
+			logger.Error(ctx, "Failed to load DKIM key", "error", err.Error())
+			return
+		}
+		logger.Info(ctx, "DKIM signing enabled", "dkim_domain", cfg.Server.DKIMDomain, "dkim_selector", cfg.Server.DKIMSelector)
+	}
+
+	sender := NewSMTPSender(cfg, dryRun)
+	throttled := NewThrottledSender(sender, cfg)
+
+	// Sends run on their own context so shutdown can let them finish until the drain timeout expires
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
+
+	// Open the dead-letter directory when configured so permanently failed emails are kept for inspection
+	var dead *DeadLetters
+	if cfg.Server.DeadLetterDir != "" {
+		dead, err = OpenDeadLetters(cfg.Server.DeadLetterDir, cfg.Server.DeadLetterMaxFiles, cfg.Server.DeadLetterMaxBytes)
+		if err != nil {
+			logger.Error(ctx, "Failed to open dead-letter directory", "error", err.Error(), "dead_letter_dir", cfg.Server.DeadLetterDir)
+			return
+		}
+		logger.Info(ctx, "Dead-letter directory enabled", "dead_letter_dir", cfg.Server.DeadLetterDir)
+	}
+
+	// Open the persistent queue when configured
+	var queue *Queue
+	if cfg.Server.QueueDir != "" {
+		queue, err = OpenQueue(cfg.Server.QueueDir, cfg.Server.MaxQueueSize)
+		if err != nil {
+			logger.Error(ctx, "Failed to open queue", "error", err.Error(), "queue_dir", cfg.Server.QueueDir)
+			return
+		}
+		logger.Info(ctx, "Persistent queue enabled", "queue_dir", cfg.Server.QueueDir, "max_queue_size", cfg.Server.MaxQueueSize)
+	}
+
+	// Remember idempotency keys, next to the queue when there is one so they survive a restart
+	if cfg.Server.IdempotencyTTL > 0 {
+		var dir string
+		if queue != nil {
+			dir = filepath.Join(cfg.Server.QueueDir, idempotencyDirName)
+		}
+		idempotency, err = OpenIdempotencyStore(ctx, dir, cfg.Server.IdempotencyTTL)
+		if err != nil {
+			logger.Error(ctx, "Failed to open idempotency store", "error", err.Error(), "queue_dir", cfg.Server.QueueDir)
+			return
+		}
+		logger.Info(ctx, "Idempotency keys enabled", "idempotency_ttl", cfg.Server.IdempotencyTTL.String(), "persistent", dir != "")
+	}
+
+	// Created before the queue is resumed so resumed emails are streamed too
+	if cfg.Server.EventsAddr != "" {
+		events = newEventHub(ctx, cfg.Server.MaxEventSubscribers)
+	}
+
+	// Open the audit log when configured before anything can send, so every send attempt is recorded
+	if cfg.Server.AuditLog != "" {
+		audit, err = openAuditLog(cfg)
+		if err != nil {
+			logger.Error(ctx, "Failed to open audit log", "error", err.Error(), "audit_log", cfg.Server.AuditLog)
+			return
+		}
+		defer audit.close()
+		logger.Info(ctx, "Audit log enabled", "audit_log", cfg.Server.AuditLog, "audit_log_format", cfg.Server.AuditLogFormat)
+	}
+
+	// Started before the queue is resumed so resumed and scheduled emails get their callbacks
+	callbacks = startCallbacks(ctx, cfg)
+
+	// Resume anything left in the queue by a previous run, read before any listener opens
+	if queue != nil {
+		entries, err := spooledEntries(ctx, queue)
+		if err != nil {
+			logger.Error(ctx, "Failed to load queued emails", "error", err.Error(), "queue_dir", cfg.Server.QueueDir)
+			return
+		}
+		go queue.runScheduler(ctx, sendCtx, dead, throttled, cfg)
+		go resumeQueue(ctx, sendCtx, queue, entries, dead, throttled, cfg)
+	}
+
+	startAdminServers(ctx, cfg)
+
+	// Limit the number of requests processed at once; a nil channel disables the limit
+	var slots chan struct{}
+	if cfg.Server.MaxConcurrent > 0 {
+		slots = make(chan struct{}, cfg.Server.MaxConcurrent)
+	}
+
+	// Setup internal listeners
+	listeners := newListenerSet(func(acceptCtx context.Context, listener net.Listener) {
+		acceptConnections(acceptCtx, sendCtx, listener, queue, dead, slots, throttled, cfg)
+	})
+	if _, _, err := listeners.update(ctx, listenAddrs(cfg)); err != nil {
+		logger.Error(ctx, "Failed to start listener", "error", err.Error())
 		return
 	}
-	defer listener.Close()
+	defer listeners.close()
+
+	// Serve the gRPC interface when configured; its address is only read at startup
+	if cfg.Server.GRPCAddr != "" {
+		listener, err := net.Listen("tcp", cfg.Server.GRPCAddr)
+		if err != nil {
+			logger.Error(ctx, "Failed to start gRPC listener", "error", err.Error(), "grpc_addr", cfg.Server.GRPCAddr)
+			return
+		}
+		go serveGRPC(ctx, listener, &grpcServer{ctx: ctx, sendCtx: sendCtx, queue: queue, dead: dead, slots: slots, sender: throttled, cfg: cfg})
+	}
+
+	// Serve the HTTP send endpoint when configured; its address is only read at startup
+	if cfg.Server.HTTPAddr != "" {
+		listener, err := net.Listen("tcp", cfg.Server.HTTPAddr)
+		if err != nil {
+			logger.Error(ctx, "Failed to start HTTP send listener", "error", err.Error(), "http_addr", cfg.Server.HTTPAddr)
+			return
+		}
+		go serveSendHTTP(ctx, listener, &httpSendServer{sendCtx: sendCtx, queue: queue, dead: dead, slots: slots, sender: throttled, cfg: cfg})
+	}
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	defer signal.Stop(sigChan)
 
-	go handleSignals(ctx, cancel, sigChan, cfg)
-	go acceptConnections(ctx, listener, cfg)
+	go handleSignals(ctx, cancel, sigChan, listeners, sender, cfg)
 
 	<-ctx.Done()
 
+	// Stop accepting new connections, then give in-flight requests time to finish
+	listeners.close()
+	drainRequests(sendCtx, cancelSends, queue != nil, cfg.Server.DrainTimeout)
+	sender.Close()
+	if !callbacks.close(cfg.Server.CallbackTimeout) {
+		logger.Warn(ctx, "Pending callbacks abandoned on shutdown")
+	}
+
 	// Create separate shutdown context
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
@@ -82,9 +258,37 @@ func main() {
 	}
 }
 
+// drainRequests waits up to timeout for in-flight requests to finish. Spooled emails waiting to be retried stop
+// at once and stay in the queue with their retry state. Requests still running after the timeout are cancelled;
+// with a persistent queue they stay spooled for the next start, otherwise they are dropped.
+func drainRequests(ctx context.Context, cancelSends context.CancelFunc, persistent bool, timeout time.Duration) {
+	activeRequests.startDrain()
+	pending := activeRequests.count()
+	if pending == 0 {
+		return
+	}
+
+	logger.Info(ctx, "Draining in-flight requests", "count", pending, "timeout", timeout)
+	if activeRequests.wait(timeout) {
+		logger.Info(ctx, "Drain complete", "drained", pending, "dropped", 0)
+		return
+	}
+
+	unfinished := activeRequests.count()
+	cancelSends()
+	// Cancelled requests return promptly; wait briefly so they can update the queue and reply to their clients
+	activeRequests.wait(drainCancelGrace)
+
+	if persistent {
+		logger.Warn(ctx, "Drain timeout reached, unfinished requests kept in queue", "drained", pending-unfinished, "persisted", unfinished)
+		return
+	}
+	logger.Warn(ctx, "Drain timeout reached, unfinished requests dropped", "drained", pending-unfinished, "dropped", unfinished)
+}
+
 // handleSignals manages system signals for graceful shutdown and configuration reloading.
-// It handles SIGHUP for config reload and SIGINT/SIGTERM for graceful shutdown.
-func handleSignals(ctx context.Context, cancel context.CancelFunc, sigChan chan os.Signal, cfg *config.Config) {
+// It handles SIGHUP for config reload, SIGUSR1 to cycle the log level and SIGINT/SIGTERM for graceful shutdown.
+func handleSignals(ctx context.Context, cancel context.CancelFunc, sigChan chan os.Signal, listeners *listenerSet, sender *SMTPSender, cfg *config.Config) {
 	logger.Debug(ctx, "Starting signal handler")
 	for {
 		select {
@@ -93,9 +297,11 @@ func handleSignals(ctx context.Context, cancel context.CancelFunc, sigChan chan
 		case sig := <-sigChan:
 			switch sig {
 			case syscall.SIGHUP:
-				if err := reloadConfig(ctx, cfg); err != nil {
+				if err := reloadConfig(ctx, listeners, sender, cfg); err != nil {
 					logger.Error(ctx, "Failed to reload configuration", "error", err)
 				}
+			case syscall.SIGUSR1:
+				logger.SetLevel(ctx, logger.NextLevel())
 			case syscall.SIGINT, syscall.SIGTERM:
 				logger.Info(ctx, "Received shutdown signal", "signal", sig.String())
 				cancel()
@@ -105,10 +311,28 @@ func handleSignals(ctx context.Context, cancel context.CancelFunc, sigChan chan
 	}
 }
 
+// runCheckConfig loads and validates the configuration without starting the service.
+// Returns the process exit code: 0 when the configuration is valid, 1 otherwise.
+func runCheckConfig() int {
+	_, configExists, err := config.Load(appName, configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration\n%v\n", configPath, err)
+		return 1
+	}
+	if !configExists {
+		fmt.Printf("%s: not found, default configuration is valid\n", configPath)
+		return 0
+	}
+	fmt.Printf("%s: configuration is valid\n", configPath)
+	return 0
+}
+
 // reloadConfig reloads the service configuration from disk and reinitializes the logger.
-// Returns an error if loading the new configuration or reinitializing the logger fails.
-func reloadConfig(ctx context.Context, cfg *config.Config) error {
-	newConfig, configExists, err := config.Load(appName)
+// Listeners are rebound when their addresses changed, and idle SMTP sessions are closed when SMTP settings changed
+// so later sends connect with the new settings. Returns an error, leaving the running configuration in place,
+// if loading the new configuration, reinitializing the logger or opening a new listener fails.
+func reloadConfig(ctx context.Context, listeners *listenerSet, sender *SMTPSender, cfg *config.Config) error {
+	newConfig, configExists, err := config.Load(appName, configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load new configuration: %w", err)
 	}
@@ -116,17 +340,45 @@ func reloadConfig(ctx context.Context, cfg *config.Config) error {
 		return fmt.Errorf("configuration file not found")
 	}
 
-	if err := logger.Init(ctx, &newConfig.Logging); err != nil {
+	if err := logger.Init(ctx, &newConfig.Logging, newConfig.Server.LogFormat); err != nil {
 		return fmt.Errorf("failed to reinitialize logger: %w", err)
 	}
 
+	opened, closed, err := listeners.update(ctx, listenAddrs(newConfig))
+	if err != nil {
+		return fmt.Errorf("failed to rebind listeners: %w", err)
+	}
+
+	changed := config.Changed(cfg, newConfig)
+	smtpChanged := slices.ContainsFunc(changed, func(key string) bool {
+		return strings.HasPrefix(key, "smtp.") || strings.HasPrefix(key, "smtp_backends.")
+	})
+
+	// The audit log is reopened so files moved away by external rotation are recreated
+	if err := audit.reopen(newConfig); err != nil {
+		logger.Error(ctx, "Failed to reopen audit log, keeping the previous file", "error", err.Error(), "audit_log", newConfig.Server.AuditLog)
+	}
+
 	*cfg = *newConfig
-	logger.Info(ctx, "Configuration reloaded successfully")
+	if smtpChanged {
+		// Sessions in use are discarded when they are next taken from the pool, as their settings no longer match
+		sender.Close()
+	}
+
+	logger.Info(ctx, "Configuration reloaded successfully", "changed", strings.Join(changed, ", "),
+		"listeners_opened", strings.Join(opened, ", "), "listeners_closed", strings.Join(closed, ", "), "smtp_sessions_reset", smtpChanged)
+	if cfg.SMTP.InsecureSkipVerify {
+		logger.Warn(ctx, "SMTP TLS certificate verification is DISABLED, connections can be intercepted; only use on trusted internal networks",
+			"smtp_host", cfg.SMTP.Host)
+	}
 	return nil
 }
 
-// acceptConnections handles incoming TCP connections
-func acceptConnections(ctx context.Context, listener net.Listener, cfg *config.Config) {
+// acceptConnections handles incoming TCP connections until ctx is cancelled.
+// Requests are processed under sendCtx so that they can outlive ctx while the server drains.
+// When slots is non-nil each connection holds a slot while it is processed, and connections arriving
+// while all slots are taken are rejected with a busy acknowledgement.
+func acceptConnections(ctx, sendCtx context.Context, listener net.Listener, queue *Queue, dead *DeadLetters, slots chan struct{}, sender Sender, cfg *config.Config) {
 	logger.Debug(ctx, "Starting connection acceptor")
 
 	for {
@@ -141,106 +393,761 @@ func acceptConnections(ctx context.Context, listener net.Listener, cfg *config.C
 				continue
 			}
 		}
-		go handleConnection(ctx, conn, cfg)
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				connsRejected.Inc()
+				logger.Warn(ctx, "Concurrency limit reached, rejecting connection", "remote_addr", conn.RemoteAddr().String(), "max_concurrent", cap(slots))
+				go rejectConnection(ctx, conn, cfg)
+				continue
+			}
+		}
+
+		// Drain waits only for requests registered before it began, so later connections are turned away
+		if !activeRequests.tryAdd() {
+			if slots != nil {
+				<-slots
+			}
+			logger.Info(ctx, "Shutting down, rejecting connection", "remote_addr", conn.RemoteAddr().String())
+			go rejectConnection(ctx, conn, cfg)
+			continue
+		}
+		go func() {
+			defer activeRequests.done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			handleConnection(ctx, sendCtx, conn, queue, dead, sender, cfg)
+		}()
+	}
+}
+
+// rejectConnection reads and discards the pending request so the client is not reset before it
+// sees the reply, then answers with a busy acknowledgement.
+func rejectConnection(ctx context.Context, conn net.Conn, cfg *config.Config) {
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(rejectReadTimeout)); err == nil {
+		protocol.ReadFrame(conn, cfg.Server.MaxMessageBytes)
+	}
+	sendAck(ctx, conn, errServerBusy)
+}
+
+// requestIDKey is the context key holding the ID that ties together the log lines of one request
+type requestIDKey struct{}
+
+// withRequestID returns a copy of ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID stored in ctx, or an empty string outside a request
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// clientAddrKey is the context key holding the address of the client that submitted a request
+type clientAddrKey struct{}
+
+// withClientAddr returns a copy of ctx carrying the client address
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// clientAddr returns the client address stored in ctx, or an empty string when unknown
+func clientAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
+
+// retryStateKey is the context key holding the retry state of a spooled email
+type retryStateKey struct{}
+
+// retryState is the delivery progress a spooled email carries over from earlier attempts
+type retryState struct {
+	attempts int       // Send attempts already made
+	since    time.Time // Time of the first attempt; zero when none was made
+}
+
+// withRetryState returns a copy of ctx marking the email as spooled, with the attempts already made for it
+func withRetryState(ctx context.Context, state retryState) context.Context {
+	return context.WithValue(ctx, retryStateKey{}, state)
+}
+
+// retryStateFrom returns the retry state stored in ctx and whether the email being processed is spooled
+func retryStateFrom(ctx context.Context) (retryState, bool) {
+	state, ok := ctx.Value(retryStateKey{}).(retryState)
+	return state, ok
+}
+
+// newRequestID generates a random identifier for an accepted connection
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validClientToken reports whether token matches Server.ClientToken; every token is accepted when none is configured
+func validClientToken(token string, cfg *config.Config) bool {
+	if cfg.Server.ClientToken == "" {
+		return true
 	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Server.ClientToken)) == 1
 }
 
-// handleConnection processes a single connection and decodes the email request
-func handleConnection(ctx context.Context, conn net.Conn, cfg *config.Config) {
-	logger.Info(ctx, "New connection received", "remote_addr", conn.RemoteAddr().String())
+// handleConnection serves the requests sent on a single connection, replying to each with an acknowledgement
+// once delivery has succeeded or failed. Clients may send several requests one after another on the same
+// connection; reading stops when the client closes it or ctx is cancelled, while requests are processed under sendCtx.
+func handleConnection(ctx, sendCtx context.Context, conn net.Conn, queue *Queue, dead *DeadLetters, sender Sender, cfg *config.Config) {
 	defer conn.Close()
 
-	var req EmailRequest
-	decoder := json.NewDecoder(conn)
+	// Stop waiting for further requests once the listener shuts down; a request already being read or processed is kept
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	r := bufio.NewReader(conn)
+	for first := true; ; first = false {
+		reqCtx := withClientAddr(withRequestID(sendCtx, newRequestID()), conn.RemoteAddr().String())
+		if first {
+			logger.Info(reqCtx, "New connection received", "request_id", requestID(reqCtx), "remote_addr", conn.RemoteAddr().String())
+		} else if !awaitRequest(ctx, reqCtx, conn, r, cfg) {
+			return
+		}
+
+		// The whole request must arrive within the read timeout so idle or trickling clients cannot hold the connection.
+		// Checking ctx afterwards keeps a deadline set by the shutdown hook from being pushed back.
+		if err := conn.SetReadDeadline(time.Now().Add(cfg.Server.ReadTimeout)); err != nil {
+			logger.Error(reqCtx, "Failed to set read deadline", "request_id", requestID(reqCtx), "error", err.Error())
+			return
+		}
+		if ctx.Err() != nil {
+			logger.Debug(reqCtx, "Closing connection on shutdown", "request_id", requestID(reqCtx), "remote_addr", conn.RemoteAddr().String())
+			return
+		}
+
+		logger.Debug(reqCtx, "Reading email request frame", "request_id", requestID(reqCtx))
+		payload, err := protocol.ReadFrame(r, cfg.Server.MaxMessageBytes)
+		if errors.Is(err, io.EOF) {
+			if first {
+				// Closed without sending anything, as connectivity checks such as the SubmitF health probe do
+				logger.Debug(reqCtx, "Connection closed without a request", "request_id", requestID(reqCtx))
+			}
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if ctx.Err() != nil {
+				logger.Debug(reqCtx, "Closing connection on shutdown", "request_id", requestID(reqCtx), "remote_addr", conn.RemoteAddr().String())
+				return
+			}
+			connsTimedOut.Inc()
+			logger.Warn(reqCtx, "Closing slow or abandoned connection, no complete request within read timeout", "request_id", requestID(reqCtx),
+				"remote_addr", conn.RemoteAddr().String(), "read_timeout", cfg.Server.ReadTimeout, "first_request", first)
+			return
+		}
+		if err != nil {
+			logger.Error(reqCtx, "Failed to read email request frame", "request_id", requestID(reqCtx), "error", err.Error(), "remote_addr", conn.RemoteAddr().String())
+			sendAck(reqCtx, conn, fmt.Errorf("invalid request frame: %w", err))
+			return
+		}
+		if !first {
+			logger.Info(reqCtx, "Further request received on connection", "request_id", requestID(reqCtx), "remote_addr", conn.RemoteAddr().String())
+		}
+
+		handleRequest(reqCtx, conn, payload, queue, dead, sender, cfg)
+	}
+}
+
+// awaitRequest waits up to Server.IdleTimeout for the next request on a kept-alive connection.
+// It reports false when the connection should be closed because the client closed it, stayed idle or MHRS is shutting down.
+func awaitRequest(ctx, reqCtx context.Context, conn net.Conn, r *bufio.Reader, cfg *config.Config) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(cfg.Server.IdleTimeout)); err != nil {
+		logger.Error(reqCtx, "Failed to set read deadline", "request_id", requestID(reqCtx), "error", err.Error())
+		return false
+	}
+	if ctx.Err() != nil {
+		logger.Debug(reqCtx, "Closing connection on shutdown", "request_id", requestID(reqCtx), "remote_addr", conn.RemoteAddr().String())
+		return false
+	}
+
+	_, err := r.Peek(1)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil:
+		logger.Debug(reqCtx, "Closing idle connection", "request_id", requestID(reqCtx), "remote_addr", conn.RemoteAddr().String(), "idle_timeout", cfg.Server.IdleTimeout)
+	case !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Debug(reqCtx, "Connection closed while waiting for the next request", "request_id", requestID(reqCtx), "error", err.Error())
+	}
+	return false
+}
+
+// handleRequest decodes and delivers a single email request and replies with an acknowledgement.
+// When a queue is provided the request is spooled to disk before the first send attempt.
+func handleRequest(ctx context.Context, conn net.Conn, payload []byte, queue *Queue, dead *DeadLetters, sender Sender, cfg *config.Config) {
+	var req protocol.EmailRequest
+	logger.Debug(ctx, "Decoding email request", "request_id", requestID(ctx), "size", len(payload))
+	if err := json.Unmarshal(payload, &req); err != nil {
+		logger.Error(ctx, "Failed to decode email request", "request_id", requestID(ctx), "error", err.Error(), "remote_addr", conn.RemoteAddr().String())
+		sendAck(ctx, conn, fmt.Errorf("invalid request: %w", err))
+		return
+	}
 
-	logger.Debug(ctx, "Decoding email request")
-	if err := decoder.Decode(&req); err != nil {
-		logger.Error(ctx, "Failed to decode email request", "error", err.Error(), "remote_addr", conn.RemoteAddr().String())
+	if !validClientToken(req.AuthToken, cfg) {
+		logger.Warn(ctx, "Rejected request with missing or invalid client token", "request_id", requestID(ctx), "remote_addr", conn.RemoteAddr().String())
+		sendAck(ctx, conn, errUnauthorized)
 		return
 	}
+	// The token has served its purpose and must not be written to the queue or dead-letter files
+	req.AuthToken = ""
+
+	if req.Command != "" {
+		handleCommand(ctx, conn, req.Command, queue, cfg)
+		return
+	}
+
+	writeAck(ctx, conn, processRequest(ctx, req, queue, dead, sender, cfg))
+}
+
+// processRequest checks an authenticated email request and delivers it, returning the acknowledgement for the client.
+// A request repeating the idempotency key of an earlier successful one is answered without sending.
+func processRequest(ctx context.Context, req protocol.EmailRequest, queue *Queue, dead *DeadLetters, sender Sender, cfg *config.Config) protocol.Ack {
+	if size := bodySize(req); size > cfg.Server.MaxBodyBytes {
+		logger.Warn(ctx, "Rejected oversized email request", "request_id", requestID(ctx), "size", size, "max_body_bytes", cfg.Server.MaxBodyBytes, "recipient", req.Recipient)
+		return ackFor(ctx, fmt.Errorf("message too large: body and attachments are %d bytes, limit is %d", size, cfg.Server.MaxBodyBytes))
+	}
+
+	if err := checkRecipients(ctx, &req, cfg); err != nil {
+		return ackFor(ctx, err)
+	}
+
+	if count := recipientCount(req); cfg.Server.MaxRecipients > 0 && count > cfg.Server.MaxRecipients {
+		logger.Warn(ctx, "Rejected email request with too many recipients", "request_id", requestID(ctx), "recipients", count, "max_recipients", cfg.Server.MaxRecipients, "subject", req.Subject, "remote_addr", clientAddr(ctx))
+		return ackFor(ctx, fmt.Errorf("too many recipients: %d recipients in to, cc and bcc, limit is %d", count, cfg.Server.MaxRecipients))
+	}
+
+	if err := checkIdempotencyKey(req.IdempotencyKey); err != nil {
+		logger.Warn(ctx, "Rejected email request with invalid idempotency key", "request_id", requestID(ctx), "error", err.Error(), "remote_addr", clientAddr(ctx))
+		return ackFor(ctx, err)
+	}
+
+	logger.Debug(ctx, "Successfully decoded email request", "request_id", requestID(ctx), "recipient", req.Recipient, "cc_count", len(req.Cc), "bcc_count", len(req.Bcc), "subject_length", len(req.Subject), "html", len(req.HTMLBody) > 0, "attachment_count", len(req.Attachments), "header_count", len(req.Headers), "idempotency_key", req.IdempotencyKey)
+	return idempotency.Do(ctx, req.IdempotencyKey, func() protocol.Ack {
+		return deliverRequest(ctx, req, queue, dead, sender, cfg)
+	})
+}
+
+// deliverRequest sends an accepted email request, or schedules it when it carries a future SendAt,
+// and returns the acknowledgement for the client
+func deliverRequest(ctx context.Context, req protocol.EmailRequest, queue *Queue, dead *DeadLetters, sender Sender, cfg *config.Config) protocol.Ack {
+	emailsAccepted.Inc()
+	events.accepted(ctx, req)
+	if req.AttemptHistory {
+		ctx = withAttemptHistory(ctx, newAttemptHistory(attemptHistoryLimit(cfg)))
+	}
+
+	if sendTime(req).After(time.Now()) && queue == nil {
+		logger.Warn(ctx, "Rejected scheduled email without persistent queue", "request_id", requestID(ctx), "send_at", sendTime(req), "recipient", req.Recipient)
+		return ackFor(ctx, errors.New("scheduled sending requires a persistent queue (server.queue_dir)"))
+	}
+
+	if queue != nil {
+		id, err := queue.Enqueue(requestID(ctx), clientAddr(ctx), req)
+		if err != nil {
+			logger.Error(ctx, "Failed to queue email request", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+			return ackFor(ctx, fmt.Errorf("failed to queue request: %w", err))
+		}
+		logger.Debug(ctx, "Email request queued", "request_id", requestID(ctx), "queue_id", id)
+
+		// Scheduled emails are acknowledged once spooled; their outcome is reported through the callback URL
+		entry := QueueEntry{ID: id, RequestID: requestID(ctx), ClientAddr: clientAddr(ctx), QueuedAt: time.Now(), Request: req}
+		if scheduled(entry, time.Now()) {
+			queue.schedule(entry)
+			logger.Info(ctx, "Email scheduled", "request_id", requestID(ctx), "queue_id", id, "send_at", sendTime(req), "recipient", req.Recipient)
+			return protocol.Ack{Status: protocol.StatusOK, Message: "scheduled for " + sendTime(req).Format(time.RFC3339), RequestID: requestID(ctx)}
+		}
+		// An email still spooled at shutdown is delivered on the next start, so it is acknowledged as queued;
+		// this also keeps its idempotency key, and a retry does not spool it a second time
+		if err := deliverQueued(ctx, queue, dead, id, req, sender, cfg); !errors.Is(err, errKeptInQueue) {
+			return ackFor(ctx, err)
+		}
+		ack := queuedAck(requestID(ctx))
+		ack.Attempts = attemptHistoryFrom(ctx).list()
+		return ack
+	}
 
-	logger.Debug(ctx, "Successfully decoded email request", "recipient", req.Recipient, "subject_length", len(req.Subject))
 	var wg sync.WaitGroup
+	var result error
 	wg.Add(1)
 	emailCtx, cancel := context.WithTimeout(ctx, cfg.Server.Timeout)
+	counter := &countingSender{next: auditing(sender)}
 	go func() {
 		defer wg.Done()
 		defer cancel()
-		processEmail(emailCtx, req, cfg)
+		result = processEmail(emailCtx, req, counter, cfg)
 	}()
 	wg.Wait()
+	if result != nil {
+		dead.record(ctx, req, result)
+	}
+	callbacks.notify(ctx, req, counter.attempts, result)
+	events.finished(ctx, req, counter.attempts, result)
+	return ackFor(ctx, result)
 }
 
-// processEmail handles the email sending process with retries
-func processEmail(ctx context.Context, req EmailRequest, cfg *config.Config) {
-	logger.Info(ctx, "Processing email request", "recipient", req.Recipient, "subject", req.Subject)
+// bodySize returns the decoded size of a request's text body, HTML body and attachments
+func bodySize(req protocol.EmailRequest) int64 {
+	size := int64(len(req.Body) + len(req.HTMLBody))
+	for _, attachment := range req.Attachments {
+		size += int64(len(attachment.Content))
+	}
+	return size
+}
+
+// recipientCount returns the number of To, Cc and Bcc addresses of a request. A Recipient list that does not
+// parse is counted by its commas; it is rejected when the email is processed anyway.
+func recipientCount(req protocol.EmailRequest) int {
+	count := len(req.Cc) + len(req.Bcc)
+	if strings.TrimSpace(req.Recipient) == "" {
+		return count
+	}
+	if to, err := validate.AddressList(req.Recipient); err == nil {
+		return count + len(to)
+	}
+	return count + strings.Count(req.Recipient, ",") + 1
+}
+
+// checkRecipients handles a request without any recipient, which is a client bug. Depending on Server.EmptyRecipient
+// it is either rejected before it is queued or retried, or addressed to Server.DefaultRecipient.
+// Requests with an empty recipient but Cc or Bcc addresses are left as they are.
+func checkRecipients(ctx context.Context, req *protocol.EmailRequest, cfg *config.Config) error {
+	if strings.TrimSpace(req.Recipient) != "" || len(req.Cc)+len(req.Bcc) > 0 {
+		return nil
+	}
+
+	if cfg.Server.EmptyRecipient == "default" {
+		logger.Warn(ctx, "Email request without recipients, sending to default recipient", "request_id", requestID(ctx), "default_recipient", cfg.Server.DefaultRecipient, "subject", req.Subject, "remote_addr", clientAddr(ctx))
+		req.Recipient = cfg.Server.DefaultRecipient
+		return nil
+	}
+
+	logger.Warn(ctx, "Rejected email request without recipients", "request_id", requestID(ctx), "subject", req.Subject, "remote_addr", clientAddr(ctx))
+	return errors.New("no recipient specified: set recipient, cc or bcc")
+}
+
+// handleCommand answers a request carrying a query instead of an email
+func handleCommand(ctx context.Context, conn net.Conn, command string, queue *Queue, cfg *config.Config) {
+	logger.Info(ctx, "Command received", "request_id", requestID(ctx), "command", command, "remote_addr", conn.RemoteAddr().String())
+
+	switch command {
+	case protocol.CommandQueueStatus:
+		ack := protocol.Ack{Status: protocol.StatusOK, RequestID: requestID(ctx), Queue: &protocol.QueueStatus{Messages: []protocol.QueuedMessage{}}}
+		if queue != nil {
+			status, err := queue.Status(ctx, maxQueueSummaries, cfg)
+			if err != nil {
+				logger.Error(ctx, "Failed to read queue status", "request_id", requestID(ctx), "error", err.Error())
+				sendAck(ctx, conn, fmt.Errorf("failed to read queue: %w", err))
+				return
+			}
+			ack.Queue = status
+		}
+		writeAck(ctx, conn, ack)
+	default:
+		logger.Warn(ctx, "Rejected unknown command", "request_id", requestID(ctx), "command", command)
+		sendAck(ctx, conn, fmt.Errorf("unknown command %q", command))
+	}
+}
+
+// sendAck writes the outcome of a request back to the client as a framed JSON acknowledgement.
+// Clients are not required to read it, so write failures are only logged at debug level.
+func sendAck(ctx context.Context, conn net.Conn, result error) {
+	writeAck(ctx, conn, ackFor(ctx, result))
+}
+
+// ackFor returns the acknowledgement reporting result, the outcome of a request
+func ackFor(ctx context.Context, result error) protocol.Ack {
+	ack := protocol.Ack{Status: protocol.StatusOK, RequestID: requestID(ctx)}
+	switch {
+	case errors.Is(result, errServerBusy):
+		ack.Status, ack.Message = protocol.StatusBusy, result.Error()
+	case errors.Is(result, errUnauthorized):
+		ack.Status, ack.Message = protocol.StatusUnauthorized, result.Error()
+	case result != nil:
+		ack.Status, ack.Message = protocol.StatusError, result.Error()
+		ack.Bounce = classifyBounce(result)
+	case dryRun:
+		ack.Message = "dry-run ok"
+	}
+	ack.Attempts = attemptHistoryFrom(ctx).list()
+	return ack
+}
+
+// writeAck sends an acknowledgement frame to the client
+func writeAck(ctx context.Context, conn net.Conn, ack protocol.Ack) {
+	data, err := json.Marshal(ack)
+	if err != nil {
+		logger.Error(ctx, "Failed to encode acknowledgement", "request_id", requestID(ctx), "error", err.Error())
+		return
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		logger.Debug(ctx, "Failed to set acknowledgement write deadline", "request_id", requestID(ctx), "error", err.Error())
+		return
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		logger.Debug(ctx, "Failed to send acknowledgement", "request_id", requestID(ctx), "error", err.Error(), "remote_addr", conn.RemoteAddr().String())
+		return
+	}
+	logger.Debug(ctx, "Acknowledgement sent", "request_id", requestID(ctx), "status", ack.Status, "remote_addr", conn.RemoteAddr().String())
+}
+
+// processEmail handles the email sending process with retries.
+// Returns nil once the email is sent, or the last error when all attempts fail or the context is done.
+func processEmail(ctx context.Context, req protocol.EmailRequest, sender Sender, cfg *config.Config) error {
+	logger.Info(ctx, "Processing email request", "request_id", requestID(ctx), "recipient", req.Recipient, "cc", req.Cc, "bcc_count", len(req.Bcc), "subject", req.Subject)
+
+	// Recipient may hold a comma-separated list and may be empty when only Cc or Bcc are used
+	var to []string
+	if strings.TrimSpace(req.Recipient) != "" {
+		var err error
+		to, err = validate.AddressList(req.Recipient)
+		if err != nil {
+			logger.Error(ctx, "Invalid recipient", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+			emailsFailed.Inc()
+			return err
+		}
+	}
 
 	e := &email.Email{
-		To:      []string{req.Recipient},
+		To:      to,
+		Cc:      req.Cc,
+		Bcc:     req.Bcc,
 		From:    cfg.SMTP.FromAddr,
 		Subject: req.Subject,
 		Text:    req.Body,
+		HTML:    req.HTMLBody,
+	}
+
+	from, err := senderAddress(ctx, req, cfg)
+	if err != nil {
+		logger.Error(ctx, "Invalid sender override", "request_id", requestID(ctx), "error", err.Error(), "from", req.From)
+		emailsFailed.Inc()
+		return err
 	}
+	e.From = from
 
-	for attempt := 0; attempt < cfg.Server.MaxRetries; attempt++ {
-		logger.Debug(ctx, "Attempting to send email", "attempt", attempt+1, "recipient", req.Recipient)
+	if e.Sender, err = envelopeSender(req, cfg); err != nil {
+		logger.Error(ctx, "Invalid envelope sender", "request_id", requestID(ctx), "error", err.Error(), "envelope_from", req.EnvelopeFrom)
+		emailsFailed.Inc()
+		return err
+	}
 
-		if err := sendEmail(ctx, e, cfg); err != nil {
-			logger.Error(ctx, "Email attempt failed",
-				"attempt", attempt+1,
-				"recipient", req.Recipient,
-				"error", err,
-				"will_retry", attempt < cfg.Server.MaxRetries-1)
-
-			if attempt < cfg.Server.MaxRetries-1 {
-				select {
-				case <-time.After(cfg.Server.RetryDelay):
-					continue
-				case <-ctx.Done():
-					logger.Debug(ctx, "Email processing cancelled", "reason", "context done")
-					return
-				}
-			}
-		} else {
+	if err := validateRecipients(e); err != nil {
+		logger.Error(ctx, "Invalid recipients", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+		emailsFailed.Inc()
+		return err
+	}
+
+	if err := checkRecipientDomains(e, cfg); err != nil {
+		logger.Error(ctx, "Recipient domain not permitted", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+		emailsFailed.Inc()
+		return err
+	}
+
+	if req.ReplyTo != "" {
+		if err := validate.Address(req.ReplyTo); err != nil {
+			logger.Error(ctx, "Invalid reply-to address", "request_id", requestID(ctx), "error", err.Error(), "reply_to", req.ReplyTo)
+			emailsFailed.Inc()
+			return fmt.Errorf("invalid reply-to address: %w", err)
+		}
+		// Formatted here so a non-ASCII display name is encoded on its own rather than with the address
+		replyTo, err := formatAddressList(req.ReplyTo)
+		if err != nil {
+			logger.Error(ctx, "Invalid reply-to address", "request_id", requestID(ctx), "error", err.Error(), "reply_to", req.ReplyTo)
+			emailsFailed.Inc()
+			return fmt.Errorf("invalid reply-to address: %w", err)
+		}
+		e.ReplyTo = []string{replyTo}
+	}
+
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			logger.Error(ctx, "Invalid callback URL", "request_id", requestID(ctx), "error", err.Error(), "callback_url", req.CallbackURL)
+			emailsFailed.Inc()
+			return fmt.Errorf("invalid callback URL: %w", err)
+		}
+	}
+
+	if err := applyHeaders(e, req.Headers, cfg.Server.AllowedHeaderOverrides); err != nil {
+		logger.Error(ctx, "Invalid custom headers", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+		emailsFailed.Inc()
+		return err
+	}
+
+	if err := setMessageHeaders(e, cfg.Server.MessageIDDomain, time.Now()); err != nil {
+		logger.Error(ctx, "Failed to set message headers", "request_id", requestID(ctx), "error", err.Error(), "recipient", req.Recipient)
+		emailsFailed.Inc()
+		return err
+	}
+
+	if err := attachFiles(e, req.Attachments, cfg.Server.MaxAttachmentBytes); err != nil {
+		logger.Error(ctx, "Failed to attach files",
+			"request_id", requestID(ctx),
+			"recipient", req.Recipient,
+			"attachment_count", len(req.Attachments),
+			"error", err.Error())
+		emailsFailed.Inc()
+		return err
+	}
+
+	// With a retry deadline attempts continue until it is reached, backing off exponentially from Server.RetryDelay;
+	// otherwise Server.MaxRetries attempts are made Server.RetryDelay apart. A spooled email continues from the
+	// attempts an earlier run made, and stops waiting for its next attempt when shutdown begins.
+	var lastErr error
+	var attempts int
+	start := time.Now()
+	backoff := cfg.Server.RetryDelay
+	state, spooled := retryStateFrom(ctx)
+	if !state.since.IsZero() {
+		start = state.since
+	}
+	if cfg.Server.RetryDeadline > 0 {
+		for range state.attempts {
+			backoff = min(backoff*2, maxRetryBackoff)
+		}
+	}
+	history := attemptHistoryFrom(ctx)
+	var drain <-chan struct{}
+	if spooled {
+		drain = activeRequests.draining()
+	}
+	for attempt := state.attempts; ; attempt++ {
+		logger.Debug(ctx, "Attempting to send email", "request_id", requestID(ctx), "attempt", attempt+1, "recipient", req.Recipient)
+		if attempt > 0 {
+			retryAttempts.Inc()
+		}
+
+		attemptStart := time.Now()
+		err := sender.Send(ctx, e)
+		history.record(attempt+1, attemptStart, err)
+		if err == nil {
 			logger.Info(ctx, "Email sent successfully",
+				"request_id", requestID(ctx),
 				"recipient", req.Recipient,
 				"subject", req.Subject,
 				"attempt", attempt+1)
-			return
+			emailsSent.Inc()
+			return nil
+		}
+
+		lastErr, attempts = err, attempt+1
+		if errors.Is(err, errDailyLimit) {
+			emailsFailed.Inc()
+			return err
+		}
+		if isPermanentSMTPError(err) && !cfg.Server.RetryPermanentErrors {
+			logger.Error(ctx, "Email rejected permanently, not retrying",
+				"request_id", requestID(ctx),
+				"attempt", attempt+1,
+				"recipient", req.Recipient,
+				"error", err.Error())
+			emailsFailed.Inc()
+			recordBounce(ctx, err)
+			return fmt.Errorf("permanent failure: %w", err)
+		}
+
+		willRetry := cfg.Server.RetryDeadline > 0 || attempt < cfg.Server.MaxRetries-1
+		var delay time.Duration
+		if willRetry {
+			delay = retryDelay(ctx, err, backoff, cfg)
+			if cfg.Server.RetryDeadline > 0 && time.Since(start)+delay >= cfg.Server.RetryDeadline {
+				willRetry = false
+			}
 		}
+		logger.Error(ctx, "Email attempt failed",
+			"request_id", requestID(ctx),
+			"attempt", attempt+1,
+			"recipient", req.Recipient,
+			"error", err,
+			"will_retry", willRetry)
+		if !willRetry {
+			break
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			logger.Error(ctx, "Retry delay exceeds the remaining processing time, giving up",
+				"request_id", requestID(ctx),
+				"attempt", attempt+1,
+				"retry_delay", delay.String(),
+				"timeout", cfg.Server.Timeout.String())
+			emailsFailed.Inc()
+			recordBounce(ctx, err)
+			return fmt.Errorf("retry delay %s exceeds the remaining processing time: %w", delay, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-drain:
+			logger.Info(ctx, "Retry left to the next start by shutdown", "request_id", requestID(ctx), "attempts", attempt+1, "recipient", req.Recipient)
+			return fmt.Errorf("%w: %w", errRetryDeferred, err)
+		case <-ctx.Done():
+			logger.Debug(ctx, "Email processing cancelled", "request_id", requestID(ctx), "reason", "context done")
+			emailsFailed.Inc()
+			return ctx.Err()
+		}
+		if cfg.Server.RetryDeadline > 0 {
+			backoff = min(backoff*2, maxRetryBackoff)
+		}
+	}
+
+	logger.Error(ctx, "Email delivery failed", "request_id", requestID(ctx), "recipient", req.Recipient, "attempts", attempts)
+	emailsFailed.Inc()
+	recordBounce(ctx, lastErr)
+	if cfg.Server.RetryDeadline > 0 {
+		return fmt.Errorf("retry deadline %s reached after %d attempts: %w", cfg.Server.RetryDeadline, attempts, lastErr)
 	}
+	return fmt.Errorf("all %d attempts failed: %w", attempts, lastErr)
 }
 
-// sendEmail performs the actual email sending operation using SMTP
-func sendEmail(ctx context.Context, e *email.Email, cfg *config.Config) error {
-	logger.Debug(ctx, "Preparing to send email",
-		"to", e.To,
-		"from", e.From,
-		"subject", e.Subject)
+// senderAddress returns the From address for req. The request's From and FromName are only honored when
+// Server.AllowFromOverride is set; otherwise, or when neither is given, the configured FromAddr is used with
+// SMTP.FromName as its display name. Non-ASCII display names are encoded per RFC 2047.
+func senderAddress(ctx context.Context, req protocol.EmailRequest, cfg *config.Config) (string, error) {
+	configured := formatAddress(cfg.SMTP.FromName, cfg.SMTP.FromAddr)
+	if req.From == "" && req.FromName == "" {
+		return configured, nil
+	}
+	if !cfg.Server.AllowFromOverride {
+		logger.Debug(ctx, "Ignoring sender override, allow_from_override is disabled", "request_id", requestID(ctx), "from", req.From)
+		return configured, nil
+	}
+
+	addr, name := cfg.SMTP.FromAddr, req.FromName
+	if req.From != "" {
+		parsed, err := mail.ParseAddress(req.From)
+		if err != nil {
+			return "", fmt.Errorf("invalid sender address: %w", err)
+		}
+		addr = parsed.Address
+		if name == "" {
+			name = parsed.Name
+		}
+	}
 
-	auth := smtp.PlainAuth("", cfg.SMTP.AuthUser, cfg.SMTP.AuthPass, cfg.SMTP.Host)
+	return formatAddress(name, addr), nil
+}
 
-	tlsConfig := &tls.Config{
-		ServerName: cfg.SMTP.Host,
-		MinVersion: tls.VersionTLS12,
+// retryDelay returns how long to wait before retrying after err. Greylisting replies (450, 451, 452) wait for the
+// interval the server suggests, or Server.GreylistDelay when it names none, capped at Server.GreylistMaxDelay and
+// never shorter than backoff, the current backoff delay, which applies to all other failures.
+func retryDelay(ctx context.Context, err error, backoff time.Duration, cfg *config.Config) time.Duration {
+	suggested, greylisted := greylistDelay(err)
+	if !greylisted {
+		return backoff
 	}
 
-	logger.Debug(ctx, "Initiating SMTP connection",
-		"host", cfg.SMTP.Host,
-		"port", cfg.SMTP.Port)
+	delay := cfg.Server.GreylistDelay
+	if suggested > 0 {
+		delay = suggested
+	}
+	delay = max(min(delay, cfg.Server.GreylistMaxDelay), backoff)
+	logger.Info(ctx, "Greylisted by SMTP server, delaying retry", "request_id", requestID(ctx), "suggested", suggested.String(), "retry_delay", delay.String())
+	return delay
+}
 
-	err := e.SendWithStartTLS(cfg.SMTP.Host+":"+cfg.SMTP.Port, auth, tlsConfig)
+// envelopeSender returns the request's envelope sender, or an empty string to use the From address.
+// Its domain must match smtp.from_addr unless Server.AllowFromOverride permits any sender.
+func envelopeSender(req protocol.EmailRequest, cfg *config.Config) (string, error) {
+	if req.EnvelopeFrom == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(req.EnvelopeFrom)
 	if err != nil {
-		logger.Error(ctx, "Failed to send email",
-			"error", err.Error(),
-			"host", cfg.SMTP.Host,
-			"port", cfg.SMTP.Port,
-			"recipient", e.To)
-		return fmt.Errorf("failed to send email: %w", err)
+		return "", fmt.Errorf("invalid envelope sender: %w", err)
+	}
+	if !cfg.Server.AllowFromOverride {
+		_, domain, _ := strings.Cut(addr.Address, "@")
+		_, fromDomain, _ := strings.Cut(cfg.SMTP.FromAddr, "@")
+		if !strings.EqualFold(domain, fromDomain) {
+			return "", fmt.Errorf("envelope sender %s must be in the domain of the sender address %s", addr.Address, cfg.SMTP.FromAddr)
+		}
+	}
+	return addr.Address, nil
+}
+
+// formatAddress renders addr with an optional display name as a header value, e.g. "Support" <help@example.com>
+func formatAddress(name, addr string) string {
+	if name == "" {
+		return addr
+	}
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
+// attachFiles adds the request attachments to the email after checking that their combined
+// size stays within maxBytes. Nothing is attached if the limit is exceeded.
+func attachFiles(e *email.Email, attachments []protocol.Attachment, maxBytes int64) error {
+	var total int64
+	for _, a := range attachments {
+		if a.Filename == "" {
+			return fmt.Errorf("attachment filename is required")
+		}
+		if a.Inline {
+			if a.ContentID == "" {
+				return fmt.Errorf("inline attachment %q requires a content ID", a.Filename)
+			}
+			if strings.ContainsAny(a.ContentID, "<>\"\r\n\t ") {
+				return fmt.Errorf("invalid content ID %q for inline attachment %q", a.ContentID, a.Filename)
+			}
+			if len(e.HTML) == 0 {
+				return fmt.Errorf("inline attachment %q requires an HTML body", a.Filename)
+			}
+		}
+		total += int64(len(a.Content))
+	}
+	if total > maxBytes {
+		return fmt.Errorf("total attachment size %d bytes exceeds limit of %d bytes", total, maxBytes)
+	}
+
+	for _, a := range attachments {
+		attachment, err := e.Attach(bytes.NewReader(a.Content), a.Filename, a.ContentType)
+		if err != nil {
+			return fmt.Errorf("failed to attach %q: %w", a.Filename, err)
+		}
+		if a.Inline {
+			attachment.HTMLRelated = true
+			attachment.Header.Set("Content-ID", "<"+a.ContentID+">")
+		}
+	}
+
+	return nil
+}
+
+// validateRecipients checks that every To, Cc and Bcc address parses before any SMTP attempt is made,
+// so malformed addresses fail immediately instead of going through the retry cycle.
+// Bcc addresses are only used for the SMTP envelope and are never written to the message headers.
+func validateRecipients(e *email.Email) error {
+	if len(e.To)+len(e.Cc)+len(e.Bcc) == 0 {
+		return fmt.Errorf("no recipient specified")
+	}
+
+	categories := []struct {
+		name  string
+		addrs []string
+	}{
+		{"to", e.To},
+		{"cc", e.Cc},
+		{"bcc", e.Bcc},
+	}
+	for _, category := range categories {
+		for _, addr := range category.addrs {
+			if err := validate.Address(addr); err != nil {
+				return fmt.Errorf("invalid %s recipient: %w", category.name, err)
+			}
+		}
 	}
 
-	logger.Debug(ctx, "Email sent successfully",
-		"recipient", e.To,
-		"subject", e.Subject)
 	return nil
 }
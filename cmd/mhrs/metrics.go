@@ -0,0 +1,21 @@
+package main
+
+import "mailhubrelay/internal/metrics"
+
+// Service metrics, always collected and exposed only when Server.MetricsAddr is set
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	emailsAccepted    = metricsRegistry.NewCounter("mhrs_emails_accepted_total", "Email requests accepted for delivery")
+	emailsSent        = metricsRegistry.NewCounter("mhrs_emails_sent_total", "Emails delivered to the SMTP server")
+	emailsFailed      = metricsRegistry.NewCounter("mhrs_emails_failed_total", "Emails that could not be delivered")
+	connsRejected     = metricsRegistry.NewCounter("mhrs_connections_rejected_total", "Connections rejected because the concurrency limit was reached")
+	connsTimedOut     = metricsRegistry.NewCounter("mhrs_connections_timed_out_total", "Connections closed because no complete request arrived within the read timeout")
+	backendFailures   = metricsRegistry.NewCounterVec("mhrs_smtp_backend_failures_total", "Failed send attempts per SMTP backend", "backend")
+	sendsThrottled    = metricsRegistry.NewCounter("mhrs_sends_throttled_total", "Sends delayed by the outbound rate limit")
+	bounces           = metricsRegistry.NewCounterVec("mhrs_bounces_total", "Failed emails rejected by the SMTP server, by bounce category", "category")
+	retryAttempts     = metricsRegistry.NewCounter("mhrs_retry_attempts_total", "Send attempts made after a failed first attempt")
+	duplicateRequests = metricsRegistry.NewCounter("mhrs_duplicate_requests_total", "Email requests answered with the result of an earlier request with the same idempotency key")
+	sendLatency       = metricsRegistry.NewHistogram("mhrs_send_duration_seconds", "Duration of individual SMTP send attempts",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+)
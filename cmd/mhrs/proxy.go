@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion      = 5
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksCmdConnect   = 0x01
+	socksAddrIPv4     = 0x01
+	socksAddrDomain   = 0x03
+	socksAddrIPv6     = 0x04
+)
+
+// socksReplies describes the SOCKS5 reply codes other than success
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// dialProxy connects to addr through the proxy named by proxyURL, a socks5:// or http:// URL whose user info
+// holds optional credentials. The target host name is passed to the proxy unresolved, so it is looked up on the
+// proxy side. The returned connection is a plain tunnel; TLS is negotiated over it by the caller.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxyURL, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", u.Redacted(), err)
+	}
+
+	// The handshake is bounded like the dial itself and aborted when ctx ends
+	deadline := time.Now().Add(smtpDialTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	stop := abortOnCancel(ctx, conn)
+	defer stop()
+
+	tunnel := conn
+	switch u.Scheme {
+	case "socks5":
+		err = socksConnect(conn, u.User, addr)
+	case "http":
+		tunnel, err = httpConnect(conn, u.User, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, fmt.Errorf("proxy %s: %w", u.Redacted(), err))
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// socksConnect asks a SOCKS5 server to open a TCP connection to addr, authenticating with user when given
+func socksConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socksAuthNone)
+	if user != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("failed to read method selection: %w", err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 server (version %d)", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("proxy refused the offered authentication method")
+	}
+
+	if method == socksAuthPassword {
+		name := user.Username()
+		pass, _ := user.Password()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("proxy user name and password must be at most 255 bytes")
+		}
+		msg := append([]byte{1, byte(len(name))}, name...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return fmt.Errorf("failed to read authentication reply: %w", err)
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			req = append(append(req, socksAddrIPv4), ip.AsSlice()...)
+		} else {
+			req = append(append(req, socksAddrIPv6), ip.AsSlice()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(append(req, socksAddrDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Reply: version, status, reserved, bound address type, bound address, bound port
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return fmt.Errorf("failed to read connect reply: %w", err)
+	}
+	if head[1] != 0 {
+		if reason, ok := socksReplies[head[1]]; ok {
+			return fmt.Errorf("connect to %s failed: %s", addr, reason)
+		}
+		return fmt.Errorf("connect to %s failed with SOCKS reply %d", addr, head[1])
+	}
+	var skip int
+	switch head[3] {
+	case socksAddrIPv4:
+		skip = 4
+	case socksAddrIPv6:
+		skip = 16
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return fmt.Errorf("failed to read connect reply: %w", err)
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown address type %d in connect reply", head[3])
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(skip+2)); err != nil {
+		return fmt.Errorf("failed to read connect reply: %w", err)
+	}
+	return nil
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request, using basic authentication when user is given
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	// The SMTP greeting may already sit in the reader's buffer
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/validate"
+
+	"github.com/jordan-wright/email"
+)
+
+const (
+	queueFileExt   = ".json"
+	corruptFileExt = ".corrupt"
+)
+
+// ErrQueueFull is returned when the spool directory already holds the maximum number of messages
+var ErrQueueFull = errors.New("queue is full")
+
+// errKeptInQueue reports an email whose delivery was interrupted by shutdown; it stays spooled for the next start
+var errKeptInQueue = errors.New("delivery interrupted by shutdown, email kept in queue")
+
+// errRetryDeferred reports a spooled email whose next attempt was left to the next start because shutdown began
+var errRetryDeferred = errors.New("retry deferred to next start by shutdown")
+
+// QueueEntry is the on-disk representation of a spooled email request
+type QueueEntry struct {
+	ID         string                `json:"id"`                    // Unique identifier, also the spool file name
+	RequestID  string                `json:"request_id,omitempty"`  // ID of the connection that submitted the request
+	ClientAddr string                `json:"client_addr,omitempty"` // Address of the client that submitted the request
+	QueuedAt   time.Time             `json:"queued_at"`             // Time the request was accepted
+	Request    protocol.EmailRequest `json:"request"`               // Original email request
+
+	// Retry state, updated after every send attempt so a restart resumes where delivery stopped
+	Attempts     int        `json:"attempts,omitempty"`      // Send attempts made so far
+	LastError    string     `json:"last_error,omitempty"`    // Error of the last failed attempt
+	FirstAttempt *time.Time `json:"first_attempt,omitempty"` // Time of the first attempt, the start of the retry deadline
+	Delivered    bool       `json:"delivered,omitempty"`     // The email was sent but the entry was not removed yet
+}
+
+// Queue is a disk-backed spool that keeps accepted email requests until they are sent.
+// Each entry is stored as a separate JSON file so a crash can only affect the entry being written.
+type Queue struct {
+	dir      string
+	maxSize  int
+	mu       sync.Mutex
+	progress map[string]*queueProgress // Delivery progress of entries this run has attempted, by entry ID
+
+	scheduled []QueueEntry  // Entries waiting for their SendAt time, earliest first
+	wake      chan struct{} // Signals the scheduler that an entry was scheduled
+}
+
+// queueProgress records the send attempts made for a queue entry, for queue status queries and the spooled retry state
+type queueProgress struct {
+	attempts     int
+	sending      bool
+	lastError    string
+	firstAttempt time.Time
+	delivered    bool
+}
+
+// OpenQueue prepares the spool directory and returns a queue bound to it
+func OpenQueue(dir string, maxSize int) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	return &Queue{dir: dir, maxSize: maxSize, progress: make(map[string]*queueProgress), wake: make(chan struct{}, 1)}, nil
+}
+
+// Enqueue writes the request submitted under requestID by the client at clientAddr to the spool and returns the entry ID
+func (q *Queue) Enqueue(requestID, clientAddr string, req protocol.EmailRequest) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count, err := q.count()
+	if err != nil {
+		return "", err
+	}
+	if count >= q.maxSize {
+		return "", ErrQueueFull
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := q.write(QueueEntry{ID: id, RequestID: requestID, ClientAddr: clientAddr, QueuedAt: time.Now(), Request: req}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// write stores entry in the spool; the caller must hold q.mu.
+// The file is written under a temporary name and renamed so a partially written entry is never picked up.
+func (q *Queue) write(entry QueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode queue entry: %w", err)
+	}
+
+	tmpPath := filepath.Join(q.dir, "."+entry.ID+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write queue entry: %w", err)
+	}
+	if err := os.Rename(tmpPath, q.path(entry.ID)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to commit queue entry: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes a spooled entry once it no longer needs to be delivered
+func (q *Queue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.progress, id)
+	if err := os.Remove(q.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove queue entry: %w", err)
+	}
+	return nil
+}
+
+// Pending loads all spooled entries ordered by queue time, taking over the retry state they were spooled with.
+// Entries that cannot be decoded are renamed with a .corrupt suffix and skipped.
+func (q *Queue) Pending(ctx context.Context) ([]QueueEntry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	var entries []QueueEntry
+	for _, file := range files {
+		if file.IsDir() || !isQueueFile(file.Name()) {
+			continue
+		}
+
+		path := filepath.Join(q.dir, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error(ctx, "Failed to read queue entry", "file", path, "error", err.Error())
+			continue
+		}
+
+		var entry QueueEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.ID+queueFileExt != file.Name() {
+			logger.Warn(ctx, "Quarantining corrupt queue entry", "file", path)
+			if err := os.Rename(path, path+corruptFileExt); err != nil {
+				logger.Error(ctx, "Failed to quarantine queue entry", "file", path, "error", err.Error())
+			}
+			continue
+		}
+		if q.progress[entry.ID] == nil && (entry.Attempts > 0 || entry.Delivered) {
+			p := &queueProgress{attempts: entry.Attempts, lastError: entry.LastError, delivered: entry.Delivered}
+			if entry.FirstAttempt != nil {
+				p.firstAttempt = *entry.FirstAttempt
+			}
+			q.progress[entry.ID] = p
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QueuedAt.Before(entries[j].QueuedAt)
+	})
+	return entries, nil
+}
+
+// Status summarizes the spooled entries, oldest first, together with the progress of their delivery.
+// At most limit entries are summarized; the count covers all of them.
+func (q *Queue) Status(ctx context.Context, limit int, cfg *config.Config) (*protocol.QueueStatus, error) {
+	entries, err := q.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	status := &protocol.QueueStatus{Enabled: true, Count: len(entries), Messages: []protocol.QueuedMessage{}}
+	for _, entry := range entries[:min(len(entries), limit)] {
+		req := entry.Request
+		msg := protocol.QueuedMessage{
+			ID:         entry.ID,
+			RequestID:  entry.RequestID,
+			QueuedAt:   entry.QueuedAt,
+			Size:       bodySize(req),
+			Sender:     cfg.SMTP.FromAddr,
+			Recipients: queuedRecipients(req),
+			Subject:    req.Subject,
+			State:      protocol.QueueStateQueued,
+			SendAt:     req.SendAt,
+		}
+		if scheduled(entry, now) {
+			msg.State = protocol.QueueStateScheduled
+		}
+		switch {
+		case req.EnvelopeFrom != "":
+			msg.Sender = req.EnvelopeFrom
+		case req.From != "" && cfg.Server.AllowFromOverride:
+			msg.Sender = req.From
+		}
+		if p := q.progress[entry.ID]; p != nil {
+			msg.Attempts, msg.LastError = p.attempts, p.lastError
+			switch {
+			case p.sending:
+				msg.State = protocol.QueueStateSending
+			case p.attempts > 0:
+				msg.State = protocol.QueueStateRetrying
+			}
+		}
+		status.Messages = append(status.Messages, msg)
+	}
+	return status, nil
+}
+
+// attemptStarted records that a send attempt for entry id has begun
+func (q *Queue) attemptStarted(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p := q.progress[id]
+	if p == nil {
+		p = &queueProgress{}
+		q.progress[id] = p
+	}
+	if p.attempts == 0 {
+		p.firstAttempt = time.Now()
+	}
+	p.attempts++
+	p.sending = true
+}
+
+// attemptFinished records the outcome of the send attempt for entry id and saves the retry state to the spool,
+// so an email sent just before the process stops is not sent again and a failing one keeps its attempt count
+func (q *Queue) attemptFinished(ctx context.Context, id string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p := q.progress[id]
+	if p == nil {
+		return
+	}
+	p.sending = false
+	if err != nil {
+		p.lastError = err.Error()
+	} else {
+		p.delivered = true
+	}
+	if saveErr := q.saveProgress(id, p); saveErr != nil {
+		logger.Error(ctx, "Failed to save queue entry retry state", "request_id", requestID(ctx), "queue_id", id, "error", saveErr.Error())
+	}
+}
+
+// saveProgress rewrites the spooled entry id with its retry state; the caller must hold q.mu.
+// An entry that was removed meanwhile is not written back.
+func (q *Queue) saveProgress(id string, p *queueProgress) error {
+	data, err := os.ReadFile(q.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read queue entry: %w", err)
+	}
+
+	var entry QueueEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("failed to decode queue entry: %w", err)
+	}
+	firstAttempt := p.firstAttempt
+	entry.Attempts, entry.LastError, entry.FirstAttempt, entry.Delivered = p.attempts, p.lastError, &firstAttempt, p.delivered
+	return q.write(entry)
+}
+
+// retryState returns the attempts already made for entry id, by this run or an earlier one,
+// and whether the email was already sent
+func (q *Queue) retryState(id string) (retryState, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p := q.progress[id]
+	if p == nil {
+		return retryState{}, false
+	}
+	return retryState{attempts: p.attempts, since: p.firstAttempt}, p.delivered
+}
+
+// count returns the number of spooled entries; the caller must hold q.mu
+func (q *Queue) count() (int, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	count := 0
+	for _, file := range files {
+		if !file.IsDir() && isQueueFile(file.Name()) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (q *Queue) path(id string) string {
+	return filepath.Join(q.dir, id+queueFileExt)
+}
+
+// isQueueFile reports whether name is a committed spool entry rather than a temporary or quarantined file
+func isQueueFile(name string) bool {
+	return strings.HasSuffix(name, queueFileExt) && !strings.HasPrefix(name, ".")
+}
+
+// newQueueID generates a time-ordered unique identifier for a queue entry
+func newQueueID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate queue id: %w", err)
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// spooledEntries reads the messages left in the spool by a previous run and remembers their idempotency keys, so repeats
+// are answered as accepted instead of being queued a second time. It must run before any listener opens, otherwise
+// emails accepted by this run would be resumed as well and sent twice.
+func spooledEntries(ctx context.Context, queue *Queue) ([]QueueEntry, error) {
+	entries, err := queue.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		idempotency.Remember(ctx, entry.Request.IdempotencyKey, queuedAck(entryRequestID(entry)))
+	}
+	return entries, nil
+}
+
+// resumeQueue sends the entries left in the spool by a previous run, handing those scheduled for later to the scheduler.
+// Messages are processed one at a time so a large backlog does not flood the SMTP server on startup.
+// No new message is started once ctx is cancelled or drain has begun; the message in progress is sent under sendCtx
+// and registered with activeRequests so drain waits for it.
+func resumeQueue(ctx, sendCtx context.Context, queue *Queue, entries []QueueEntry, dead *DeadLetters, sender Sender, cfg *config.Config) {
+	if len(entries) == 0 {
+		return
+	}
+
+	logger.Info(ctx, "Resuming queued emails", "count", len(entries))
+	for _, entry := range entries {
+		if scheduled(entry, time.Now()) {
+			queue.schedule(entry)
+			continue
+		}
+		if ctx.Err() != nil || !activeRequests.tryAdd() {
+			logger.Info(ctx, "Queue resume interrupted", "reason", "shutting down")
+			return
+		}
+		deliverQueued(withClientAddr(withRequestID(sendCtx, entryRequestID(entry)), entry.ClientAddr), queue, dead, entry.ID, entry.Request, sender, cfg)
+		activeRequests.done()
+	}
+}
+
+// entryRequestID returns the ID a spooled request is logged under.
+// Entries spooled by older versions carry no request ID, so the queue ID stands in for it.
+func entryRequestID(entry QueueEntry) string {
+	if entry.RequestID != "" {
+		return entry.RequestID
+	}
+	return entry.ID
+}
+
+// deliverQueued processes a spooled request and removes it from the spool unless the service is shutting down,
+// in which case the entry is kept so the next run can resume it. Requests that fail are passed to the dead-letter store,
+// and the final outcome is posted to the request's callback URL.
+// An entry that already carries attempts from an earlier run only gets the retries left over, and one that was sent
+// before the previous run stopped is finished without sending it again.
+func deliverQueued(ctx context.Context, queue *Queue, dead *DeadLetters, id string, req protocol.EmailRequest, sender Sender, cfg *config.Config) error {
+	emailCtx, cancel := context.WithTimeout(ctx, cfg.Server.Timeout)
+	defer cancel()
+
+	state, delivered := queue.retryState(id)
+	counter := &countingSender{next: &queuedSender{next: auditing(sender), queue: queue, id: id}, attempts: state.attempts}
+	var err error
+	if delivered {
+		logger.Info(ctx, "Email was sent before the last shutdown, not sending again", "request_id", requestID(ctx), "queue_id", id, "recipient", req.Recipient)
+	} else {
+		err = processEmail(withRetryState(emailCtx, state), req, counter, cfg)
+	}
+	// Only shutdown cancels ctx; a request whose client deadline passed has failed and is not kept
+	if err != nil && (errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, errRetryDeferred)) {
+		logger.Info(ctx, "Email kept in queue for next start", "request_id", requestID(ctx), "queue_id", id, "recipient", req.Recipient)
+		return fmt.Errorf("%w: %w", errKeptInQueue, err)
+	}
+
+	if err != nil {
+		dead.record(ctx, req, err)
+	}
+	callbacks.notify(ctx, req, counter.attempts, err)
+	events.finished(ctx, req, counter.attempts, err)
+	if removeErr := queue.Remove(id); removeErr != nil {
+		logger.Error(ctx, "Failed to remove email from queue", "request_id", requestID(ctx), "queue_id", id, "error", removeErr.Error())
+	}
+	return err
+}
+
+// queuedAck acknowledges a request whose email is spooled and will be delivered, possibly after a restart
+func queuedAck(requestID string) protocol.Ack {
+	return protocol.Ack{Status: protocol.StatusOK, Message: "queued", RequestID: requestID}
+}
+
+// queuedSender records the send attempts for a queue entry so queue status queries can report its progress
+type queuedSender struct {
+	next  Sender
+	queue *Queue
+	id    string
+}
+
+// Send forwards to the wrapped sender
+func (s *queuedSender) Send(ctx context.Context, e *email.Email) error {
+	s.queue.attemptStarted(s.id)
+	err := s.next.Send(ctx, e)
+	s.queue.attemptFinished(ctx, s.id, err)
+	return err
+}
+
+// queuedRecipients lists the To, Cc and Bcc recipients of a request
+func queuedRecipients(req protocol.EmailRequest) []string {
+	var recipients []string
+	if strings.TrimSpace(req.Recipient) != "" {
+		to, err := validate.AddressList(req.Recipient)
+		if err != nil {
+			to = []string{req.Recipient}
+		}
+		recipients = append(recipients, to...)
+	}
+	return slices.Concat(recipients, req.Cc, req.Bcc)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/protocol"
+
+	"github.com/jordan-wright/email"
+)
+
+// TestDrainKillResume drains a queue with one email sent, one waiting to be retried, one being sent and one not yet
+// started, kills the process mid-drain by snapshotting the spool, and resumes a second run from the snapshot.
+// Every email must be delivered exactly once across both runs, and the retried one must keep its attempt count.
+func TestDrainKillResume(t *testing.T) {
+	activeRequests = inflight{}
+	t.Cleanup(func() { activeRequests = inflight{} })
+
+	dir := t.TempDir()
+	queue, err := OpenQueue(filepath.Join(dir, "queue"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := queueTestConfig()
+
+	subjects := []string{"sent", "retrying", "in flight", "not started"}
+	ids := make(map[string]string)
+	for _, subject := range subjects {
+		id, err := queue.Enqueue(subject, "", queueTestRequest(subject))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[subject] = id
+	}
+
+	// First run: "retrying" fails once and waits for its retry, "in flight" hangs until its send is cancelled
+	failed := make(chan struct{})
+	sending := make(chan struct{})
+	first := &scriptedSender{reply: func(ctx context.Context, subject string) error {
+		switch subject {
+		case "retrying":
+			close(failed)
+			return errors.New("connection reset by peer")
+		case "in flight":
+			close(sending)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}}
+
+	type result struct {
+		subject string
+		err     error
+	}
+	results := make(chan result, 3)
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
+	for _, subject := range subjects[:3] {
+		activeRequests.add()
+		go func() {
+			defer activeRequests.done()
+			err := deliverQueued(withRequestID(sendCtx, subject), queue, nil, ids[subject], queueTestRequest(subject), first, cfg)
+			results <- result{subject, err}
+		}()
+	}
+	if r := <-results; r.subject != "sent" || r.err != nil {
+		t.Fatalf("first result = %s: %v, want sent without error", r.subject, r.err)
+	}
+	<-failed
+	<-sending
+
+	drained := make(chan struct{})
+	go func() {
+		drainRequests(context.Background(), cancelSends, true, time.Minute)
+		close(drained)
+	}()
+
+	// The email waiting for its retry stops at once and stays spooled
+	if r := <-results; r.subject != "retrying" || !errors.Is(r.err, errKeptInQueue) {
+		t.Fatalf("result = %s: %v, want retrying kept in queue", r.subject, r.err)
+	}
+
+	// Kill mid-drain: the spool as it is now is all the next run gets
+	snapshot := filepath.Join(dir, "snapshot")
+	if err := os.CopyFS(snapshot, os.DirFS(queue.dir)); err != nil {
+		t.Fatal(err)
+	}
+	delivered := first.deliveredCopy()
+
+	cancelSends()
+	<-drained
+	if r := <-results; r.subject != "in flight" || !errors.Is(r.err, errKeptInQueue) {
+		t.Fatalf("result = %s: %v, want in flight kept in queue", r.subject, r.err)
+	}
+
+	// Second run resumes from the snapshot, in a process that is not draining
+	activeRequests = inflight{}
+	resumed, err := OpenQueue(snapshot, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := resumed.Pending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spooled := make(map[string]QueueEntry)
+	for _, entry := range entries {
+		spooled[entry.Request.Subject] = entry
+	}
+	if _, ok := spooled["sent"]; ok || len(spooled) != 3 {
+		t.Fatalf("snapshot holds %d entries %v, want all but the sent one", len(spooled), spooled)
+	}
+	if entry := spooled["retrying"]; entry.Attempts != 1 || !strings.Contains(entry.LastError, "connection reset") || entry.FirstAttempt == nil {
+		t.Errorf("retrying entry has attempts %d, last error %q, first attempt %v, want its failed attempt kept",
+			entry.Attempts, entry.LastError, entry.FirstAttempt)
+	}
+
+	second := &scriptedSender{}
+	resumeQueue(context.Background(), context.Background(), resumed, entries, nil, second, cfg)
+
+	for subject, count := range second.deliveredCopy() {
+		delivered[subject] += count
+	}
+	for _, subject := range subjects {
+		if delivered[subject] != 1 {
+			t.Errorf("%q delivered %d times, want once", subject, delivered[subject])
+		}
+	}
+	if left, err := resumed.Pending(context.Background()); err != nil || len(left) != 0 {
+		t.Errorf("queue holds %d entries after the second run (%v), want none", len(left), err)
+	}
+}
+
+// TestResumeContinuesRetryBudget checks that a spooled email only gets the attempts an earlier run left over
+func TestResumeContinuesRetryBudget(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenQueue(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := queueTestConfig()
+	cfg.Server.RetryDelay = time.Millisecond
+
+	req := queueTestRequest("failing")
+	id, err := queue.Enqueue("failing", "", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		queue.attemptStarted(id)
+		queue.attemptFinished(context.Background(), id, errors.New("connection refused"))
+	}
+
+	resumed, err := OpenQueue(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumed.Pending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sender := &scriptedSender{reply: func(context.Context, string) error { return errors.New("connection refused") }}
+	err = deliverQueued(context.Background(), resumed, nil, id, req, sender, cfg)
+	if err == nil || !strings.Contains(err.Error(), "all 3 attempts failed") {
+		t.Errorf("error = %v, want all 3 attempts failed", err)
+	}
+	if sender.calls != 1 {
+		t.Errorf("resumed delivery made %d attempts, want the 1 left of 3", sender.calls)
+	}
+}
+
+// TestResumeSkipsDeliveredEntry checks that an email sent just before the process stopped is not sent again
+func TestResumeSkipsDeliveredEntry(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenQueue(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := queue.Enqueue("sent", "", queueTestRequest("sent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stopped after the send succeeded but before the entry was removed
+	queue.attemptStarted(id)
+	queue.attemptFinished(context.Background(), id, nil)
+
+	resumed, err := OpenQueue(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := spooledEntries(context.Background(), resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &scriptedSender{}
+	resumeQueue(context.Background(), context.Background(), resumed, entries, nil, sender, queueTestConfig())
+	if sender.calls != 0 {
+		t.Errorf("delivered entry was sent %d more times, want none", sender.calls)
+	}
+	if left, err := resumed.Pending(context.Background()); err != nil || len(left) != 0 {
+		t.Errorf("queue holds %d entries (%v), want the delivered one removed", len(left), err)
+	}
+}
+
+// TestResumeLeavesLiveEntries checks that resuming only sends what was spooled when the entries were read,
+// so an email accepted by the running process afterwards is left to the request that spooled it
+func TestResumeLeavesLiveEntries(t *testing.T) {
+	activeRequests = inflight{}
+	t.Cleanup(func() { activeRequests = inflight{} })
+
+	queue, err := OpenQueue(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue("left over", "", queueTestRequest("left over")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := spooledEntries(context.Background(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue("live", "", queueTestRequest("live")); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &scriptedSender{}
+	resumeQueue(context.Background(), context.Background(), queue, entries, nil, sender, queueTestConfig())
+	if delivered := sender.deliveredCopy(); len(delivered) != 1 || delivered["left over"] != 1 {
+		t.Errorf("resume delivered %v, want only the left over entry", delivered)
+	}
+}
+
+// TestResumeQueueAfterDrainStarted checks that resuming the queue starts no delivery once drain has begun,
+// even before the resume context is cancelled, so no send can outlive the drain
+func TestResumeQueueAfterDrainStarted(t *testing.T) {
+	activeRequests = inflight{}
+	t.Cleanup(func() { activeRequests = inflight{} })
+
+	queue, err := OpenQueue(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue("late", "", queueTestRequest("late")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := spooledEntries(context.Background(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeRequests.startDrain()
+	sender := &scriptedSender{}
+	resumeQueue(context.Background(), context.Background(), queue, entries, nil, sender, queueTestConfig())
+	if sender.calls != 0 || activeRequests.count() != 0 {
+		t.Errorf("resume after drain started made %d sends and left %d requests registered, want none", sender.calls, activeRequests.count())
+	}
+	if entries, err := queue.Pending(context.Background()); err != nil || len(entries) != 1 {
+		t.Errorf("queue holds %d entries (%v), want the entry kept", len(entries), err)
+	}
+}
+
+// TestSchedulerAfterDrainStarted checks that the scheduler sends no due entry once drain has begun
+func TestSchedulerAfterDrainStarted(t *testing.T) {
+	activeRequests = inflight{}
+	t.Cleanup(func() { activeRequests = inflight{} })
+
+	queue, err := OpenQueue(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := queueTestRequest("due")
+	sendAt := time.Now().Add(-time.Minute)
+	req.SendAt = &sendAt
+	id, err := queue.Enqueue("due", "", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.schedule(QueueEntry{ID: id, RequestID: "due", Request: req})
+
+	activeRequests.startDrain()
+	sender := &scriptedSender{}
+	stopped := make(chan struct{})
+	go func() {
+		queue.runScheduler(context.Background(), context.Background(), nil, sender, queueTestConfig())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler kept running after drain started")
+	}
+	if sender.calls != 0 || activeRequests.count() != 0 {
+		t.Errorf("scheduler made %d sends and left %d requests registered after drain started, want none", sender.calls, activeRequests.count())
+	}
+}
+
+// scriptedSender answers each send through reply, by subject, and counts the emails it accepted.
+// Without reply every send succeeds.
+type scriptedSender struct {
+	reply func(ctx context.Context, subject string) error
+
+	mu        sync.Mutex
+	calls     int
+	delivered map[string]int
+}
+
+// Send records the attempt and answers it as scripted
+func (s *scriptedSender) Send(ctx context.Context, e *email.Email) error {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+
+	var err error
+	if s.reply != nil {
+		err = s.reply(ctx, e.Subject)
+	}
+	if err == nil {
+		s.mu.Lock()
+		if s.delivered == nil {
+			s.delivered = make(map[string]int)
+		}
+		s.delivered[e.Subject]++
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// deliveredCopy returns the number of times each subject was delivered so far
+func (s *scriptedSender) deliveredCopy() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivered := make(map[string]int)
+	for subject, count := range s.delivered {
+		delivered[subject] = count
+	}
+	return delivered
+}
+
+// queueTestConfig returns a configuration that retries three times an hour apart, so a retry only happens
+// when a test asks for it
+func queueTestConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.SMTP.FromAddr = "relay@example.com"
+	cfg.Server.MaxRetries = 3
+	cfg.Server.RetryDelay = time.Hour
+	cfg.Server.Timeout = 24 * time.Hour
+	return cfg
+}
+
+// queueTestRequest returns a plain email request to a fixed recipient, told apart from others by its subject
+func queueTestRequest(subject string) protocol.EmailRequest {
+	return protocol.EmailRequest{Recipient: "rcpt@example.com", Subject: subject, Body: []byte("body")}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+// scheduled reports whether a request asks to be sent later than now
+func scheduled(entry QueueEntry, now time.Time) bool {
+	return sendTime(entry.Request).After(now)
+}
+
+// sendTime returns the time a request asks to be sent at, or the zero time when it asks for none
+func sendTime(req protocol.EmailRequest) time.Time {
+	if req.SendAt == nil {
+		return time.Time{}
+	}
+	return *req.SendAt
+}
+
+// schedule hands a spooled entry whose SendAt lies in the future to the scheduler
+func (q *Queue) schedule(entry QueueEntry) {
+	q.mu.Lock()
+	i, _ := slices.BinarySearchFunc(q.scheduled, entry, func(a, b QueueEntry) int {
+		return sendTime(a.Request).Compare(sendTime(b.Request))
+	})
+	q.scheduled = slices.Insert(q.scheduled, i, entry)
+	q.mu.Unlock()
+
+	// Wake the scheduler so it can pick up an entry due earlier than the one it is waiting for
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextDue removes and returns the scheduled entries due at now, and the time the next one is due
+// (zero when none are left)
+func (q *Queue) nextDue(now time.Time) ([]QueueEntry, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for n < len(q.scheduled) && !scheduled(q.scheduled[n], now) {
+		n++
+	}
+	due := slices.Clone(q.scheduled[:n])
+	q.scheduled = slices.Delete(q.scheduled, 0, n)
+	if len(q.scheduled) == 0 {
+		return due, time.Time{}
+	}
+	return due, sendTime(q.scheduled[0].Request)
+}
+
+// runScheduler sends scheduled entries once their SendAt time has come, sleeping until the next one is due.
+// Entries are sent one at a time under sendCtx and registered with activeRequests so shutdown can drain them;
+// the scheduler stops when ctx is cancelled or drain begins, and entries not yet sent stay spooled for the next start.
+func (q *Queue) runScheduler(ctx, sendCtx context.Context, dead *DeadLetters, sender Sender, cfg *config.Config) {
+	// Timers drop pending fires on Stop and Reset (Go 1.23), so this one is reused without draining
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		due, next := q.nextDue(time.Now())
+		for _, entry := range due {
+			if ctx.Err() != nil || !activeRequests.tryAdd() {
+				return
+			}
+			logger.Info(ctx, "Sending scheduled email", "request_id", entry.RequestID, "queue_id", entry.ID, "send_at", sendTime(entry.Request))
+			deliverQueued(withClientAddr(withRequestID(sendCtx, entry.RequestID), entry.ClientAddr), q, dead, entry.ID, entry.Request, sender, cfg)
+			activeRequests.done()
+		}
+		if len(due) > 0 {
+			// Sending took time, so entries may have become due meanwhile
+			continue
+		}
+
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			wait = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-wait:
+		}
+		timer.Stop()
+	}
+}
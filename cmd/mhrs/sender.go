@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+
+	"github.com/jordan-wright/email"
+)
+
+// Sender delivers a fully built email. processEmail only depends on this interface,
+// so delivery can be replaced without a real SMTP server.
+type Sender interface {
+	Send(ctx context.Context, e *email.Email) error
+}
+
+// SMTPSender delivers emails to the configured SMTP servers, reusing pooled sessions when enabled.
+// Each attempt tries the [smtp] server first and then the failover backends in their configured order.
+type SMTPSender struct {
+	cfg    *config.Config
+	dryRun bool
+
+	dkim dkimSigner
+
+	mu    sync.Mutex
+	pools map[string]*smtpPool // Idle sessions per backend name
+}
+
+// NewSMTPSender returns a sender that reads the current SMTP settings from cfg on every send.
+// In dry-run mode the SMTP handshake, authentication and envelope are exercised but no message is sent.
+func NewSMTPSender(cfg *config.Config, dryRun bool) *SMTPSender {
+	return &SMTPSender{cfg: cfg, dryRun: dryRun, pools: make(map[string]*smtpPool)}
+}
+
+// Send performs a single delivery attempt, failing over through the configured backends until one accepts the email
+func (s *SMTPSender) Send(ctx context.Context, e *email.Email) error {
+	logger.Debug(ctx, "Preparing to send email",
+		"request_id", requestID(ctx),
+		"to", e.To,
+		"cc", e.Cc,
+		"bcc_count", len(e.Bcc),
+		"from", e.From,
+		"subject", e.Subject)
+
+	// Render the message once, so every backend receives the same bytes the DKIM signature covers
+	msg, err := e.Bytes()
+	if err != nil {
+		return fmt.Errorf("failed to build message: %w", err)
+	}
+	msg = foldHeaders(msg)
+	if msg, err = s.dkim.sign(msg, s.cfg); err != nil {
+		return fmt.Errorf("DKIM signing failed: %w", err)
+	}
+
+	chain := s.cfg.SMTPChain()
+	var errs []error
+	for _, backend := range chain {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+
+		logger.Debug(ctx, "Initiating SMTP connection",
+			"request_id", requestID(ctx),
+			"backend", backend.Name,
+			"host", backend.SMTP.Host,
+			"port", backend.SMTP.Port,
+			"encryption", backend.SMTP.Encryption,
+			"pooled", backend.SMTP.PoolSize > 0)
+
+		start := time.Now()
+		err := s.deliver(ctx, e, msg, backend)
+		sendLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			backendFailures.Inc(backend.Name)
+			logger.Error(ctx, "Failed to send email",
+				"request_id", requestID(ctx),
+				"error", err.Error(),
+				"backend", backend.Name,
+				"host", backend.SMTP.Host,
+				"port", backend.SMTP.Port,
+				"recipient", e.To)
+			if len(chain) > 1 {
+				err = fmt.Errorf("%s: %w", backend.Name, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		if s.dryRun {
+			logger.Info(ctx, "Dry run: SMTP server accepted sender and recipients, message not sent",
+				"request_id", requestID(ctx),
+				"backend", backend.Name,
+				"from", e.From,
+				"to", e.To,
+				"cc", e.Cc,
+				"bcc_count", len(e.Bcc),
+				"subject", e.Subject,
+				"attachment_count", len(e.Attachments))
+			return nil
+		}
+
+		logger.Debug(ctx, "Email sent successfully",
+			"request_id", requestID(ctx),
+			"backend", backend.Name,
+			"recipient", e.To,
+			"subject", e.Subject)
+		if len(errs) > 0 {
+			logger.Warn(ctx, "Email delivered by failover backend",
+				"request_id", requestID(ctx),
+				"backend", backend.Name,
+				"failed_backends", len(errs))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("failed to send email: %w", errors.Join(errs...))
+}
+
+// Close ends all idle pooled sessions
+func (s *SMTPSender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pool := range s.pools {
+		pool.closeAll()
+	}
+}
+
+// pool returns the session pool of the named backend, creating it on first use
+func (s *SMTPSender) pool(name string) *smtpPool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pool, ok := s.pools[name]
+	if !ok {
+		pool = &smtpPool{}
+		s.pools[name] = pool
+	}
+	return pool
+}
+
+// deliver sends msg, the rendered form of e, over a pooled SMTP session to backend, or over a one-shot connection when pooling is disabled.
+// A pooled session that fails with a connection error before DATA is replaced by a fresh connection and the send is
+// repeated once, since the server may have dropped it after the liveness check. Once DATA was issued the server may
+// already hold the message, so the error is returned instead of sending it again at once.
+func (s *SMTPSender) deliver(ctx context.Context, e *email.Email, msg []byte, backend config.SMTPBackend) error {
+	smtpCfg := backend.SMTP
+	if smtpCfg.PoolSize <= 0 {
+		session, err := dialSMTP(ctx, smtpCfg)
+		if err != nil {
+			return err
+		}
+		defer session.quit()
+		return session.send(ctx, e, msg, s.dryRun)
+	}
+
+	pool := s.pool(backend.Name)
+	session, reused, err := pool.get(ctx, smtpCfg)
+	if err != nil {
+		return err
+	}
+
+	err = session.send(ctx, e, msg, s.dryRun)
+	if err != nil && reused && !isSMTPReply(err) && !session.dataSent {
+		logger.Debug(ctx, "Pooled SMTP session failed, reconnecting", "request_id", requestID(ctx), "backend", backend.Name, "error", err.Error())
+		session.close()
+		if session, err = dialSMTP(ctx, smtpCfg); err != nil {
+			return err
+		}
+		err = session.send(ctx, e, msg, s.dryRun)
+	}
+
+	switch {
+	case err == nil:
+		pool.put(session, smtpCfg.PoolSize)
+	case isSMTPReply(err) && session.client.Reset() == nil:
+		pool.put(session, smtpCfg.PoolSize)
+	default:
+		session.close()
+	}
+	return err
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+
+	"github.com/jordan-wright/email"
+)
+
+// smtpDialTimeout bounds connection establishment when the request context has no earlier deadline
+const smtpDialTimeout = 30 * time.Second
+
+// smtpSession is an established, authenticated SMTP session that can deliver several messages in turn
+type smtpSession struct {
+	conn     net.Conn
+	client   *smtp.Client
+	key      string      // Identifies the SMTP settings the session was opened with
+	lastUsed time.Time   // Time the session was last returned to the pool
+	trace    *smtpTracer // Conversation logger, nil unless smtp.trace is set
+	dataSent bool        // DATA was issued in the last transaction, so the server may hold the message even if it failed
+}
+
+// smtpSessionKey identifies the settings that make a session unusable for another configuration
+func smtpSessionKey(smtpCfg *config.SMTPConfig) string {
+	return smtpCfg.Host + "|" + smtpCfg.Port + "|" + smtpCfg.Proxy + "|" + smtpCfg.HeloHost + "|" + smtpCfg.Encryption + "|" + smtpCfg.AuthMethod + "|" + smtpCfg.AuthUser
+}
+
+// machineHostname is the host name EHLO falls back to without smtp.helo_host, or "localhost" when it is unknown
+var machineHostname = sync.OnceValue(func() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
+})
+
+// heloName returns the name the client announces in EHLO and HELO: smtp.helo_host, or else the machine's host name
+func heloName(smtpCfg *config.SMTPConfig) string {
+	if smtpCfg.HeloHost != "" {
+		return smtpCfg.HeloHost
+	}
+	return machineHostname()
+}
+
+// smtpTLSConfig builds the TLS settings for connections to the SMTP server from the configured minimum version
+// and cipher suites, including the client certificate when mutual TLS is configured.
+// Cipher suites only restrict TLS 1.2 and earlier; TLS 1.3 suites are not configurable.
+func smtpTLSConfig(smtpCfg *config.SMTPConfig) (*tls.Config, error) {
+	minVersion, err := config.TLSVersion(smtpCfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := config.TLSCipherSuites(smtpCfg.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         smtpCfg.Host,
+		MinVersion:         minVersion,
+		CipherSuites:       cipherSuites,
+		InsecureSkipVerify: smtpCfg.InsecureSkipVerify,
+	}
+
+	if smtpCfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(smtpCfg.ClientCertFile, smtpCfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SMTP client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// abortOnCancel makes blocked reads and writes on conn fail as soon as ctx is cancelled, since net/smtp has no
+// context support of its own. The returned function stops watching ctx and must be called once the exchange is over.
+func abortOnCancel(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// contextError reports ctx's error in place of err when the exchange failed because ctx ended,
+// so callers see a cancellation or timeout rather than an I/O error on the aborted connection
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("SMTP exchange aborted: %w (%v)", ctx.Err(), err)
+	}
+	return err
+}
+
+// dialSMTP connects to the configured SMTP server, negotiates the configured encryption and authenticates.
+// STARTTLS is required when selected; the session is never silently downgraded to plaintext.
+func dialSMTP(ctx context.Context, smtpCfg *config.SMTPConfig) (*smtpSession, error) {
+	addr := net.JoinHostPort(smtpCfg.Host, smtpCfg.Port)
+	tlsConfig, err := smtpTLSConfig(smtpCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	var conn net.Conn
+	if smtpCfg.Proxy != "" {
+		conn, err = dialProxy(ctx, dialer, smtpCfg.Proxy, addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := abortOnCancel(ctx, conn)
+	defer stop()
+
+	s, err := openSession(ctx, conn, smtpCfg, tlsConfig)
+	return s, contextError(ctx, err)
+}
+
+// openSession runs the greeting, encryption and authentication steps of dialSMTP on an established connection.
+// The connection is closed when any step fails.
+func openSession(ctx context.Context, conn net.Conn, smtpCfg *config.SMTPConfig, tlsConfig *tls.Config) (*smtpSession, error) {
+	if smtpCfg.Encryption == encryptionTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// net/smtp only treats the session as encrypted, and only then allows PLAIN and LOGIN authentication, when it
+	// is handed the *tls.Conn itself. Implicit TLS sessions are therefore traced above the client's text layer.
+	var trace *smtpTracer
+	if smtpCfg.Trace {
+		trace = newSMTPTracer(ctx)
+		if smtpCfg.Encryption != encryptionTLS {
+			conn = &tracedConn{Conn: conn, trace: trace}
+		}
+	}
+
+	client, err := smtp.NewClient(conn, smtpCfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &smtpSession{conn: conn, client: client, key: smtpSessionKey(smtpCfg), trace: trace}
+
+	// NewClient has already read the greeting, so that line is not traced
+	if trace != nil && smtpCfg.Encryption == encryptionTLS {
+		client.Text = textproto.NewConn(&tracedText{text: client.Text, trace: trace})
+		trace.note("[TLS established, greeting received]")
+	}
+
+	if err := client.Hello(heloName(smtpCfg)); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	if smtpCfg.Encryption == encryptionStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			s.close()
+			return nil, errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			s.close()
+			return nil, err
+		}
+		// The client now talks through a TLS connection layered on the traced one, so tracing moves above it.
+		// StartTLS has already repeated EHLO by then, so that exchange is not traced.
+		if trace != nil {
+			client.Text = textproto.NewConn(&tracedText{text: client.Text, trace: trace})
+			trace.note("[TLS established, EHLO repeated]")
+		}
+	}
+
+	// Plaintext relays never receive credentials; config validation rejects auth with encryption "none"
+	if smtpCfg.Encryption != encryptionNone {
+		ok, mechanisms := client.Extension("AUTH")
+		if !ok {
+			s.close()
+			return nil, errors.New("SMTP server does not support authentication")
+		}
+		method, err := selectAuthMethod(smtpCfg.AuthMethod, mechanisms)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		auth, err := buildAuth(ctx, smtpCfg, method)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		if err := client.Auth(auth); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// send runs a single mail transaction delivering msg to the sender and recipients of e.
+// On success the session is ready for the next message.
+// With dryRun set the sender and recipients are submitted but the transaction is reset instead of sending DATA.
+func (s *smtpSession) send(ctx context.Context, e *email.Email, msg []byte, dryRun bool) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	} else {
+		s.conn.SetDeadline(time.Time{})
+	}
+	stop := abortOnCancel(ctx, s.conn)
+	defer stop()
+	if s.trace != nil {
+		s.trace.setContext(ctx)
+	}
+
+	return contextError(ctx, s.transaction(ctx, e, msg, dryRun))
+}
+
+// transaction issues MAIL, RCPT and DATA for a single message on the session.
+// The reply accepting the message is noted in the request's attempt history, when it asked for one.
+func (s *smtpSession) transaction(ctx context.Context, e *email.Email, msg []byte, dryRun bool) error {
+	s.dataSent = false
+
+	// The envelope sender receives bounces; it is the From address unless the request set its own
+	envelope := e.From
+	if e.Sender != "" {
+		envelope = e.Sender
+	}
+	from, err := mail.ParseAddress(envelope)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+
+	if err := s.client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, list := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, rcpt := range list {
+			addr, err := mail.ParseAddress(rcpt)
+			if err != nil {
+				return fmt.Errorf("invalid recipient address: %w", err)
+			}
+			if err := s.client.Rcpt(addr.Address); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dryRun {
+		return s.client.Reset()
+	}
+
+	// DATA is run on the text connection directly, since the writer net/smtp returns discards the final reply
+	s.dataSent = true
+	id, err := s.client.Text.Cmd("DATA")
+	if err != nil {
+		return err
+	}
+	s.client.Text.StartResponse(id)
+	_, _, err = s.client.Text.ReadResponse(354)
+	s.client.Text.EndResponse(id)
+	if err != nil {
+		return err
+	}
+
+	w := s.client.Text.DotWriter()
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	code, reply, err := s.client.Text.ReadResponse(250)
+	if err != nil {
+		return err
+	}
+	attemptHistoryFrom(ctx).accepted(code, reply)
+	return nil
+}
+
+// quit ends the session politely and closes the connection
+func (s *smtpSession) quit() {
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	s.client.Quit()
+	s.conn.Close()
+}
+
+// close drops the connection without a QUIT exchange
+func (s *smtpSession) close() {
+	s.conn.Close()
+}
+
+// isSMTPReply reports whether err is a reply from the server rather than a connection failure,
+// in which case the session is still usable after a RSET
+func isSMTPReply(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr)
+}
+
+// greylistPattern finds a retry interval suggested in a greylisting reply, e.g. "try again in 300 seconds" or "5 min"
+var greylistPattern = regexp.MustCompile(`(?i)\b(\d+)\s*(seconds?|secs?|s|minutes?|mins?|m|hours?|h)\b`)
+
+// greylistDelay reports whether err contains a 450, 451 or 452 reply, which receiving servers use for greylisting,
+// and returns the retry interval the reply suggests, or 0 when it names none
+func greylistDelay(err error) (time.Duration, bool) {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code < 450 || tpErr.Code > 452 {
+		return 0, false
+	}
+
+	match := greylistPattern.FindStringSubmatch(tpErr.Msg)
+	if match == nil {
+		return 0, true
+	}
+	n, convErr := strconv.Atoi(match[1])
+	if convErr != nil {
+		return 0, true
+	}
+	unit := time.Second
+	switch strings.ToLower(match[2])[0] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	}
+	return time.Duration(n) * unit, true
+}
+
+// isPermanentSMTPError reports whether err is a permanent (5xx) rejection that retrying cannot fix.
+// Connection failures and 4xx replies are transient. For a failover attempt joining the errors of several
+// backends, the failure is only permanent when every backend rejected the message permanently.
+func isPermanentSMTPError(err error) bool {
+	switch e := err.(type) {
+	case *textproto.Error:
+		return e.Code >= 500 && e.Code < 600
+	case interface{ Unwrap() []error }:
+		errs := e.Unwrap()
+		for _, err := range errs {
+			if !isPermanentSMTPError(err) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	case interface{ Unwrap() error }:
+		return isPermanentSMTPError(e.Unwrap())
+	default:
+		return false
+	}
+}
+
+// smtpPool keeps a bounded number of idle authenticated sessions for reuse across messages.
+// Sessions idle for longer than the idle timeout, opened with different settings, or dropped by the server
+// are discarded when they are next taken from the pool.
+type smtpPool struct {
+	mu   sync.Mutex
+	idle []*smtpSession
+}
+
+// get returns a pooled session that still answers a NOOP, or dials a new one.
+// reused reports whether the session came from the pool.
+func (p *smtpPool) get(ctx context.Context, smtpCfg *config.SMTPConfig) (s *smtpSession, reused bool, err error) {
+	key := smtpSessionKey(smtpCfg)
+	for {
+		s = p.pop()
+		if s == nil {
+			s, err = dialSMTP(ctx, smtpCfg)
+			return s, false, err
+		}
+
+		if s.key != key || time.Since(s.lastUsed) > smtpCfg.PoolIdleTimeout {
+			s.quit()
+			continue
+		}
+
+		s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := s.client.Noop(); err != nil {
+			s.close()
+			continue
+		}
+		return s, true, nil
+	}
+}
+
+// put returns a healthy session to the pool, or closes it when the pool is full
+func (p *smtpPool) put(s *smtpSession, size int) {
+	s.lastUsed = time.Now()
+
+	p.mu.Lock()
+	if len(p.idle) < size {
+		p.idle = append(p.idle, s)
+		s = nil
+	}
+	p.mu.Unlock()
+
+	if s != nil {
+		s.quit()
+	}
+}
+
+// pop removes the most recently used idle session, or returns nil when the pool is empty
+func (p *smtpPool) pop() *smtpSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) == 0 {
+		return nil
+	}
+	s := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return s
+}
+
+// closeAll ends every idle session, used on shutdown
+func (p *smtpPool) closeAll() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, s := range idle {
+		s.quit()
+	}
+}
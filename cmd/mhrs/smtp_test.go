@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"mailhubrelay/internal/config"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestIsPermanentSMTPError(t *testing.T) {
+	perm := &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+	temp := &textproto.Error{Code: 451, Msg: "4.7.1 try again later"}
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"5xx reply", perm, true},
+		{"554 reply", &textproto.Error{Code: 554, Msg: "transaction failed"}, true},
+		{"4xx reply", temp, false},
+		{"452 reply", &textproto.Error{Code: 452, Msg: "insufficient storage"}, false},
+		{"wrapped 5xx", fmt.Errorf("failed to send email: %w", perm), true},
+		{"doubly wrapped 5xx", fmt.Errorf("attempt 2: %w", fmt.Errorf("send: %w", perm)), true},
+		{"wrapped 4xx", fmt.Errorf("failed to send email: %w", temp), false},
+		{"joined all permanent", errors.Join(perm, fmt.Errorf("backend secondary: %w", perm)), true},
+		{"joined permanent and transient", errors.Join(perm, temp), false},
+		{"joined permanent and network", errors.Join(perm, netErr), false},
+		{"wrapped join all permanent", fmt.Errorf("all backends failed: %w", errors.Join(perm, perm)), true},
+		{"network error", netErr, false},
+		{"wrapped network error", fmt.Errorf("failed to connect: %w", netErr), false},
+		{"eof", io.EOF, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"plain error", errors.New("550 looks permanent but is not a reply"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPermanentSMTPError(tt.err); got != tt.want {
+				t.Errorf("isPermanentSMTPError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGreylistDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		want       time.Duration
+		greylisted bool
+	}{
+		{"451 with seconds", &textproto.Error{Code: 451, Msg: "4.7.1 Greylisted, please try again in 300 seconds"}, 300 * time.Second, true},
+		{"451 with secs", &textproto.Error{Code: 451, Msg: "Greylisting in action, retry in 90 secs"}, 90 * time.Second, true},
+		{"451 with short unit", &textproto.Error{Code: 451, Msg: "4.7.1 Try again in 45s"}, 45 * time.Second, true},
+		{"450 with minutes", &textproto.Error{Code: 450, Msg: "4.2.0 Greylisted for 5 minutes"}, 5 * time.Minute, true},
+		{"450 with min", &textproto.Error{Code: 450, Msg: "4.7.1 <a@example.com>: Recipient address rejected: Greylisted, see http://example.com, come back in 2 min"}, 2 * time.Minute, true},
+		{"451 with hours", &textproto.Error{Code: 451, Msg: "Temporarily deferred, retry in 1 hour"}, time.Hour, true},
+		{"452 greylisting", &textproto.Error{Code: 452, Msg: "Greylisted, retry in 10 m"}, 10 * time.Minute, true},
+		{"450 without interval", &textproto.Error{Code: 450, Msg: "4.2.0 Greylisted, try again later"}, 0, true},
+		{"451 without interval", &textproto.Error{Code: 451, Msg: "4.7.1 Service temporarily unavailable"}, 0, true},
+		{"wrapped 451", fmt.Errorf("failed to send email: %w", &textproto.Error{Code: 451, Msg: "try again in 30 seconds"}), 30 * time.Second, true},
+		{"421 is not greylisting", &textproto.Error{Code: 421, Msg: "Service not available, try again in 60 seconds"}, 0, false},
+		{"550 is not greylisting", &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}, 0, false},
+		{"network error", errors.New("connection refused"), 0, false},
+		{"nil", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, greylisted := greylistDelay(tt.err)
+			if got != tt.want || greylisted != tt.greylisted {
+				t.Errorf("greylistDelay(%v) = %v, %v, want %v, %v", tt.err, got, greylisted, tt.want, tt.greylisted)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.GreylistDelay = time.Minute
+	cfg.Server.GreylistMaxDelay = 5 * time.Minute
+
+	tests := []struct {
+		name    string
+		err     error
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{"transient error keeps backoff", errors.New("connection reset"), 2 * time.Second, 2 * time.Second},
+		{"permanent reply keeps backoff", &textproto.Error{Code: 550, Msg: "no such user"}, 2 * time.Second, 2 * time.Second},
+		{"suggested interval", &textproto.Error{Code: 451, Msg: "Greylisted, try again in 120 seconds"}, 2 * time.Second, 2 * time.Minute},
+		{"no interval uses greylist delay", &textproto.Error{Code: 450, Msg: "4.2.0 Greylisted"}, 2 * time.Second, time.Minute},
+		{"suggested interval capped", &textproto.Error{Code: 451, Msg: "Greylisted, try again in 2 hours"}, 2 * time.Second, 5 * time.Minute},
+		{"longer backoff wins", &textproto.Error{Code: 451, Msg: "Greylisted, try again in 10 seconds"}, 30 * time.Second, 30 * time.Second},
+		{"backoff beyond cap wins", &textproto.Error{Code: 451, Msg: "Greylisted, try again in 2 hours"}, 10 * time.Minute, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryDelay(context.Background(), tt.err, tt.backoff, cfg); got != tt.want {
+				t.Errorf("retryDelay(%v, %v) = %v, want %v", tt.err, tt.backoff, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPooledSessionNotResentAfterData drops a reused pooled session after the message was sent with DATA and
+// checks that the message is not sent again on a fresh connection, since the server may already hold it
+func TestPooledSessionNotResentAfterData(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var mu sync.Mutex
+	var conns, messages int
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go func() {
+				defer conn.Close()
+				text := textproto.NewConn(conn)
+				text.PrintfLine("220 test ready")
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+					if !strings.EqualFold(line, "DATA") {
+						text.PrintfLine("250 ok")
+						continue
+					}
+					text.PrintfLine("354 go ahead")
+					if _, err := text.ReadDotBytes(); err != nil {
+						return
+					}
+					mu.Lock()
+					messages++
+					n := messages
+					mu.Unlock()
+					// The second message is taken but the connection drops before the reply
+					if n == 2 {
+						return
+					}
+					text.PrintfLine("250 queued")
+				}
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	smtpCfg := &config.SMTPConfig{Host: host, Port: port, Encryption: encryptionNone, TLSMinVersion: "1.2", PoolSize: 1, PoolIdleTimeout: time.Minute}
+	sender := NewSMTPSender(&config.Config{}, false)
+	defer sender.Close()
+
+	e := email.NewEmail()
+	e.From = "relay@example.com"
+	e.To = []string{"rcpt@example.com"}
+	backend := config.SMTPBackend{Name: "primary", SMTP: smtpCfg}
+	if err := sender.deliver(context.Background(), e, []byte("Subject: one\r\n\r\nbody\r\n"), backend); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.deliver(context.Background(), e, []byte("Subject: two\r\n\r\nbody\r\n"), backend); err == nil {
+		t.Fatal("send on the dropped session succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if messages != 2 || conns != 1 {
+		t.Errorf("server received %d messages over %d connections, want 2 over the pooled one", messages, conns)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/ratelimit"
+
+	"github.com/jordan-wright/email"
+)
+
+// errDailyLimit is returned for emails that would exceed Server.DailySendLimit. Retrying the same day cannot
+// succeed, so processEmail gives up immediately and the email is dead-lettered when that is enabled.
+var errDailyLimit = errors.New("daily send limit reached")
+
+// ThrottledSender paces outbound sends of another Sender to Server.SendRatePerMinute and enforces Server.DailySendLimit.
+// Sends over the rate wait for a token instead of failing. The daily count is kept in memory and restarts at zero
+// when MHRS restarts or the local date changes.
+type ThrottledSender struct {
+	next Sender
+	cfg  *config.Config
+
+	mu        sync.Mutex
+	bucket    *ratelimit.Bucket
+	rate      int // Settings the bucket was built with, to pick up changes on reload
+	burst     int
+	day       string
+	sentToday int
+}
+
+// NewThrottledSender wraps next with the throttling settings read from cfg on every send
+func NewThrottledSender(next Sender, cfg *config.Config) *ThrottledSender {
+	t := &ThrottledSender{next: next, cfg: cfg}
+	metricsRegistry.NewGaugeFunc("mhrs_daily_sends", "Emails sent or in flight since local midnight", func() float64 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.rollDay(time.Now())
+		return float64(t.sentToday)
+	})
+	return t
+}
+
+// Send waits for a send slot, reserves one unit of the daily limit and passes e to the wrapped sender.
+// The reservation is returned when the send fails.
+func (t *ThrottledSender) Send(ctx context.Context, e *email.Email) error {
+	if bucket := t.limiter(); bucket != nil {
+		if ok, wait := bucket.Allow(); !ok {
+			sendsThrottled.Inc()
+			logger.Debug(ctx, "Outbound rate reached, waiting for a send slot", "request_id", requestID(ctx), "wait", wait.String())
+			if err := bucket.Wait(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := t.reserve(); err != nil {
+		logger.Warn(ctx, "Daily send limit reached", "request_id", requestID(ctx), "limit", t.cfg.Server.DailySendLimit)
+		return err
+	}
+
+	err := t.next.Send(ctx, e)
+	if err != nil {
+		t.release()
+	}
+	return err
+}
+
+// limiter returns the token bucket matching the current rate settings, or nil when throttling is disabled
+func (t *ThrottledSender) limiter() *ratelimit.Bucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rate, burst := t.cfg.Server.SendRatePerMinute, t.cfg.Server.SendBurst
+	if rate <= 0 {
+		t.bucket = nil
+		return nil
+	}
+	if t.bucket == nil || t.rate != rate || t.burst != burst {
+		t.bucket = ratelimit.NewBucket(float64(rate)/60, burst)
+		t.rate, t.burst = rate, burst
+	}
+	return t.bucket
+}
+
+// reserve counts one send against today's limit, failing with errDailyLimit when it is used up
+func (t *ThrottledSender) reserve() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollDay(time.Now())
+	if limit := t.cfg.Server.DailySendLimit; limit > 0 && t.sentToday >= limit {
+		return errDailyLimit
+	}
+	t.sentToday++
+	return nil
+}
+
+// release returns a reservation taken by reserve
+func (t *ThrottledSender) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sentToday > 0 {
+		t.sentToday--
+	}
+}
+
+// rollDay resets the daily count when the local date has changed; the caller must hold t.mu
+func (t *ThrottledSender) rollDay(now time.Time) {
+	if day := now.Format(time.DateOnly); day != t.day {
+		t.day, t.sentToday = day, 0
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"mailhubrelay/internal/logger"
+)
+
+// smtpTracer logs the SMTP conversation of a session line by line at debug level when smtp.trace is set.
+// Credentials sent with AUTH or in answer to a 334 challenge are redacted, and the message content sent
+// after DATA is summarized by its size.
+type smtpTracer struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	sent      []byte // Partial client line awaiting its CRLF
+	received  []byte // Partial server line awaiting its CRLF
+	lastCmd   string // Verb of the last command sent
+	challenge bool   // The server's last reply was a 334 challenge, so the next client line is a credential
+	data      bool   // Message content is being sent
+	dataBytes int
+	tls       bool // STARTTLS succeeded, so raw connection traffic is encrypted and no longer traced
+}
+
+// newSMTPTracer returns a tracer logging under the request ID of ctx
+func newSMTPTracer(ctx context.Context) *smtpTracer {
+	return &smtpTracer{ctx: ctx}
+}
+
+// setContext switches the request the following lines are logged under, for sessions reused from the pool
+func (t *smtpTracer) setContext(ctx context.Context) {
+	t.mu.Lock()
+	t.ctx = ctx
+	t.mu.Unlock()
+}
+
+// clientWrote records bytes sent to the server
+func (t *smtpTracer) clientWrote(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.data {
+		t.dataBytes += len(p)
+		// Keep the tail only, enough to spot the terminating CRLF.CRLF
+		t.sent = append(t.sent, p...)
+		if len(t.sent) > 5 {
+			t.sent = t.sent[len(t.sent)-5:]
+		}
+		if bytes.Equal(t.sent, []byte("\r\n.\r\n")) {
+			logger.Debug(t.ctx, "SMTP trace", "request_id", requestID(t.ctx), "direction", "C", "line", "[message content]", "bytes", t.dataBytes)
+			t.data, t.dataBytes, t.sent = false, 0, nil
+		}
+		return
+	}
+
+	t.sent = append(t.sent, p...)
+	for {
+		line, rest, ok := bytes.Cut(t.sent, []byte("\r\n"))
+		if !ok {
+			return
+		}
+		t.sent = rest
+		t.logClientLine(string(line))
+	}
+}
+
+// serverWrote records bytes received from the server
+func (t *smtpTracer) serverWrote(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.received = append(t.received, p...)
+	for {
+		line, rest, ok := bytes.Cut(t.received, []byte("\r\n"))
+		if !ok {
+			return
+		}
+		t.received = rest
+		text := string(line)
+		logger.Debug(t.ctx, "SMTP trace", "request_id", requestID(t.ctx), "direction", "S", "line", text)
+
+		// Only the final line of a multi-line reply ("250 " rather than "250-") ends the reply
+		if len(text) < 4 || text[3] == '-' {
+			continue
+		}
+		code := text[:3]
+		t.challenge = code == "334"
+		switch {
+		case code == "354" && t.lastCmd == "DATA":
+			t.data, t.sent = true, nil
+		case code == "220" && t.lastCmd == "STARTTLS":
+			t.tls = true
+		}
+	}
+}
+
+// logClientLine logs one command line with credentials redacted; the caller must hold t.mu
+func (t *smtpTracer) logClientLine(line string) {
+	logged := line
+	if t.challenge {
+		logged = "[redacted]"
+		t.challenge = false
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			t.lastCmd = strings.ToUpper(fields[0])
+		}
+		if t.lastCmd == "AUTH" && len(fields) > 2 {
+			logged = fields[0] + " " + fields[1] + " [redacted]"
+		}
+	}
+	logger.Debug(t.ctx, "SMTP trace", "request_id", requestID(t.ctx), "direction", "C", "line", logged)
+}
+
+// note logs an event in the conversation that is not a protocol line
+func (t *smtpTracer) note(text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logger.Debug(t.ctx, "SMTP trace", "request_id", requestID(t.ctx), "direction", "-", "line", text)
+}
+
+// encrypted reports whether STARTTLS has completed
+func (t *smtpTracer) encrypted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tls
+}
+
+// tracedConn traces a plaintext connection until STARTTLS takes over; later traffic on it is ciphertext
+type tracedConn struct {
+	net.Conn
+	trace *smtpTracer
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.trace.encrypted() {
+		c.trace.serverWrote(p[:n])
+	}
+	return n, err
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	if !c.trace.encrypted() {
+		c.trace.clientWrote(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// tracedText traces the decrypted conversation of an SMTP client after STARTTLS by sitting on top of the
+// buffered reader and writer the client set up for the TLS connection
+type tracedText struct {
+	text  *textproto.Conn
+	trace *smtpTracer
+}
+
+func (t *tracedText) Read(p []byte) (int, error) {
+	n, err := t.text.R.Read(p)
+	if n > 0 {
+		t.trace.serverWrote(p[:n])
+	}
+	return n, err
+}
+
+func (t *tracedText) Write(p []byte) (int, error) {
+	t.trace.clientWrote(p)
+	n, err := t.text.W.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, t.text.W.Flush()
+}
+
+func (t *tracedText) Close() error {
+	return t.text.Close()
+}
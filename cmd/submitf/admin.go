@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+)
+
+const (
+	// healthCacheTTL bounds how often the health check dials MHRS
+	healthCacheTTL = 5 * time.Second
+	// healthTimeout bounds a single MHRS dial
+	healthTimeout = 5 * time.Second
+)
+
+// startAdminServers starts the optional HTTP endpoints (metrics, health, admin send).
+// Endpoints configured on the same address share a single listener.
+func startAdminServers(ctx context.Context, cfg *config.Config) {
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(addr string) *http.ServeMux {
+		if mux, ok := muxes[addr]; ok {
+			return mux
+		}
+		mux := http.NewServeMux()
+		muxes[addr] = mux
+		return mux
+	}
+
+	if cfg.Server.MetricsAddr != "" {
+		muxFor(cfg.Server.MetricsAddr).Handle("/metrics", metricsRegistry.Handler())
+	}
+
+	if cfg.Server.HealthAddr != "" {
+		muxFor(cfg.Server.HealthAddr).Handle("/healthz", &relayProbe{cfg: cfg})
+	}
+
+	if cfg.Server.AdminAddr != "" {
+		muxFor(cfg.Server.AdminAddr).Handle("/admin/send", &adminSender{ctx: ctx, cfg: cfg})
+	}
+
+	for addr, mux := range muxes {
+		go serveHTTP(ctx, addr, mux)
+	}
+}
+
+// serveHTTP runs an HTTP server on addr until the context is cancelled
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info(ctx, "Admin HTTP server started", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(ctx, "Admin HTTP server error", "error", err.Error(), "addr", addr)
+	}
+}
+
+// relayProbe checks that MHRS accepts connections and caches the result briefly
+type relayProbe struct {
+	cfg *config.Config
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+// ServeHTTP returns 200 when MHRS is reachable and 503 otherwise
+func (p *relayProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := p.check(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "mhrs unavailable: %v\n", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// check returns the cached result if it is recent enough, otherwise dials MHRS and closes the connection
+// without sending a request
+func (p *relayProbe) check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < healthCacheTTL {
+		return p.lastErr
+	}
+
+	conn, err := protocol.Dial(relayAddr(p.cfg), healthTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	p.lastErr = err
+	p.checkedAt = time.Now()
+	return p.lastErr
+}
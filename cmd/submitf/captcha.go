@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mailhubrelay/internal/config"
+)
+
+// captchaTimeout bounds a single call to the CAPTCHA provider
+const captchaTimeout = 10 * time.Second
+
+// captchaVerifyURLs maps supported providers to their verification endpoints
+var captchaVerifyURLs = map[string]string{
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+}
+
+// errCaptchaFailed is returned when the provider rejects a CAPTCHA token
+var errCaptchaFailed = errors.New("captcha verification failed")
+
+var captchaClient = &http.Client{Timeout: captchaTimeout}
+
+// captchaResponse is the verification result shared by reCAPTCHA and hCaptcha
+type captchaResponse struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"` // Only returned by reCAPTCHA v3 and hCaptcha Enterprise
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// verifyCaptcha checks a CAPTCHA token with the configured provider.
+// It always succeeds when no CAPTCHA secret is configured. A rejected token yields an error wrapping
+// errCaptchaFailed; any other error means the provider could not be asked.
+func verifyCaptcha(ctx context.Context, token, remoteIP string, cfg *config.Config) error {
+	if cfg.Server.CaptchaSecret == "" {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("%w: missing token", errCaptchaFailed)
+	}
+
+	verifyURL := cfg.Server.CaptchaVerifyURL
+	if verifyURL == "" {
+		verifyURL = captchaVerifyURLs[cfg.Server.CaptchaProvider]
+	}
+
+	form := url.Values{
+		"secret":   {cfg.Server.CaptchaSecret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("captcha provider request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha provider returned %s", resp.Status)
+	}
+
+	var result captchaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid captcha provider response: %w", err)
+	}
+
+	if !result.Success {
+		return fmt.Errorf("%w: %s", errCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	if cfg.Server.CaptchaMinScore > 0 && result.Score != nil && *result.Score < cfg.Server.CaptchaMinScore {
+		return fmt.Errorf("%w: score %.2f below minimum", errCaptchaFailed, *result.Score)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/protocol"
+)
+
+// maxFormValueBytes caps the combined size of the non-file values of a multipart body
+const maxFormValueBytes = 1 << 20
+
+var (
+	// errUnsupportedContentType is returned for bodies that are neither JSON nor an HTML form encoding
+	errUnsupportedContentType = errors.New("unsupported content type")
+	// errUploadTooLarge is returned when uploaded files exceed Server.MaxUploadBytes
+	errUploadTooLarge = errors.New("uploaded files are too large")
+)
+
+// decodeForm reads the submission from r according to its Content-Type.
+// JSON is used when no Content-Type is given; application/x-www-form-urlencoded and multipart/form-data
+// bodies are mapped onto FormData by field name (see formFromValues). Multipart file parts become Files.
+func decodeForm(r *http.Request, cfg *config.Config) (FormData, error) {
+	var form FormData
+
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return form, fmt.Errorf("%w: %v", errUnsupportedContentType, err)
+		}
+	}
+
+	switch mediaType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&form)
+		return form, err
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return form, err
+		}
+		return formFromValues(r.PostForm)
+	case "multipart/form-data":
+		return decodeMultipart(r, cfg)
+	default:
+		return form, fmt.Errorf("%w: %s", errUnsupportedContentType, mediaType)
+	}
+}
+
+// formFromValues maps HTML form values onto FormData. Inputs named after the JSON keys fill the matching field,
+// inputs named "fields[x]" and any other input become additional field x. Only the first value of a name is used.
+func formFromValues(values url.Values) (FormData, error) {
+	var form FormData
+	for name, list := range values {
+		if len(list) == 0 {
+			continue
+		}
+		value := list[0]
+		switch name {
+		case "name":
+			form.Name = value
+		case "email":
+			form.Email = value
+		case "message":
+			form.Message = value
+		case "form_id":
+			form.FormID = value
+		case "website":
+			form.Website = value
+		case "captcha_token":
+			form.CaptchaToken = value
+		case "form_rendered_at":
+			if value == "" {
+				continue
+			}
+			renderedAt, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return form, fmt.Errorf("invalid form_rendered_at: %w", err)
+			}
+			form.FormRenderedAt = renderedAt
+		default:
+			if inner, ok := strings.CutPrefix(name, "fields["); ok && strings.HasSuffix(inner, "]") {
+				name = strings.TrimSuffix(inner, "]")
+			}
+			if form.Fields == nil {
+				form.Fields = make(map[string]string)
+			}
+			form.Fields[name] = value
+		}
+	}
+	return form, nil
+}
+
+// decodeMultipart reads a multipart body part by part so uploads are never held beyond Server.MaxUploadBytes.
+// File parts must have a type listed in Server.AllowedUploadTypes and are returned as attachments in Files.
+func decodeMultipart(r *http.Request, cfg *config.Config) (FormData, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return FormData{}, err
+	}
+
+	values := make(url.Values)
+	var files []protocol.Attachment
+	valueBudget, uploadBudget := int64(maxFormValueBytes), cfg.Server.MaxUploadBytes
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return FormData{}, err
+		}
+
+		_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if _, isFile := disposition["filename"]; !isFile {
+			data, err := io.ReadAll(io.LimitReader(part, valueBudget+1))
+			if err != nil {
+				return FormData{}, err
+			}
+			valueBudget -= int64(len(data))
+			if valueBudget < 0 {
+				return FormData{}, errors.New("form values too large")
+			}
+			values.Add(part.FormName(), string(data))
+			continue
+		}
+
+		// Browsers send a part without a file name for a file input left blank
+		if part.FileName() == "" {
+			continue
+		}
+		file, err := readUpload(part, uploadBudget, cfg)
+		if err != nil {
+			return FormData{}, err
+		}
+		uploadBudget -= int64(len(file.Content))
+		files = append(files, file)
+	}
+
+	form, err := formFromValues(values)
+	form.Files = files
+	return form, err
+}
+
+// readUpload reads one file part, rejecting it when uploads are disabled, its type is not allowed
+// or it would take the submission past budget bytes
+func readUpload(part *multipart.Part, budget int64, cfg *config.Config) (protocol.Attachment, error) {
+	filename := part.FileName()
+	if cfg.Server.MaxUploadBytes == 0 {
+		return protocol.Attachment{}, &FieldError{Field: part.FormName(), Message: "file uploads are not accepted"}
+	}
+
+	contentType := uploadType(part, filename)
+	if !uploadAllowed(contentType, cfg.Server.AllowedUploadTypes) {
+		return protocol.Attachment{}, &FieldError{
+			Field:   part.FormName(),
+			Message: fmt.Sprintf("file type %s is not allowed", contentType),
+		}
+	}
+
+	content, err := io.ReadAll(io.LimitReader(part, budget+1))
+	if err != nil {
+		return protocol.Attachment{}, err
+	}
+	if int64(len(content)) > budget {
+		return protocol.Attachment{}, fmt.Errorf("%w: limit is %d bytes", errUploadTooLarge, cfg.Server.MaxUploadBytes)
+	}
+	return protocol.Attachment{Filename: filename, ContentType: contentType, Content: content}, nil
+}
+
+// uploadType returns the media type declared for a file part, falling back to the type implied by the file
+// extension when the browser sent none or only application/octet-stream
+func uploadType(part *multipart.Part, filename string) string {
+	if mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type")); err == nil && mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(filename))); err == nil {
+		return byExt
+	}
+	return "application/octet-stream"
+}
+
+// uploadAllowed reports whether contentType matches an entry of allowed, where "image/*" matches any image type
+func uploadAllowed(contentType string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if major, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(contentType, major+"/") {
+				return true
+			}
+		} else if strings.EqualFold(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupKey identifies a submission by the hash of its normalized content
+type dedupKey [sha256.Size]byte
+
+// Dedup remembers recent submissions so identical ones sent within the window, e.g. by a double-click,
+// are answered without sending another notification. Entries older than the window are discarded.
+type Dedup struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[dedupKey]time.Time
+	lastSweep time.Time
+}
+
+// NewDedup creates a cache suppressing repeats within window
+func NewDedup(window time.Duration) *Dedup {
+	return &Dedup{window: window, seen: make(map[dedupKey]time.Time), lastSweep: time.Now()}
+}
+
+// Claim records the submission and reports whether it is new. A duplicate of a submission claimed within
+// the window returns false. The claim is made before sending so concurrent duplicates are caught too.
+func (d *Dedup) Claim(key dedupKey) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) > d.window {
+		d.sweep(now)
+	}
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= d.window {
+		return false
+	}
+	d.seen[key] = now
+	return true
+}
+
+// Release forgets a claimed submission that was not sent, so the submitter can try again
+func (d *Dedup) Release(key dedupKey) {
+	d.mu.Lock()
+	delete(d.seen, key)
+	d.mu.Unlock()
+}
+
+// sweep removes entries older than the window; the caller must hold d.mu
+func (d *Dedup) sweep(now time.Time) {
+	for key, at := range d.seen {
+		if now.Sub(at) > d.window {
+			delete(d.seen, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// submissionKey hashes the content of a submission. Case and surrounding whitespace of the email and
+// runs of whitespace in text values are ignored; bot detection values are left out as they vary per request.
+func submissionKey(form FormData) dedupKey {
+	h := sha256.New()
+	write := func(value string) {
+		h.Write([]byte(strings.Join(strings.Fields(value), " ")))
+		h.Write([]byte{0})
+	}
+
+	write(form.Name)
+	write(strings.ToLower(form.Email))
+	write(form.Message)
+	write(form.FormID)
+	for _, name := range slices.Sorted(maps.Keys(form.Fields)) {
+		write(name)
+		write(form.Fields[name])
+	}
+	for _, file := range form.Files {
+		write(file.Filename)
+		h.Write(file.Content)
+		h.Write([]byte{0})
+	}
+
+	var key dedupKey
+	h.Sum(key[:0])
+	return key
+}
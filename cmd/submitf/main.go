@@ -5,88 +5,220 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"maps"
+	"math"
 	"net"
 	"net/http"
+	"net/mail"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"mailhubrelay/internal/config"
-
-	"github.com/LixenWraith/logger"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/origin"
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/ratelimit"
+	"mailhubrelay/internal/validate"
 )
 
 const appName = "submitf"
 
+// configPath is the configuration file in use, from the -config flag or config.Resolve
+var configPath string
+
 // FormData defines the expected structure of incoming form submissions
 // All fields are required and validated before processing
 type FormData struct {
 	Name    string `json:"name"`    // Sender's name
 	Email   string `json:"email"`   // Sender's email address (not From email address)
 	Message string `json:"message"` // Content of the message
+	FormID  string `json:"form_id"` // Optional form identifier used to route the notification
+
+	// Additional form fields such as phone or company, restricted by Server.FormFields when configured
+	Fields map[string]string `json:"fields"`
+
+	// Bot detection fields, only checked when enabled in configuration
+	Website        string `json:"website"`          // Hidden honeypot field that humans leave empty
+	FormRenderedAt int64  `json:"form_rendered_at"` // Unix time in milliseconds when the form was displayed
+	CaptchaToken   string `json:"captcha_token"`    // reCAPTCHA or hCaptcha response token
+
+	// Files uploaded with a multipart/form-data submission, forwarded as attachments
+	Files []protocol.Attachment `json:"-"`
+
+	// Origin of the submission, set from the request when Server.IncludeClientInfo is enabled
+	ClientIP  string `json:"-"`
+	UserAgent string `json:"-"`
 }
 
-// EmailRequest represents the format expected by MHRS
-type EmailRequest struct {
-	Recipient string `json:"recipient"`
-	Subject   string `json:"subject"`
-	Body      []byte `json:"body"`
+// Submission is the machine-readable copy of a form attached as submission.json when Server.AttachSubmissionJSON is set.
+// Bot detection fields are left out; uploaded files are listed by name since they are attached themselves.
+type Submission struct {
+	Name        string            `json:"name"`
+	Email       string            `json:"email"`
+	Message     string            `json:"message"`
+	FormID      string            `json:"form_id,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Files       []string          `json:"files,omitempty"`
+	SubmittedAt time.Time         `json:"submitted_at"`
+	ClientIP    string            `json:"client_ip,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
 }
 
+// maxUserAgentLength caps the User-Agent included in notifications
+const maxUserAgentLength = 256
+
 func main() {
+	flag.StringVar(&configPath, "config", "", "Path to the configuration file, overriding $"+config.EnvPath(appName)+" and the default search")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and body templates and exit")
+	flag.Parse()
+	configPath = config.Resolve(appName, configPath)
+
+	if *checkConfig {
+		os.Exit(runCheckConfig())
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cfg, configExists, err := config.Load(appName)
+	cfg, configExists, err := config.Load(appName, configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
 		os.Exit(1)
 	}
 	if !configExists {
-		if config.Save(cfg, appName) != nil {
+		if err := config.Save(cfg, configPath); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to save configuration: %v\n", err)
 		}
 	}
 
-	if err := logger.Init(ctx, &cfg.Logging); err != nil {
+	if err := logger.Init(ctx, &cfg.Logging, cfg.Server.LogFormat); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
 		os.Exit(1)
 	}
 	defer logger.Shutdown(ctx)
 
-	logger.Info(ctx, "Starting submitf service", "addr", cfg.Server.ExternalAddr)
+	logger.Info(ctx, "Starting submitf service", "addr", cfg.Server.ExternalAddr, "config_path", configPath)
+
+	templates, err := LoadBodyTemplates(cfg)
+	if err != nil {
+		logger.Error(ctx, "Failed to load body templates", "error", err.Error())
+		os.Exit(1)
+	}
 
 	// Handle shutdown gracefully
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Reload body templates on SIGHUP and cycle the log level on SIGUSR1
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP, syscall.SIGUSR1)
+	go func() {
+		for sig := range hupChan {
+			if sig == syscall.SIGUSR1 {
+				logger.SetLevel(ctx, logger.NextLevel())
+				continue
+			}
+			if err := templates.Reload(cfg); err != nil {
+				logger.Error(ctx, "Failed to reload body templates, keeping previous templates", "error", err.Error())
+				continue
+			}
+			logger.Info(ctx, "Body templates reloaded")
+		}
+	}()
+
+	startAdminServers(ctx, cfg)
+
+	// Patterns were validated when the configuration was loaded
+	origins, err := origin.NewMatcher(cfg.Server.AllowedOrigins)
+	if err != nil {
+		logger.Error(ctx, "Invalid allowed origins", "error", err.Error())
+		os.Exit(1)
+	}
+
+	var limiter *ratelimit.Keyed
+	if cfg.Server.RateLimitPerMinute > 0 {
+		rate := float64(cfg.Server.RateLimitPerMinute) / 60
+		// Buckets idle long enough to refill completely carry no state and can be dropped
+		idleTTL := max(time.Minute, time.Duration(float64(cfg.Server.RateLimitBurst)/rate*float64(time.Second)))
+		limiter = ratelimit.NewKeyed(rate, cfg.Server.RateLimitBurst, idleTTL)
+		logger.Info(ctx, "Per-IP rate limiting enabled",
+			"per_minute", cfg.Server.RateLimitPerMinute,
+			"burst", cfg.Server.RateLimitBurst,
+			"trust_proxy_headers", cfg.Server.TrustProxyHeaders)
+	}
+
+	// Each submitter email may send EmailRateLimit submissions at once, regaining them evenly over EmailRateWindow
+	var emailLimiter *ratelimit.Keyed
+	if cfg.Server.EmailRateLimit > 0 {
+		rate := float64(cfg.Server.EmailRateLimit) / cfg.Server.EmailRateWindow.Seconds()
+		emailLimiter = ratelimit.NewKeyed(rate, cfg.Server.EmailRateLimit, cfg.Server.EmailRateWindow)
+		logger.Info(ctx, "Per-email rate limiting enabled",
+			"email_rate_limit", cfg.Server.EmailRateLimit,
+			"email_rate_window", cfg.Server.EmailRateWindow.String())
+	}
+
+	// Denied IPs were validated when the configuration was loaded
+	spam, err := NewSpamFilter(cfg)
+	if err != nil {
+		logger.Error(ctx, "Invalid spam filter settings", "error", err.Error())
+		os.Exit(1)
+	}
+	if spam != nil {
+		logger.Info(ctx, "Spam scoring enabled",
+			"spam_threshold", cfg.Server.SpamThreshold,
+			"spam_action", cfg.Server.SpamAction,
+			"keyword_count", len(cfg.Server.SpamKeywords),
+			"denied_ip_count", len(cfg.Server.SpamDeniedIPs))
+	}
+
+	rejected := NewOriginStats()
+	if cfg.Server.OriginReportInterval > 0 {
+		go rejected.Run(ctx, cfg.Server.OriginReportInterval)
+	}
+
+	var dedup *Dedup
+	if cfg.Server.DedupWindow > 0 {
+		dedup = NewDedup(cfg.Server.DedupWindow)
+		logger.Info(ctx, "Duplicate submission suppression enabled", "dedup_window", cfg.Server.DedupWindow.String())
+	}
+
 	server := &http.Server{
 		Addr:         cfg.Server.ExternalAddr,
-		Handler:      handleSubmit(ctx, cfg),
+		Handler:      handleSubmit(ctx, cfg, origins, rejected, limiter, emailLimiter, templates, dedup, spam),
 		ReadTimeout:  cfg.Server.Timeout,
 		WriteTimeout: cfg.Server.Timeout,
 	}
 
+	// Shutdown closes the listener at once and then waits for in-flight submissions, which may be inside
+	// sendToMHRS, for up to Server.DrainTimeout before remaining connections are closed
+	drained := make(chan struct{})
 	go func() {
-		<-sigChan
-		logger.Info(ctx, "Shutdown signal received")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+		defer close(drained)
+		sig := <-sigChan
+		logger.Info(ctx, "Shutdown signal received, draining in-flight submissions",
+			"signal", sig.String(),
+			"drain_timeout", cfg.Server.DrainTimeout.String())
 
-		logger.Info(shutdownCtx, "Shutdown signal received")
-
-		if err := server.Shutdown(shutdownCtx); err != nil {
-			logger.Error(shutdownCtx, "Server shutdown error", "error", err)
-		}
-
-		if err := logger.Shutdown(shutdownCtx); err != nil {
-			fmt.Fprintf(os.Stderr, "Logger shutdown error: %v\n", err)
+		drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.DrainTimeout)
+		defer cancel()
+		if err := server.Shutdown(drainCtx); err != nil {
+			logger.Warn(ctx, "Drain timeout expired, closing remaining connections", "error", err.Error())
+			server.Close()
+			return
 		}
+		logger.Info(ctx, "In-flight submissions finished")
 	}()
 
 	logger.Info(ctx, "Server started", "addr", server.Addr)
@@ -94,28 +226,55 @@ func main() {
 		logger.Error(ctx, "Server error", "error", err)
 		os.Exit(1)
 	}
+	<-drained
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := logger.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "Logger shutdown error: %v\n", err)
+	}
+}
+
+// runCheckConfig loads and validates the configuration and body templates without starting the service.
+// Returns the process exit code: 0 when everything is valid, 1 otherwise.
+func runCheckConfig() int {
+	cfg, configExists, err := config.Load(appName, configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration\n%v\n", configPath, err)
+		return 1
+	}
+	if _, err := LoadBodyTemplates(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return 1
+	}
+	if !configExists {
+		fmt.Printf("%s: not found, default configuration is valid\n", configPath)
+		return 0
+	}
+	fmt.Printf("%s: configuration is valid\n", configPath)
+	return 0
 }
 
 // handleSubmit returns an http.HandlerFunc that processes form submissions
-// It implements CORS protection and validates form data before forwarding to MHRS
-func handleSubmit(ctx context.Context, cfg *config.Config) http.HandlerFunc {
+// It implements CORS protection, optional per-IP rate limiting, form tokens, spam scoring and duplicate suppression,
+// and validates form data before forwarding to MHRS
+func handleSubmit(ctx context.Context, cfg *config.Config, origins *origin.Matcher, rejected *OriginStats, limiter, emailLimiter *ratelimit.Keyed, templates *BodyTemplates, dedup *Dedup, spam *SpamFilter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Debug(ctx, "Handling new submission request", "method", r.Method, "remote_addr", r.RemoteAddr)
 
 		// Set CORS headers
 		origin := r.Header.Get("Origin")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.Server.CORSAllowedMethods, ", "))
+		if headers := corsAllowedHeaders(cfg); len(headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
 		// Check if origin is allowed
-		originAllowed := false
-		for _, allowed := range cfg.Server.AllowedOrigins {
-			if origin == allowed {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				originAllowed = true
-				break
-			}
+		originAllowed := origins.Allowed(origin)
+		if originAllowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
 		}
 
 		// handle preflight
@@ -123,119 +282,488 @@ func handleSubmit(ctx context.Context, cfg *config.Config) http.HandlerFunc {
 			if originAllowed {
 				w.WriteHeader(http.StatusOK)
 			} else {
+				rejected.Record(origin)
+				logger.Debug(ctx, "Preflight from invalid origin", "origin", origin)
 				w.WriteHeader(http.StatusForbidden)
 			}
 			return
 		}
 
+		submissionsReceived.Inc()
+
 		// Continue only if origin is allowed
 		if !originAllowed {
+			submissionsRejected.Inc(rejectOrigin)
+			rejected.Record(origin)
 			logger.Warn(ctx, "Invalid origin", "origin", origin)
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			writeError(w, http.StatusForbidden, "Origin not allowed")
 			return
 		}
 
 		if r.Method != http.MethodPost {
+			submissionsRejected.Inc(rejectMethod)
 			logger.Warn(ctx, "Invalid request method", "method", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		if limiter != nil {
+			ip := clientIP(r, cfg)
+			if ok, wait := limiter.Allow(ip); !ok {
+				submissionsRejected.Inc(rejectRateLimit)
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				logger.Warn(ctx, "Rate limit exceeded", "client_ip", ip, "retry_after", retryAfter)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				writeError(w, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+		}
+
+		// The token is checked before the body is read so rejected requests cost no decoding
+		if err := checkFormToken(r.Header.Get(formTokenHeader), cfg, time.Now()); err != nil {
+			submissionsRejected.Inc(rejectFormToken)
+			logger.Warn(ctx, "Form token rejected", "error", err.Error(), "remote_addr", r.RemoteAddr)
+			writeError(w, http.StatusForbidden, "Invalid form token")
 			return
 		}
 
-		var form FormData
-		if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
-			logger.Error(ctx, "Failed to decode request body", "error", err)
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		form, err := decodeForm(r, cfg)
+		if err != nil {
+			submissionsRejected.Inc(rejectBody)
+			logger.Error(ctx, "Failed to decode request body", "error", err, "content_type", r.Header.Get("Content-Type"))
+			var fieldErr *FieldError
+			switch {
+			case errors.As(err, &fieldErr):
+				writeJSON(w, http.StatusBadRequest, Response{Status: responseError, Message: fieldErr.Message, Field: fieldErr.Field})
+			case errors.Is(err, errUploadTooLarge):
+				writeError(w, http.StatusRequestEntityTooLarge, "Uploaded files are too large")
+			case errors.Is(err, errUnsupportedContentType):
+				writeError(w, http.StatusUnsupportedMediaType, "Unsupported content type")
+			default:
+				writeError(w, http.StatusBadRequest, "Invalid request body")
+			}
 			return
 		}
 
+		// Line breaks in single-line values could otherwise spoof body lines or headers and split log lines
+		form = sanitizeForm(form)
+
 		logger.Debug(ctx, "Received form submission",
 			"name", form.Name,
 			"email", form.Email,
-			"message_length", len(form.Message))
+			"message_length", len(form.Message),
+			"file_count", len(form.Files))
+
+		// Bots are answered as if the submission succeeded so they get no signal to adapt
+		if reason := detectBot(form, cfg, time.Now()); reason != "" {
+			submissionsRejected.Inc(rejectBot)
+			logger.Warn(ctx, "Submission discarded as automated",
+				"reason", reason,
+				"remote_addr", r.RemoteAddr)
+			writeJSON(w, http.StatusOK, Response{Status: responseSuccess})
+			return
+		}
 
-		if err := validateForm(form); err != nil {
+		form.Fields = filterFields(ctx, form.Fields, cfg)
+		if cfg.Server.IncludeClientInfo {
+			form.ClientIP = clientIP(r, cfg)
+			form.UserAgent = sanitizeUserAgent(r.UserAgent())
+		}
+		if err := validateForm(form, cfg); err != nil {
+			submissionsRejected.Inc(rejectValidation)
 			logger.Error(ctx, "Form validation failed", "error", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			resp := Response{Status: responseError, Message: err.Error()}
+			var fieldErr *FieldError
+			if errors.As(err, &fieldErr) {
+				resp.Field = fieldErr.Field
+			}
+			writeJSON(w, http.StatusBadRequest, resp)
 			return
 		}
 
-		if err := sendToMHRS(ctx, form, cfg); err != nil {
-			logger.Error(ctx, "Failed to send to MHRS", "error", err)
-			http.Error(w, "Failed to process submission", http.StatusInternalServerError)
+		if spam != nil {
+			ip := clientIP(r, cfg)
+			if score, reasons, isSpam := spam.Score(form, ip); isSpam {
+				submissionsRejected.Inc(rejectSpam)
+				logger.Warn(ctx, "Submission scored as spam",
+					"score", score,
+					"reasons", strings.Join(reasons, ", "),
+					"action", cfg.Server.SpamAction,
+					"client_ip", ip)
+				// Dropped spam gets the normal success response, like bots, so it gets no signal to adapt
+				if cfg.Server.SpamAction == "drop" {
+					writeJSON(w, http.StatusOK, Response{Status: responseSuccess})
+				} else {
+					writeError(w, http.StatusBadRequest, "Submission rejected as spam")
+				}
+				return
+			}
+		}
+
+		// Attackers rotating IPs often reuse the same made-up address, so submissions are also limited per email
+		if emailLimiter != nil {
+			if ok, wait := emailLimiter.Allow(normalizedEmail(form.Email)); !ok {
+				submissionsRejected.Inc(rejectEmailRate)
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				logger.Warn(ctx, "Email rate limit exceeded", "email", form.Email, "remote_addr", r.RemoteAddr, "retry_after", retryAfter)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				writeError(w, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+		}
+
+		// Repeats are answered as if sent so a double-clicked form still reports success
+		var key dedupKey
+		if dedup != nil {
+			key = submissionKey(form)
+			if !dedup.Claim(key) {
+				submissionsRejected.Inc(rejectDuplicate)
+				logger.Info(ctx, "Duplicate submission suppressed", "email", form.Email, "remote_addr", r.RemoteAddr)
+				writeJSON(w, http.StatusOK, Response{Status: responseSuccess})
+				return
+			}
+		}
+
+		if err := verifyCaptcha(r.Context(), form.CaptchaToken, clientIP(r, cfg), cfg); err != nil {
+			if dedup != nil {
+				dedup.Release(key)
+			}
+			submissionsRejected.Inc(rejectCaptcha)
+			if errors.Is(err, errCaptchaFailed) {
+				logger.Warn(ctx, "Captcha rejected", "error", err.Error(), "remote_addr", r.RemoteAddr)
+				writeJSON(w, http.StatusBadRequest, Response{
+					Status:  responseError,
+					Message: "captcha verification failed",
+					Field:   "captcha_token",
+				})
+				return
+			}
+			logger.Error(ctx, "Captcha verification unavailable", "error", err.Error())
+			writeError(w, http.StatusServiceUnavailable, "Captcha verification unavailable")
 			return
 		}
 
+		// Forwarding, auto-reply included, ends before the write timeout so the submitter always gets an answer
+		relayCtx, cancel := context.WithTimeout(r.Context(), cfg.Server.RelayTimeout)
+		defer cancel()
+		if err := sendToMHRS(relayCtx, form, templates, cfg); err != nil {
+			if dedup != nil {
+				dedup.Release(key)
+			}
+			relayFailures.Inc()
+			logger.Error(ctx, "Failed to send to MHRS", "error", err.Error())
+			writeError(w, http.StatusInternalServerError, "Failed to process submission")
+			return
+		}
+
+		submissionsForwarded.Inc()
+
+		// The submission is already forwarded, so a failed confirmation is only logged
+		if err := sendAutoReply(relayCtx, form, templates, cfg); err != nil {
+			logger.Error(ctx, "Failed to send auto-reply", "error", err.Error(), "email", form.Email)
+		}
 		logger.Info(ctx, "Form submission processed successfully",
 			"name", form.Name,
 			"email", form.Email)
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+		writeJSON(w, http.StatusOK, Response{Status: responseSuccess})
+	}
+}
+
+// corsAllowedHeaders returns Server.CORSAllowedHeaders, plus the form token header when form tokens are enabled
+func corsAllowedHeaders(cfg *config.Config) []string {
+	headers := cfg.Server.CORSAllowedHeaders
+	if cfg.Server.FormTokenMode != "" && !slices.ContainsFunc(headers, func(h string) bool { return strings.EqualFold(h, formTokenHeader) }) {
+		headers = append(slices.Clip(headers), formTokenHeader)
+	}
+	return headers
+}
+
+// clientIP returns the address of the submitting client.
+// When Server.TrustProxyHeaders is set the last entry of the Server.ProxyIPHeader header is used, which for
+// X-Forwarded-For is the address seen by the fronting proxy and cannot be forged by the client. Entries that are
+// not IP addresses are ignored, and the connection's remote address is used otherwise.
+func clientIP(r *http.Request, cfg *config.Config) string {
+	if cfg.Server.TrustProxyHeaders {
+		if values := r.Header.Values(cfg.Server.ProxyIPHeader); len(values) > 0 {
+			parts := strings.Split(values[len(values)-1], ",")
+			if addr, err := netip.ParseAddr(strings.TrimSpace(parts[len(parts)-1])); err == nil {
+				return addr.String()
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sanitizeUserAgent makes a User-Agent safe to include in an email or log line: control characters
+// such as line breaks become spaces, runs of whitespace are collapsed and the result is truncated
+func sanitizeUserAgent(ua string) string {
+	ua = singleLine(ua)
+	if len(ua) > maxUserAgentLength {
+		ua = strings.ToValidUTF8(ua[:maxUserAgentLength], "")
+	}
+	return ua
+}
+
+// detectBot applies the optional honeypot and minimum fill time checks.
+// Returns the reason the submission looks automated, or an empty string if it passes.
+func detectBot(form FormData, cfg *config.Config, now time.Time) string {
+	if cfg.Server.HoneypotEnabled && form.Website != "" {
+		return "honeypot field filled"
+	}
+
+	if cfg.Server.MinFillTime > 0 {
+		if form.FormRenderedAt <= 0 {
+			return "missing form render time"
+		}
+		elapsed := now.Sub(time.UnixMilli(form.FormRenderedAt))
+		if elapsed < cfg.Server.MinFillTime {
+			return "form filled too quickly"
+		}
 	}
+
+	return ""
 }
 
 // validateForm performs basic validation of form submission data
 // Returns error if any required field is missing or invalid
-func validateForm(form FormData) error {
+func validateForm(form FormData, cfg *config.Config) error {
 	if strings.TrimSpace(form.Name) == "" {
-		return errors.New("name is required")
+		return &FieldError{Field: "name", Message: "name is required"}
 	}
-	if !strings.Contains(form.Email, "@") {
-		return errors.New("invalid email address")
+	if err := validate.Address(form.Email); err != nil {
+		return &FieldError{Field: "email", Message: "invalid email address"}
 	}
 	if strings.TrimSpace(form.Message) == "" {
-		return errors.New("message is required")
+		return &FieldError{Field: "message", Message: "message is required"}
+	}
+	for _, name := range cfg.Server.RequiredFormFields {
+		if strings.TrimSpace(form.Fields[name]) == "" {
+			return &FieldError{Field: name, Message: name + " is required"}
+		}
 	}
 	return nil
 }
 
+// filterFields drops additional fields not listed in Server.FormFields.
+// All fields are kept when no list is configured.
+func filterFields(ctx context.Context, fields map[string]string, cfg *config.Config) map[string]string {
+	if len(cfg.Server.FormFields) == 0 {
+		return fields
+	}
+
+	kept := make(map[string]string, len(fields))
+	for name, value := range fields {
+		if slices.Contains(cfg.Server.FormFields, name) {
+			kept[name] = value
+		} else {
+			logger.Debug(ctx, "Ignoring unexpected form field", "field", name)
+		}
+	}
+	return kept
+}
+
+// formSubject builds the default notification subject, appending the Server.SubjectField value when the form supplies one
+func formSubject(form FormData, cfg *config.Config) string {
+	subject := "Contact Form Submission from " + form.Name
+	if cfg.Server.SubjectField == "" {
+		return subject
+	}
+	// Collapse whitespace so a multi-line value cannot break the header
+	if topic := strings.Join(strings.Fields(form.Fields[cfg.Server.SubjectField]), " "); topic != "" {
+		subject += ": " + topic
+	}
+	return subject
+}
+
+// normalizedEmail returns the lower-cased address part of a submitter email, the key of the per-email rate limit
+func normalizedEmail(email string) string {
+	if addr, err := mail.ParseAddress(email); err == nil {
+		email = addr.Address
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// replyAddress formats the submitter as a Reply-To address so replies to the notification reach them.
+// An empty string is returned when the email cannot be parsed, leaving Reply-To unset.
+func replyAddress(form FormData) string {
+	addr, err := mail.ParseAddress(form.Email)
+	if err != nil {
+		return ""
+	}
+	return (&mail.Address{Name: strings.TrimSpace(form.Name), Address: addr.Address}).String()
+}
+
 // sendToMHRS forwards validated form data to MHRS over localhost TCP connection
-// Formats the email and handles the connection with configurable timeout
-func sendToMHRS(ctx context.Context, form FormData, cfg *config.Config) error {
+// Formats the notification email and hands it to forwardRequest
+func sendToMHRS(ctx context.Context, form FormData, templates *BodyTemplates, cfg *config.Config) error {
 	logger.Debug(ctx, "Preparing email request for MHRS")
 
-	emailBody := formatEmailBody(form)
-	req := EmailRequest{
-		Recipient: cfg.SMTP.FromAddr,
-		Subject:   "Contact Form Submission from " + form.Name,
-		Body:      []byte(emailBody),
+	now := time.Now()
+	emailBody, htmlBody, err := templates.Render(form, now)
+	if err != nil {
+		return err
 	}
-
-	jsonData, err := json.Marshal(req)
+	subject, err := templates.Subject(form, now, cfg)
 	if err != nil {
 		return err
 	}
 
-	logger.Debug(ctx, "Connecting to MHRS", "size", len(jsonData))
+	attachments := form.Files
+	if cfg.Server.AttachSubmissionJSON {
+		attachment, err := submissionAttachment(form, now)
+		if err != nil {
+			return err
+		}
+		attachments = append(slices.Clip(attachments), attachment)
+	}
+
+	req := protocol.EmailRequest{
+		Recipient:   formRecipient(ctx, form, cfg),
+		ReplyTo:     replyAddress(form),
+		Subject:     subject,
+		Body:        []byte(emailBody),
+		HTMLBody:    htmlBody,
+		Attachments: attachments,
+		AuthToken:   cfg.Server.ClientToken,
+	}
+	return forwardRequest(ctx, req, cfg)
+}
+
+// submissionAttachment encodes the sanitized form as the submission.json attachment
+func submissionAttachment(form FormData, now time.Time) (protocol.Attachment, error) {
+	submission := Submission{
+		Name:        form.Name,
+		Email:       form.Email,
+		Message:     form.Message,
+		FormID:      form.FormID,
+		Fields:      form.Fields,
+		SubmittedAt: now.UTC(),
+		ClientIP:    form.ClientIP,
+		UserAgent:   form.UserAgent,
+	}
+	for _, file := range form.Files {
+		submission.Files = append(submission.Files, file.Filename)
+	}
 
-	conn, err := net.Dial("tcp", cfg.Server.InternalAddr)
+	content, err := json.MarshalIndent(submission, "", "  ")
 	if err != nil {
-		return err
+		return protocol.Attachment{}, fmt.Errorf("failed to encode submission.json: %w", err)
 	}
-	defer conn.Close()
+	return protocol.Attachment{Filename: "submission.json", ContentType: "application/json", Content: content}, nil
+}
 
-	// Set write deadline
-	if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
-		logger.Error(ctx, "Failed to set write deadline", "error", err)
+// sendAutoReply sends the Server.AutoReplyTemplate confirmation to the submitter.
+// It does nothing when no auto-reply template is configured.
+func sendAutoReply(ctx context.Context, form FormData, templates *BodyTemplates, cfg *config.Config) error {
+	subject, body, ok, err := templates.AutoReply(form, time.Now())
+	if err != nil || !ok {
 		return err
 	}
 
-	if _, err := conn.Write(jsonData); err != nil {
-		logger.Error(ctx, "Failed to write to MHRS", "error", err)
+	addr, err := mail.ParseAddress(form.Email)
+	if err != nil {
 		return err
 	}
+	req := protocol.EmailRequest{
+		Recipient: addr.Address,
+		From:      cfg.Server.AutoReplyFrom,
+		Subject:   subject,
+		Body:      []byte(body),
+		AuthToken: cfg.Server.ClientToken,
+	}
+	return forwardRequest(ctx, req, cfg)
+}
 
-	logger.Info(ctx, "Email request sent to MHRS",
-		"recipient", req.Recipient,
-		"subject", req.Subject)
-	return nil
+// forwardRequest sends req to MHRS and waits for its acknowledgement, retrying up to Server.RelayMaxRetries times
+// while MHRS cannot be reached or answers busy. Any other acknowledgement than ok is returned as an error.
+// Every attempt carries the same idempotency key, so MHRS sends the email once even if a failed attempt reached it.
+func forwardRequest(ctx context.Context, req protocol.EmailRequest, cfg *config.Config) error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err == nil {
+		req.IdempotencyKey = "submitf-" + hex.EncodeToString(key)
+	}
+
+	// A brief MHRS restart or load spike should not lose the submission, so both are retried with backoff
+	delay := cfg.Server.RelayRetryDelay
+	for attempt := 1; ; attempt++ {
+		ack, err := exchangeWithMHRS(ctx, req, cfg)
+		if err == nil {
+			switch ack.Status {
+			case protocol.StatusOK:
+				logger.Info(ctx, "Email request sent to MHRS",
+					"recipient", req.Recipient,
+					"subject", req.Subject,
+					"mhrs_request_id", ack.RequestID)
+				return nil
+			case protocol.StatusBusy:
+				err = fmt.Errorf("MHRS busy: %s", ack.Message)
+			default:
+				return fmt.Errorf("MHRS answered %s: %s", ack.Status, ack.Message)
+			}
+		}
+		if attempt >= cfg.Server.RelayMaxRetries {
+			return fmt.Errorf("all %d attempts failed: %w", attempt, err)
+		}
+		logger.Warn(ctx, "Forwarding to MHRS failed, retrying",
+			"attempt", attempt,
+			"retry_in", delay.String(),
+			"error", err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, context.Cause(ctx))
+		}
+		delay *= 2
+	}
+}
+
+// relayAddr returns the MHRS address to dial: the TCP address, or the Unix socket when no TCP address is set
+func relayAddr(cfg *config.Config) string {
+	if cfg.Server.InternalAddr != "" {
+		return cfg.Server.InternalAddr
+	}
+	return cfg.Server.InternalSocket
+}
+
+// formRecipient selects the notification recipient for a submission.
+// A known form_id is routed through Server.FormRecipients, otherwise Server.FormRecipient is used,
+// falling back to the SMTP sender address when neither is configured.
+func formRecipient(ctx context.Context, form FormData, cfg *config.Config) string {
+	if form.FormID != "" {
+		if recipient, ok := cfg.Server.FormRecipients[form.FormID]; ok && recipient != "" {
+			return recipient
+		}
+		logger.Warn(ctx, "Unknown form id, using default recipient", "form_id", form.FormID)
+	}
+	if cfg.Server.FormRecipient != "" {
+		return cfg.Server.FormRecipient
+	}
+	return cfg.SMTP.FromAddr
 }
 
 // formatEmailBody constructs a formatted email message string from the form submission data.
 // It includes the sender's name, email address, and their message in a readable format.
+// Additional fields are listed after the email address in name order, and the client IP and User-Agent
+// follow the message when they were recorded.
 func formatEmailBody(form FormData) string {
-	return "New contact form submission:\n\n" +
-		"Name: " + form.Name + "\n" +
-		"Email: " + form.Email + "\n\n" +
-		"Message:\n" + form.Message
+	var b strings.Builder
+	b.WriteString("New contact form submission:\n\n")
+	b.WriteString("Name: " + form.Name + "\n")
+	b.WriteString("Email: " + form.Email + "\n")
+	for _, name := range slices.Sorted(maps.Keys(form.Fields)) {
+		b.WriteString(name + ": " + form.Fields[name] + "\n")
+	}
+	b.WriteString("\nMessage:\n" + form.Message)
+	if form.ClientIP != "" || form.UserAgent != "" {
+		b.WriteString("\n\n--\n")
+		b.WriteString("Client IP: " + form.ClientIP + "\n")
+		b.WriteString("User-Agent: " + form.UserAgent + "\n")
+	}
+	return b.String()
 }
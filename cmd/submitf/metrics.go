@@ -0,0 +1,30 @@
+package main
+
+import "mailhubrelay/internal/metrics"
+
+// Service metrics, always collected and exposed only when Server.MetricsAddr is set
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	submissionsReceived  = metricsRegistry.NewCounter("submitf_submissions_received_total", "Form submission requests received, excluding CORS preflight")
+	submissionsRejected  = metricsRegistry.NewCounterVec("submitf_submissions_rejected_total", "Form submissions rejected before forwarding, by reason", "reason")
+	submissionsForwarded = metricsRegistry.NewCounter("submitf_submissions_forwarded_total", "Form submissions forwarded to MHRS")
+	relayFailures        = metricsRegistry.NewCounter("submitf_relay_failures_total", "Form submissions that could not be forwarded to MHRS")
+	adminSends           = metricsRegistry.NewCounterVec("submitf_admin_sends_total", "Requests to /admin/send, by MHRS acknowledgement status or rejection reason", "status")
+	rejectedOrigins      = metricsRegistry.NewCounterVec("submitf_rejected_origins_total", "Submissions and preflight requests rejected for their origin, by origin", "origin")
+)
+
+// Rejection reasons used as the submitf_submissions_rejected_total label
+const (
+	rejectOrigin     = "origin"
+	rejectMethod     = "method"
+	rejectRateLimit  = "rate_limit"
+	rejectEmailRate  = "email_rate_limit"
+	rejectFormToken  = "form_token"
+	rejectBody       = "invalid_body"
+	rejectBot        = "bot"
+	rejectValidation = "validation"
+	rejectCaptcha    = "captcha"
+	rejectDuplicate  = "duplicate"
+	rejectSpam       = "spam"
+)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mailhubrelay/internal/logger"
+)
+
+const (
+	maxTrackedOrigins = 1000 // Distinct origins counted per report interval; further ones are counted as otherOrigin
+	maxOriginLabels   = 100  // Distinct origin label values of submitf_rejected_origins_total over the process lifetime
+	maxOriginLength   = 256  // Longer Origin headers are truncated before they are counted
+	originReportTop   = 10   // Origins listed in each report
+)
+
+// Placeholder origins used in reports and metric labels
+const (
+	noOrigin    = "(none)"  // The request had no Origin header
+	otherOrigin = "(other)" // Origins beyond the tracking limits
+)
+
+// OriginStats aggregates requests rejected for their origin, so a blocked legitimate site stands out as one origin
+// with many hits while probing with random origins shows up as many distinct origins. Counts are exported as
+// metrics and summarized in a periodic log record.
+type OriginStats struct {
+	mu     sync.Mutex
+	counts map[string]int  // Rejections per origin since the last report
+	total  int             // Rejections since the last report, including those counted as otherOrigin
+	labels map[string]bool // Origins that have their own metric label
+}
+
+// NewOriginStats creates an empty aggregation
+func NewOriginStats() *OriginStats {
+	return &OriginStats{counts: make(map[string]int), labels: make(map[string]bool)}
+}
+
+// Record counts a request rejected because of its Origin header
+func (s *OriginStats) Record(origin string) {
+	origin = originKey(origin)
+
+	s.mu.Lock()
+	s.total++
+	if _, ok := s.counts[origin]; ok || len(s.counts) < maxTrackedOrigins {
+		s.counts[origin]++
+	} else {
+		s.counts[otherOrigin]++
+	}
+	label := origin
+	if !s.labels[origin] {
+		if len(s.labels) < maxOriginLabels {
+			s.labels[origin] = true
+		} else {
+			label = otherOrigin
+		}
+	}
+	s.mu.Unlock()
+
+	rejectedOrigins.Inc(label)
+}
+
+// Run logs a summary of the rejected origins every interval until ctx ends. Intervals without rejections are not logged.
+func (s *OriginStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.report(ctx, interval)
+		}
+	}
+}
+
+// report logs the most frequent rejected origins since the last report and starts a new interval
+func (s *OriginStats) report(ctx context.Context, interval time.Duration) {
+	s.mu.Lock()
+	counts, total := s.counts, s.total
+	s.counts, s.total = make(map[string]int), 0
+	s.mu.Unlock()
+
+	if total == 0 {
+		return
+	}
+
+	origins := slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), strings.Compare(a, b))
+	})
+	top := make([]string, 0, originReportTop)
+	for _, origin := range origins[:min(len(origins), originReportTop)] {
+		top = append(top, fmt.Sprintf("%s=%d", origin, counts[origin]))
+	}
+
+	logger.Warn(ctx, "Requests rejected for their origin",
+		"interval", interval.String(),
+		"rejected", total,
+		"distinct_origins", len(counts),
+		"top_origins", strings.Join(top, ", "))
+}
+
+// originKey normalizes an Origin header for counting. Control characters are replaced and the value is
+// truncated, since the header is client-controlled and ends up in log records and metric labels.
+func originKey(origin string) string {
+	if origin == "" {
+		return noOrigin
+	}
+	origin = singleLine(origin)
+	if len(origin) > maxOriginLength {
+		origin = strings.ToValidUTF8(origin[:maxOriginLength], "")
+	}
+	return origin
+}
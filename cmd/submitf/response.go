@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Response statuses
+const (
+	responseSuccess = "success"
+	responseError   = "error"
+)
+
+// Response is the JSON body returned for every submission
+type Response struct {
+	Status  string `json:"status"`            // "success" or "error"
+	Message string `json:"message,omitempty"` // Human-readable failure reason
+	Field   string `json:"field,omitempty"`   // Form field that failed validation, when the failure is tied to one
+}
+
+// FieldError is a validation failure of a single form field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+// writeJSON writes resp with the given HTTP status code
+func writeJSON(w http.ResponseWriter, code int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeError writes an error response with the given HTTP status code
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, Response{Status: responseError, Message: message})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizeForm makes submitted values safe to place in subjects, headers, bodies and log lines.
+// Single-line values (name, email, form ID, additional fields and file names) have line breaks and other
+// control characters replaced by spaces; the message keeps its line breaks, normalized to LF.
+func sanitizeForm(form FormData) FormData {
+	form.Name = singleLine(form.Name)
+	form.Email = singleLine(form.Email)
+	form.FormID = singleLine(form.FormID)
+	form.Message = multiLine(form.Message)
+
+	if form.Fields != nil {
+		fields := make(map[string]string, len(form.Fields))
+		for name, value := range form.Fields {
+			if name = singleLine(name); name != "" {
+				fields[name] = singleLine(value)
+			}
+		}
+		form.Fields = fields
+	}
+	for i := range form.Files {
+		form.Files[i].Filename = singleLine(form.Files[i].Filename)
+	}
+	return form
+}
+
+// singleLine replaces control characters, line separators and invalid UTF-8 with spaces, collapses runs of
+// whitespace and trims the result
+func singleLine(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unsafeRune(r) || r == '\n' || r == '\t' {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// multiLine normalizes CRLF and lone CR line breaks to LF and removes other control characters and invalid
+// UTF-8, keeping tabs
+func multiLine(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r' || r == '\u2028' || r == '\u2029':
+			return '\n'
+		case r == '\n' || r == '\t':
+			return r
+		case unsafeRune(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// unsafeRune reports whether r is a control character, a Unicode line or paragraph separator, or stands for invalid UTF-8
+func unsafeRune(r rune) bool {
+	return unicode.IsControl(r) || r == '\u2028' || r == '\u2029' || r == utf8.RuneError
+}
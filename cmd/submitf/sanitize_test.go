@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/origin"
+	"mailhubrelay/internal/protocol"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestSingleLine(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Jane Doe", "Jane Doe"},
+		{"crlf header injection", "foo\r\nBcc: attacker@evil.com", "foo Bcc: attacker@evil.com"},
+		{"lone cr", "foo\rBcc: attacker@evil.com", "foo Bcc: attacker@evil.com"},
+		{"lone lf", "foo\nBcc: attacker@evil.com", "foo Bcc: attacker@evil.com"},
+		{"line separator", "foo\u2028Bcc: attacker@evil.com", "foo Bcc: attacker@evil.com"},
+		{"paragraph separator", "foo\u2029Bcc: attacker@evil.com", "foo Bcc: attacker@evil.com"},
+		{"invalid utf-8", "foo\xff\xfeBcc: x", "foo Bcc: x"},
+		{"nul and tab", "a\x00b\tc", "a b c"},
+		{"whitespace collapsed and trimmed", "  a \r\n\r\n  b  ", "a b"},
+		{"unicode kept", "Zoë 🚀", "Zoë 🚀"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := singleLine(tt.in); got != tt.want {
+				t.Errorf("singleLine(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiLine(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"crlf", "a\r\nb", "a\nb"},
+		{"lone cr", "a\rb", "a\nb"},
+		{"line and paragraph separators", "a\u2028b\u2029c", "a\nb\nc"},
+		{"tabs kept", "a\tb", "a\tb"},
+		{"control characters removed", "a\x00\x1bb\x7f", "ab"},
+		{"invalid utf-8 removed", "a\xffb", "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := multiLine(tt.in); got != tt.want {
+				t.Errorf("multiLine(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFormSingleLineFields(t *testing.T) {
+	form := sanitizeForm(FormData{
+		Name:    "foo\r\nBcc: attacker@evil.com",
+		Email:   "a@example.com\r\n",
+		Message: "line one\r\nline two",
+		FormID:  "contact\u2028x",
+		Fields:  map[string]string{"topic\r\n": "sales\r\nX-Injected: 1", "\r\n": "dropped"},
+		Files:   []protocol.Attachment{{Filename: "a\r\n.txt"}},
+	})
+
+	for name, value := range map[string]string{"name": form.Name, "email": form.Email, "form_id": form.FormID, "filename": form.Files[0].Filename} {
+		if strings.ContainsAny(value, "\r\n\u2028\u2029") {
+			t.Errorf("%s still contains a line break: %q", name, value)
+		}
+	}
+	if form.Message != "line one\nline two" {
+		t.Errorf("message = %q, want line breaks normalized to LF", form.Message)
+	}
+	if len(form.Fields) != 1 || form.Fields["topic"] != "sales X-Injected: 1" {
+		t.Errorf("fields = %q, want only topic with its line break removed", form.Fields)
+	}
+}
+
+// TestHandleSubmitHeaderInjection submits a name carrying a Bcc header and checks that the request relayed to MHRS,
+// built into a message the way MHRS does, gains no extra header or recipient
+func TestHandleSubmitHeaderInjection(t *testing.T) {
+	cfg := testConfig(t)
+	requests := fakeMHRS(t, cfg)
+
+	templates, err := LoadBodyTemplates(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins, err := origin.NewMatcher(cfg.Server.AllowedOrigins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handleSubmit(context.Background(), cfg, origins, NewOriginStats(), nil, nil, templates, nil, nil)
+
+	for _, name := range []string{
+		"foo\r\nBcc: attacker@evil.com",
+		"foo\rBcc: attacker@evil.com",
+		"foo\u2028Bcc: attacker@evil.com",
+		"foo\xffBcc: attacker@evil.com",
+	} {
+		t.Run(strings.ToValidUTF8(name, "?"), func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{"name": name, "email": "sender@example.org", "message": "hello"})
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			r.Header.Set("Origin", cfg.Server.AllowedOrigins[0])
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			req := <-requests
+			if len(req.Cc) > 0 || len(req.Bcc) > 0 || len(req.Headers) > 0 {
+				t.Fatalf("relayed request gained recipients or headers: cc %q, bcc %q, headers %q", req.Cc, req.Bcc, req.Headers)
+			}
+			for field, value := range map[string]string{"subject": req.Subject, "reply_to": req.ReplyTo} {
+				if strings.ContainsAny(value, "\r\n") {
+					t.Errorf("%s contains a line break: %q", field, value)
+				}
+			}
+
+			e := email.NewEmail()
+			e.From = cfg.SMTP.FromAddr
+			e.To = []string{req.Recipient}
+			e.ReplyTo = []string{req.ReplyTo}
+			e.Subject = req.Subject
+			e.Text = req.Body
+			raw, err := e.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bcc := msg.Header.Get("Bcc"); bcc != "" {
+				t.Errorf("built message has injected Bcc header %q", bcc)
+			}
+			replyTo, err := msg.Header.AddressList("Reply-To")
+			if err != nil || len(replyTo) != 1 || replyTo[0].Address != "sender@example.org" {
+				t.Errorf("Reply-To = %v (%v), want only the submitter", replyTo, err)
+			}
+		})
+	}
+}
+
+// testConfig loads the default configuration with logs written to a temporary directory
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, appName+".toml")
+	data := "[smtp]\nencryption = \"none\"\nauth_pass = \"\"\n\n[logging]\ndirectory = \"" + filepath.ToSlash(dir) + "\"\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := config.Load(appName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// fakeMHRS points cfg at a listener that acknowledges every request with ok and passes the requests it receives on
+func fakeMHRS(t *testing.T, cfg *config.Config) <-chan protocol.EmailRequest {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	cfg.Server.InternalAddr = listener.Addr().String()
+
+	requests := make(chan protocol.EmailRequest, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			payload, err := protocol.ReadFrame(conn, cfg.Server.MaxMessageBytes)
+			if err == nil {
+				var req protocol.EmailRequest
+				if json.Unmarshal(payload, &req) == nil {
+					requests <- req
+				}
+				ack, _ := json.Marshal(protocol.Ack{Status: protocol.StatusOK, RequestID: "test"})
+				protocol.WriteFrame(conn, ack)
+			}
+			conn.Close()
+		}
+	}()
+	return requests
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mailhubrelay/internal/config"
+	"mailhubrelay/internal/logger"
+	"mailhubrelay/internal/protocol"
+	"mailhubrelay/internal/validate"
+)
+
+// adminSender relays complete email requests from internal services to MHRS, so they can send mail over HTTP
+// without implementing the MHRS protocol. Requests are forwarded unchanged apart from the MHRS client token.
+type adminSender struct {
+	ctx context.Context
+	cfg *config.Config
+}
+
+// ServeHTTP accepts a JSON protocol.EmailRequest authenticated with Server.AdminToken as a bearer token, relays it
+// to MHRS and answers with the MHRS acknowledgement once delivery has succeeded or failed
+func (s *adminSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Server.AdminToken)) != 1 {
+		adminSends.Inc("unauthorized")
+		logger.Warn(s.ctx, "Rejected admin send with missing or invalid token", "remote_addr", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="submitf"`)
+		writeError(w, http.StatusUnauthorized, "Invalid or missing bearer token")
+		return
+	}
+
+	var req protocol.EmailRequest
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.Server.MaxMessageBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		adminSends.Inc("invalid")
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid email request: %v", err))
+		return
+	}
+	if err := validateEmailRequest(req); err != nil {
+		adminSends.Inc("invalid")
+		logger.Warn(s.ctx, "Rejected invalid admin send", "error", err.Error(), "remote_addr", r.RemoteAddr)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.AuthToken = s.cfg.Server.ClientToken
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.Server.RelayTimeout)
+	defer cancel()
+	ack, err := exchangeWithMHRS(ctx, req, s.cfg)
+	if err != nil {
+		adminSends.Inc("relay_failed")
+		logger.Error(s.ctx, "Failed to relay admin send to MHRS", "error", err.Error(), "recipient", req.Recipient, "remote_addr", r.RemoteAddr)
+		writeError(w, http.StatusBadGateway, "Failed to reach mail relay")
+		return
+	}
+
+	adminSends.Inc(ack.Status)
+	logger.Info(s.ctx, "Admin send relayed to MHRS",
+		"recipient", req.Recipient,
+		"subject", req.Subject,
+		"status", ack.Status,
+		"mhrs_request_id", ack.RequestID,
+		"remote_addr", r.RemoteAddr)
+
+	code := http.StatusOK
+	switch ack.Status {
+	case protocol.StatusOK:
+	case protocol.StatusBusy:
+		code = http.StatusServiceUnavailable
+	default:
+		code = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ack)
+}
+
+// validateEmailRequest checks that an admin send is an email with at least one recipient and that every
+// recipient address parses. Queries such as queue_status are not relayed.
+func validateEmailRequest(req protocol.EmailRequest) error {
+	if req.Command != "" {
+		return errors.New("commands cannot be sent through this endpoint")
+	}
+
+	var recipients int
+	if strings.TrimSpace(req.Recipient) != "" {
+		to, err := validate.AddressList(req.Recipient)
+		if err != nil {
+			return fmt.Errorf("invalid recipient: %w", err)
+		}
+		recipients += len(to)
+	}
+	for _, list := range []struct {
+		name  string
+		addrs []string
+	}{
+		{"cc", req.Cc},
+		{"bcc", req.Bcc},
+	} {
+		for _, addr := range list.addrs {
+			if err := validate.Address(addr); err != nil {
+				return fmt.Errorf("invalid %s recipient: %w", list.name, err)
+			}
+		}
+		recipients += len(list.addrs)
+	}
+	if recipients == 0 {
+		return errors.New("no recipient specified: set recipient, cc or bcc")
+	}
+	return nil
+}
+
+// exchangeWithMHRS sends req to MHRS and waits for its acknowledgement until the deadline of ctx, or for up to
+// Server.RelayTimeout when ctx has none. The exchange is abandoned when ctx is cancelled.
+func exchangeWithMHRS(ctx context.Context, req protocol.EmailRequest, cfg *config.Config) (protocol.Ack, error) {
+	var ack protocol.Ack
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return ack, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(cfg.Server.RelayTimeout)
+	}
+	conn, err := protocol.Dial(relayAddr(cfg), min(30*time.Second, time.Until(deadline)))
+	if err != nil {
+		return ack, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return ack, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if err := protocol.WriteFrame(conn, jsonData); err != nil {
+		return ack, fmt.Errorf("failed to write request: %w", err)
+	}
+	ackData, err := protocol.ReadFrame(conn, cfg.Server.MaxMessageBytes)
+	if err != nil {
+		return ack, fmt.Errorf("failed to read acknowledgement: %w", err)
+	}
+	if err := json.Unmarshal(ackData, &ack); err != nil {
+		return ack, fmt.Errorf("failed to decode acknowledgement: %w", err)
+	}
+	return ack, nil
+}
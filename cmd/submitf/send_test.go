@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mailhubrelay/internal/origin"
+)
+
+// TestHandleSubmitRelayTimeout checks that a submission MHRS never acknowledges is answered with an error once
+// Server.RelayTimeout has passed, rather than left to the HTTP write timeout
+func TestHandleSubmitRelayTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Server.RelayTimeout = 200 * time.Millisecond
+
+	// MHRS accepts the connection but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	cfg.Server.InternalAddr = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	templates, err := LoadBodyTemplates(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins, err := origin.NewMatcher(cfg.Server.AllowedOrigins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handleSubmit(context.Background(), cfg, origins, NewOriginStats(), nil, nil, templates, nil, nil)
+
+	body, _ := json.Marshal(map[string]string{"name": "Jane", "email": "sender@example.org", "message": "hello"})
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Origin", cfg.Server.AllowedOrigins[0])
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler(w, r)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("submission answered after %s, want soon after the relay timeout", elapsed)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, body %s, want a relay failure", w.Code, w.Body)
+	}
+}
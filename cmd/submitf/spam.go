@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"mailhubrelay/internal/config"
+)
+
+// linkPattern matches URLs and bare www. links in submitted text
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// SpamFilter scores submissions with the heuristics configured under Server.Spam*
+type SpamFilter struct {
+	threshold int
+	maxLinks  int
+	keywords  []string
+	deniedIPs []netip.Prefix
+}
+
+// NewSpamFilter builds the filter from the configuration. Returns nil when Server.SpamThreshold is 0,
+// which disables scoring.
+func NewSpamFilter(cfg *config.Config) (*SpamFilter, error) {
+	if cfg.Server.SpamThreshold == 0 {
+		return nil, nil
+	}
+
+	f := &SpamFilter{threshold: cfg.Server.SpamThreshold, maxLinks: cfg.Server.SpamMaxLinks}
+	for _, keyword := range cfg.Server.SpamKeywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			f.keywords = append(f.keywords, keyword)
+		}
+	}
+	for _, entry := range cfg.Server.SpamDeniedIPs {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid spam denied IP %q", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		f.deniedIPs = append(f.deniedIPs, prefix.Masked())
+	}
+	return f, nil
+}
+
+// Score rates a submission from client ip. Every link beyond Server.SpamMaxLinks and every listed keyword found
+// adds a point, and a denied IP adds the full threshold. Returns the score and the reasons that contributed,
+// and whether the submission reaches the threshold.
+func (f *SpamFilter) Score(form FormData, ip string) (int, []string, bool) {
+	var score int
+	var reasons []string
+
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range f.deniedIPs {
+			if prefix.Contains(addr) {
+				score += f.threshold
+				reasons = append(reasons, "denied ip "+prefix.String())
+				break
+			}
+		}
+	}
+
+	text := submissionText(form)
+	if links := len(linkPattern.FindAllString(text, -1)); links > f.maxLinks {
+		score += links - f.maxLinks
+		reasons = append(reasons, fmt.Sprintf("%d links", links))
+	}
+
+	lower := strings.ToLower(text)
+	for _, keyword := range f.keywords {
+		if strings.Contains(lower, keyword) {
+			score++
+			reasons = append(reasons, "keyword "+keyword)
+		}
+	}
+
+	return score, reasons, score >= f.threshold
+}
+
+// submissionText joins the free-text values of a submission for content checks
+func submissionText(form FormData) string {
+	parts := []string{form.Name, form.Message}
+	for _, value := range form.Fields {
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, "\n")
+}
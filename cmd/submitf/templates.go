@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"mailhubrelay/internal/config"
+)
+
+// TemplateData holds the values available to subject and body templates
+type TemplateData struct {
+	Name      string            // Submitter's name
+	Email     string            // Submitter's email address
+	Message   string            // Message content
+	FormID    string            // Form identifier, empty when the form sends none
+	Fields    map[string]string // Additional form fields, e.g. {{index .Fields "phone"}}
+	Timestamp time.Time         // Time the submission was received
+	ClientIP  string            // Submitter's IP address, empty unless Server.IncludeClientInfo is set
+	UserAgent string            // Submitter's User-Agent with control characters removed, empty unless Server.IncludeClientInfo is set
+}
+
+// BodyTemplates caches the parsed notification templates so template files are only read at startup and on SIGHUP
+type BodyTemplates struct {
+	mu               sync.RWMutex
+	subject          *texttemplate.Template
+	text             *texttemplate.Template
+	html             *htmltemplate.Template
+	autoReplySubject *texttemplate.Template
+	autoReply        *texttemplate.Template
+}
+
+// LoadBodyTemplates parses the configured subject template and template files. Unset values leave the
+// corresponding template nil, which selects the built-in subject, the built-in text body, no HTML part and no auto-reply.
+func LoadBodyTemplates(cfg *config.Config) (*BodyTemplates, error) {
+	t := &BodyTemplates{}
+	if err := t.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload parses the configured template files again. The cached templates are only
+// replaced when every file parses, so a broken edit keeps the previous templates in use.
+func (t *BodyTemplates) Reload(cfg *config.Config) error {
+	var subject *texttemplate.Template
+	if cfg.Server.SubjectTemplate != "" {
+		parsed, err := texttemplate.New("subject").Parse(cfg.Server.SubjectTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to parse subject template: %w", err)
+		}
+		subject = parsed
+	}
+
+	var text *texttemplate.Template
+	if cfg.Server.BodyTemplate != "" {
+		parsed, err := texttemplate.ParseFiles(cfg.Server.BodyTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to parse body template: %w", err)
+		}
+		text = parsed
+	}
+
+	var html *htmltemplate.Template
+	if cfg.Server.HTMLBodyTemplate != "" {
+		parsed, err := htmltemplate.ParseFiles(cfg.Server.HTMLBodyTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to parse HTML body template: %w", err)
+		}
+		html = parsed
+	}
+
+	var autoReplySubject, autoReply *texttemplate.Template
+	if cfg.Server.AutoReplyTemplate != "" {
+		parsed, err := texttemplate.ParseFiles(cfg.Server.AutoReplyTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to parse auto-reply template: %w", err)
+		}
+		autoReply = parsed
+		if autoReplySubject, err = texttemplate.New("auto_reply_subject").Parse(cfg.Server.AutoReplySubject); err != nil {
+			return fmt.Errorf("failed to parse auto-reply subject: %w", err)
+		}
+	}
+
+	t.mu.Lock()
+	t.subject, t.text, t.html = subject, text, html
+	t.autoReplySubject, t.autoReply = autoReplySubject, autoReply
+	t.mu.Unlock()
+	return nil
+}
+
+// Render produces the plaintext body and, when an HTML template is configured, the HTML body for a submission
+func (t *BodyTemplates) Render(form FormData, now time.Time) (string, []byte, error) {
+	t.mu.RLock()
+	text, html := t.text, t.html
+	t.mu.RUnlock()
+
+	data := templateData(form, now)
+
+	body := formatEmailBody(form)
+	if text != nil {
+		var buf bytes.Buffer
+		if err := text.Execute(&buf, data); err != nil {
+			return "", nil, fmt.Errorf("failed to render body template: %w", err)
+		}
+		body = buf.String()
+	}
+
+	var htmlBody []byte
+	if html != nil {
+		var buf bytes.Buffer
+		if err := html.Execute(&buf, data); err != nil {
+			return "", nil, fmt.Errorf("failed to render HTML body template: %w", err)
+		}
+		htmlBody = buf.Bytes()
+	}
+
+	return body, htmlBody, nil
+}
+
+// Subject produces the notification subject from Server.SubjectTemplate, or formSubject when none is configured.
+// Whitespace in the result is collapsed so a line break in a form value cannot break the header.
+func (t *BodyTemplates) Subject(form FormData, now time.Time, cfg *config.Config) (string, error) {
+	t.mu.RLock()
+	subject := t.subject
+	t.mu.RUnlock()
+
+	if subject == nil {
+		return formSubject(form, cfg), nil
+	}
+	var buf bytes.Buffer
+	if err := subject.Execute(&buf, templateData(form, now)); err != nil {
+		return "", fmt.Errorf("failed to render subject template: %w", err)
+	}
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// AutoReply renders the confirmation sent to the submitter. ok is false when no auto-reply template is configured.
+func (t *BodyTemplates) AutoReply(form FormData, now time.Time) (subject, body string, ok bool, err error) {
+	t.mu.RLock()
+	subjectTmpl, bodyTmpl := t.autoReplySubject, t.autoReply
+	t.mu.RUnlock()
+
+	if bodyTmpl == nil {
+		return "", "", false, nil
+	}
+	data := templateData(form, now)
+	var buf bytes.Buffer
+	if err := subjectTmpl.Execute(&buf, data); err != nil {
+		return "", "", false, fmt.Errorf("failed to render auto-reply subject: %w", err)
+	}
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := bodyTmpl.Execute(&buf, data); err != nil {
+		return "", "", false, fmt.Errorf("failed to render auto-reply template: %w", err)
+	}
+	return subject, buf.String(), true, nil
+}
+
+// templateData collects the template values for a submission
+func templateData(form FormData, now time.Time) TemplateData {
+	return TemplateData{
+		Name:      form.Name,
+		Email:     form.Email,
+		Message:   form.Message,
+		FormID:    form.FormID,
+		Fields:    form.Fields,
+		Timestamp: now,
+		ClientIP:  form.ClientIP,
+		UserAgent: form.UserAgent,
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"mailhubrelay/internal/config"
+)
+
+// formTokenHeader carries the form token on submissions
+const formTokenHeader = "X-Form-Token"
+
+// Form token modes
+const (
+	formTokenShared = "shared" // The header must equal the configured secret
+	formTokenSigned = "signed" // The header must be an unexpired token signed with the configured secret
+)
+
+var (
+	errFormTokenMissing = errors.New("missing form token")
+	errFormTokenInvalid = errors.New("invalid form token")
+	errFormTokenExpired = errors.New("form token expired")
+)
+
+// checkFormToken validates the form token sent with a submission.
+// It always succeeds when form tokens are disabled.
+func checkFormToken(token string, cfg *config.Config, now time.Time) error {
+	if cfg.Server.FormTokenMode == "" {
+		return nil
+	}
+	if token == "" {
+		return errFormTokenMissing
+	}
+
+	secret := cfg.Server.FormTokenSecret
+	if cfg.Server.FormTokenMode == formTokenShared {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return errFormTokenInvalid
+		}
+		return nil
+	}
+
+	// Signed tokens are "<expiry>.<signature>" where expiry is a Unix time in seconds
+	// and signature is the hex HMAC-SHA256 of the expiry string keyed with the secret
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return errFormTokenInvalid
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errFormTokenInvalid
+	}
+	if !hmac.Equal(got, signFormToken(expiry, secret)) {
+		return errFormTokenInvalid
+	}
+
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return errFormTokenInvalid
+	}
+	if now.Unix() > expiresAt {
+		return errFormTokenExpired
+	}
+	return nil
+}
+
+// signFormToken returns the HMAC-SHA256 signature of a signed token's expiry
+func signFormToken(expiry, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(expiry))
+	return mac.Sum(nil)
+}
@@ -1,11 +1,25 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
+	"mailhubrelay/internal/origin"
+	"mailhubrelay/internal/validate"
+
 	"github.com/LixenWraith/logger"
 	"github.com/LixenWraith/tinytoml"
 )
@@ -15,43 +29,275 @@ const (
 )
 
 type SMTPConfig struct {
-	Host     string `toml:"host"`
-	Port     string `toml:"port"`
-	FromAddr string `toml:"from_addr"`
-	AuthUser string `toml:"auth_user"`
-	AuthPass string `toml:"auth_pass"`
+	Host               string        `toml:"host"`
+	Port               string        `toml:"port"`
+	Proxy              string        `toml:"proxy"`
+	HeloHost           string        `toml:"helo_host"`
+	FromAddr           string        `toml:"from_addr"`
+	FromName           string        `toml:"from_name"`
+	Encryption         string        `toml:"encryption"`
+	AuthMethod         string        `toml:"auth_method"`
+	AuthUser           string        `toml:"auth_user"`
+	AuthPass           string        `toml:"auth_pass"`
+	AuthPassFile       string        `toml:"auth_pass_file"`
+	OAuthTokenURL      string        `toml:"oauth_token_url"`
+	OAuthClientID      string        `toml:"oauth_client_id"`
+	OAuthClientSecret  string        `toml:"oauth_client_secret"`
+	OAuthScope         string        `toml:"oauth_scope"`
+	ClientCertFile     string        `toml:"client_cert_file"`
+	ClientKeyFile      string        `toml:"client_key_file"`
+	TLSMinVersion      string        `toml:"tls_min_version"`
+	TLSCipherSuites    []string      `toml:"tls_cipher_suites"`
+	InsecureSkipVerify bool          `toml:"insecure_skip_verify"`
+	PoolSize           int           `toml:"pool_size"`
+	PoolIdleTimeout    time.Duration `toml:"pool_idle_timeout"`
+	Trace              bool          `toml:"trace"`
 }
 
 type ServerConfig struct {
-	InternalAddr   string        `toml:"internal_addr"`
-	ExternalAddr   string        `toml:"external_addr"`
-	Timeout        time.Duration `toml:"timeout"`
-	RetryDelay     time.Duration `toml:"retry_delay"`
-	MaxRetries     int           `toml:"max_retries"`
-	AllowedOrigins []string      `toml:"allowed_origins"`
+	InternalAddr            string            `toml:"internal_addr"`
+	InternalSocket          string            `toml:"internal_socket"`
+	ExternalAddr            string            `toml:"external_addr"`
+	GRPCAddr                string            `toml:"grpc_addr"`
+	HTTPAddr                string            `toml:"http_addr"`
+	Timeout                 time.Duration     `toml:"timeout"`
+	ReadTimeout             time.Duration     `toml:"read_timeout"`
+	IdleTimeout             time.Duration     `toml:"idle_timeout"`
+	RetryDelay              time.Duration     `toml:"retry_delay"`
+	MaxRetries              int               `toml:"max_retries"`
+	RetryDeadline           time.Duration     `toml:"retry_deadline"`
+	RetryPermanentErrors    bool              `toml:"retry_permanent_errors"`
+	GreylistDelay           time.Duration     `toml:"greylist_delay"`
+	GreylistMaxDelay        time.Duration     `toml:"greylist_max_delay"`
+	CallbackWorkers         int               `toml:"callback_workers"`
+	CallbackTimeout         time.Duration     `toml:"callback_timeout"`
+	CallbackMaxRetries      int               `toml:"callback_max_retries"`
+	AllowedOrigins          []string          `toml:"allowed_origins"`
+	OriginReportInterval    time.Duration     `toml:"origin_report_interval"`
+	CORSAllowedMethods      []string          `toml:"cors_allowed_methods"`
+	CORSAllowedHeaders      []string          `toml:"cors_allowed_headers"`
+	MaxAttachmentBytes      int64             `toml:"max_attachment_bytes"`
+	MaxMessageBytes         int64             `toml:"max_message_bytes"`
+	MaxBodyBytes            int64             `toml:"max_body_bytes"`
+	MaxRecipients           int               `toml:"max_recipients"`
+	EmptyRecipient          string            `toml:"empty_recipient"`
+	DefaultRecipient        string            `toml:"default_recipient"`
+	QueueDir                string            `toml:"queue_dir"`
+	MaxQueueSize            int               `toml:"max_queue_size"`
+	IdempotencyTTL          time.Duration     `toml:"idempotency_ttl"`
+	FormRecipient           string            `toml:"form_recipient"`
+	FormRecipients          map[string]string `toml:"form_recipients"`
+	RateLimitPerMinute      int               `toml:"rate_limit_per_minute"`
+	RateLimitBurst          int               `toml:"rate_limit_burst"`
+	EmailRateLimit          int               `toml:"email_rate_limit"`
+	EmailRateWindow         time.Duration     `toml:"email_rate_window"`
+	TrustProxyHeaders       bool              `toml:"trust_proxy_headers"`
+	ProxyIPHeader           string            `toml:"proxy_ip_header"`
+	IncludeClientInfo       bool              `toml:"include_client_info"`
+	AttachSubmissionJSON    bool              `toml:"attach_submission_json"`
+	HoneypotEnabled         bool              `toml:"honeypot_enabled"`
+	MinFillTime             time.Duration     `toml:"min_fill_time"`
+	MetricsAddr             string            `toml:"metrics_addr"`
+	HealthAddr              string            `toml:"health_addr"`
+	EventsAddr              string            `toml:"events_addr"`
+	MaxEventSubscribers     int               `toml:"max_event_subscribers"`
+	AdminAddr               string            `toml:"admin_addr"`
+	AdminToken              string            `toml:"admin_token"`
+	AllowedHeaderOverrides  []string          `toml:"allowed_header_overrides"`
+	MaxConcurrent           int               `toml:"max_concurrent"`
+	DrainTimeout            time.Duration     `toml:"drain_timeout"`
+	DeadLetterDir           string            `toml:"dead_letter_dir"`
+	DeadLetterMaxFiles      int               `toml:"dead_letter_max_files"`
+	DeadLetterMaxBytes      int64             `toml:"dead_letter_max_bytes"`
+	AuditLog                string            `toml:"audit_log"`
+	AuditLogFormat          string            `toml:"audit_log_format"`
+	AuditMaxBytes           int64             `toml:"audit_max_bytes"`
+	AuditMaxFiles           int               `toml:"audit_max_files"`
+	AllowFromOverride       bool              `toml:"allow_from_override"`
+	BodyTemplate            string            `toml:"body_template"`
+	HTMLBodyTemplate        string            `toml:"html_body_template"`
+	FormTokenMode           string            `toml:"form_token_mode"`
+	FormTokenSecret         string            `toml:"form_token_secret"`
+	FormFields              []string          `toml:"form_fields"`
+	RequiredFormFields      []string          `toml:"required_form_fields"`
+	SubjectField            string            `toml:"subject_field"`
+	SubjectTemplate         string            `toml:"subject_template"`
+	DedupWindow             time.Duration     `toml:"dedup_window"`
+	SpamThreshold           int               `toml:"spam_threshold"`
+	SpamAction              string            `toml:"spam_action"`
+	SpamMaxLinks            int               `toml:"spam_max_links"`
+	SpamKeywords            []string          `toml:"spam_keywords"`
+	SpamDeniedIPs           []string          `toml:"spam_denied_ips"`
+	RelayMaxRetries         int               `toml:"relay_max_retries"`
+	RelayRetryDelay         time.Duration     `toml:"relay_retry_delay"`
+	RelayTimeout            time.Duration     `toml:"relay_timeout"`
+	AutoReplyTemplate       string            `toml:"auto_reply_template"`
+	AutoReplySubject        string            `toml:"auto_reply_subject"`
+	AutoReplyFrom           string            `toml:"auto_reply_from"`
+	MaxUploadBytes          int64             `toml:"max_upload_bytes"`
+	AllowedUploadTypes      []string          `toml:"allowed_upload_types"`
+	CaptchaProvider         string            `toml:"captcha_provider"`
+	CaptchaSecret           string            `toml:"captcha_secret"`
+	CaptchaVerifyURL        string            `toml:"captcha_verify_url"`
+	CaptchaMinScore         float64           `toml:"captcha_min_score"`
+	SMTPFailover            []string          `toml:"smtp_failover"`
+	SendRatePerMinute       int               `toml:"send_rate_per_minute"`
+	SendBurst               int               `toml:"send_burst"`
+	DailySendLimit          int               `toml:"daily_send_limit"`
+	MessageIDDomain         string            `toml:"message_id_domain"`
+	DKIMKeyFile             string            `toml:"dkim_key_file"`
+	DKIMSelector            string            `toml:"dkim_selector"`
+	DKIMDomain              string            `toml:"dkim_domain"`
+	AllowedRecipientDomains []string          `toml:"allowed_recipient_domains"`
+	BlockedRecipientDomains []string          `toml:"blocked_recipient_domains"`
+	ClientToken             string            `toml:"client_token"`
+	LogFormat               string            `toml:"log_format"`
 }
 
 type Config struct {
-	SMTP    SMTPConfig    `toml:"smtp"`
-	Server  ServerConfig  `toml:"server"`
-	Logging logger.Config `toml:"logging"`
+	SMTP         SMTPConfig            `toml:"smtp"`
+	SMTPBackends map[string]SMTPConfig `toml:"smtp_backends"`
+	Server       ServerConfig          `toml:"server"`
+	Logging      logger.Config         `toml:"logging"`
+}
+
+// PrimarySMTPBackend is the name the [smtp] server is reported under alongside named failover backends
+const PrimarySMTPBackend = "primary"
+
+// SMTPBackend is an SMTP server taking part in delivery
+type SMTPBackend struct {
+	Name string
+	SMTP *SMTPConfig
+}
+
+// SMTPChain returns the SMTP servers to try for each delivery attempt, in order:
+// the [smtp] server followed by the backends listed in server.smtp_failover
+func (c *Config) SMTPChain() []SMTPBackend {
+	chain := []SMTPBackend{{Name: PrimarySMTPBackend, SMTP: &c.SMTP}}
+	for _, name := range c.Server.SMTPFailover {
+		if backend, ok := c.SMTPBackends[name]; ok {
+			chain = append(chain, SMTPBackend{Name: name, SMTP: &backend})
+		}
+	}
+	return chain
 }
 
 var defaultConfig = Config{
 	SMTP: SMTPConfig{
-		Host:     "smtp.gmail.com",
-		Port:     "587",
-		FromAddr: "user@example.com",
-		AuthUser: "user@example.com",
-		AuthPass: "0123456789AB",
+		Host:               "smtp.gmail.com",
+		Port:               "587",
+		Proxy:              "",
+		HeloHost:           "",
+		FromAddr:           "user@example.com",
+		FromName:           "",
+		Encryption:         "starttls",
+		AuthMethod:         "plain",
+		AuthUser:           "user@example.com",
+		AuthPass:           "0123456789AB",
+		AuthPassFile:       "",
+		OAuthTokenURL:      "",
+		OAuthClientID:      "",
+		OAuthClientSecret:  "",
+		OAuthScope:         "https://mail.google.com/",
+		ClientCertFile:     "",
+		ClientKeyFile:      "",
+		TLSMinVersion:      "1.2",
+		InsecureSkipVerify: false,
+		PoolSize:           2,
+		PoolIdleTimeout:    30 * time.Second,
+		Trace:              false,
 	},
 	Server: ServerConfig{
-		InternalAddr:   "localhost:2525",
-		ExternalAddr:   "localhost:8845",
-		Timeout:        3 * time.Minute,
-		RetryDelay:     10 * time.Second,
-		MaxRetries:     3,
-		AllowedOrigins: []string{"https://example.com", "http://example.com"},
+		InternalAddr:         "localhost:2525",
+		InternalSocket:       "",
+		ExternalAddr:         "localhost:8845",
+		GRPCAddr:             "",
+		HTTPAddr:             "",
+		Timeout:              3 * time.Minute,
+		ReadTimeout:          60 * time.Second,
+		IdleTimeout:          2 * time.Minute,
+		RetryDelay:           10 * time.Second,
+		MaxRetries:           3,
+		RetryDeadline:        0,
+		RetryPermanentErrors: false,
+		GreylistDelay:        60 * time.Second,
+		GreylistMaxDelay:     5 * time.Minute,
+		CallbackWorkers:      4,
+		CallbackTimeout:      10 * time.Second,
+		CallbackMaxRetries:   3,
+		AllowedOrigins:       []string{"https://example.com", "http://example.com"},
+		OriginReportInterval: 5 * time.Minute,
+		CORSAllowedMethods:   []string{"POST", "OPTIONS"},
+		CORSAllowedHeaders:   []string{"Content-Type"},
+		MaxAttachmentBytes:   10 * 1024 * 1024,
+		MaxMessageBytes:      20 * 1024 * 1024,
+		MaxBodyBytes:         15 * 1024 * 1024,
+		MaxRecipients:        50,
+		EmptyRecipient:       "reject",
+		DefaultRecipient:     "",
+		QueueDir:             "",
+		MaxQueueSize:         1000,
+		IdempotencyTTL:       24 * time.Hour,
+		FormRecipient:        "",
+		RateLimitPerMinute:   0,
+		RateLimitBurst:       5,
+		EmailRateLimit:       0,
+		EmailRateWindow:      time.Hour,
+		TrustProxyHeaders:    false,
+		ProxyIPHeader:        "X-Forwarded-For",
+		IncludeClientInfo:    true,
+		AttachSubmissionJSON: false,
+		HoneypotEnabled:      false,
+		MinFillTime:          0,
+		MetricsAddr:          "",
+		HealthAddr:           "",
+		EventsAddr:           "",
+		MaxEventSubscribers:  10,
+		AdminAddr:            "",
+		AdminToken:           "",
+		MaxConcurrent:        20,
+		DrainTimeout:         30 * time.Second,
+		DeadLetterDir:        "",
+		DeadLetterMaxFiles:   1000,
+		DeadLetterMaxBytes:   100 * 1024 * 1024,
+		AuditLog:             "",
+		AuditLogFormat:       "json",
+		AuditMaxBytes:        100 * 1024 * 1024,
+		AuditMaxFiles:        10,
+		AllowFromOverride:    false,
+		BodyTemplate:         "",
+		HTMLBodyTemplate:     "",
+		FormTokenMode:        "",
+		FormTokenSecret:      "",
+		SubjectField:         "",
+		SubjectTemplate:      "",
+		DedupWindow:          0,
+		SpamThreshold:        0,
+		SpamAction:           "reject",
+		SpamMaxLinks:         2,
+		SpamKeywords:         []string{},
+		SpamDeniedIPs:        []string{},
+		RelayMaxRetries:      3,
+		RelayRetryDelay:      500 * time.Millisecond,
+		RelayTimeout:         90 * time.Second,
+		AutoReplyTemplate:    "",
+		AutoReplySubject:     "We received your message",
+		AutoReplyFrom:        "",
+		MaxUploadBytes:       0,
+		AllowedUploadTypes:   []string{"application/pdf", "application/msword", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "text/plain", "image/png", "image/jpeg"},
+		CaptchaProvider:      "recaptcha",
+		CaptchaSecret:        "",
+		CaptchaVerifyURL:     "",
+		CaptchaMinScore:      0,
+		SendRatePerMinute:    0,
+		SendBurst:            1,
+		DailySendLimit:       0,
+		MessageIDDomain:      "",
+		DKIMKeyFile:          "",
+		DKIMSelector:         "",
+		DKIMDomain:           "",
+		ClientToken:          "",
+		LogFormat:            "native",
 	},
 	Logging: logger.Config{
 		Level:          logger.LevelDebug,
@@ -64,10 +310,78 @@ var defaultConfig = Config{
 	},
 }
 
-func Load(name string) (*Config, bool, error) {
-	defaultConfigPath := filepath.Join(defaultConfigBase, name, name+".toml")
+// Path returns the system-wide location of the configuration file for the named service
+func Path(name string) string {
+	return filepath.Join(defaultConfigBase, name, name+".toml")
+}
+
+// EnvPath returns the environment variable that names the configuration file of a service, e.g. MHRS_CONFIG
+func EnvPath(name string) string {
+	return strings.ToUpper(name) + "_CONFIG"
+}
 
-	if err := os.MkdirAll(filepath.Dir(defaultConfigPath), 0755); err != nil {
+// userPath returns the per-user configuration file under $XDG_CONFIG_HOME, or ~/.config when that is unset
+func userPath(name string) string {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if !filepath.IsAbs(base) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, name, name+".toml")
+}
+
+// Resolve returns the configuration file a service should use. An explicit path wins, then the path in the
+// EnvPath(name) variable, then the first of the per-user and system-wide files that exists. When neither exists,
+// non-root users get the per-user location, so a generated configuration can be saved without privileges.
+func Resolve(name, explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if path := os.Getenv(EnvPath(name)); path != "" {
+		return path
+	}
+
+	user := userPath(name)
+	for _, path := range []string{user, Path(name)} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	if user != "" && os.Geteuid() != 0 {
+		return user
+	}
+	return Path(name)
+}
+
+// backendDefaults holds the settings failover backends use when they leave them unset.
+// Server identity and credentials have no defaults and must be given for every backend.
+var backendDefaults = SMTPConfig{
+	Port:            "587",
+	Encryption:      "starttls",
+	AuthMethod:      "plain",
+	OAuthScope:      "https://mail.google.com/",
+	TLSMinVersion:   "1.2",
+	PoolSize:        2,
+	PoolIdleTimeout: 30 * time.Second,
+}
+
+// maxRetriesUnset marks server.max_retries as not given by the config file or the environment while loading
+const maxRetriesUnset = math.MinInt
+
+// Load reads the configuration of the named service from path, or from Resolve(name, "") when path is empty.
+// Returns whether the file exists; a missing file yields the defaults.
+func Load(name, path string) (*Config, bool, error) {
+	if path == "" {
+		path = Resolve(name, "")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return nil, false, fmt.Errorf("failed to create config directory: %w", err)
 	}
 
@@ -75,12 +389,13 @@ func Load(name string) (*Config, bool, error) {
 	config := defaultConfig
 	config.Logging.Name = name
 	config.Logging.Directory = filepath.Join(config.Logging.Directory, name)
+	config.Server.MaxRetries = maxRetriesUnset
 
 	// If config file exists, Load and merge with defaults
 	configExists := false
-	if _, err := os.Stat(defaultConfigPath); err == nil {
+	if _, err := os.Stat(path); err == nil {
 		configExists = true
-		data, err := os.ReadFile(defaultConfigPath)
+		data, err := os.ReadFile(path)
 		if err != nil {
 			return nil, configExists, fmt.Errorf("failed to read config file: %w", err)
 		}
@@ -91,6 +406,39 @@ func Load(name string) (*Config, bool, error) {
 		}
 	}
 
+	// Environment variables take precedence over the config file
+	if err := applyEnv(&config); err != nil {
+		return nil, configExists, err
+	}
+
+	// An unset max_retries defaults to a retry count, unless a retry deadline sets the budget instead
+	if config.Server.MaxRetries == maxRetriesUnset {
+		config.Server.MaxRetries = defaultConfig.Server.MaxRetries
+		if config.Server.RetryDeadline > 0 {
+			config.Server.MaxRetries = 0
+		}
+	}
+
+	if config.SMTP.AuthPassFile != "" {
+		pass, err := readSecretFile(config.SMTP.AuthPassFile)
+		if err != nil {
+			return nil, configExists, fmt.Errorf("failed to load SMTP password: %w", err)
+		}
+		config.SMTP.AuthPass = pass
+	}
+
+	for name, backend := range config.SMTPBackends {
+		fillZero(reflect.ValueOf(&backend).Elem(), reflect.ValueOf(backendDefaults))
+		if backend.AuthPassFile != "" {
+			pass, err := readSecretFile(backend.AuthPassFile)
+			if err != nil {
+				return nil, configExists, fmt.Errorf("failed to load SMTP password for backend %s: %w", name, err)
+			}
+			backend.AuthPass = pass
+		}
+		config.SMTPBackends[name] = backend
+	}
+
 	if err := validateConfig(&config); err != nil {
 		return nil, configExists, err
 	}
@@ -98,41 +446,558 @@ func Load(name string) (*Config, bool, error) {
 	return &config, configExists, nil
 }
 
+// readSecretFile returns the trimmed content of a file holding a secret.
+// The file must not be readable or writable by group or others.
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s has permissions %04o, it must not be accessible by group or others", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// validateConfig checks every setting and returns all problems found joined into a single error, one per line
 func validateConfig(config *Config) error {
-	// Basic validation
-	if config.SMTP.Host == "" || config.SMTP.Port == "" ||
-		config.SMTP.FromAddr == "" || config.SMTP.AuthUser == "" ||
-		config.SMTP.AuthPass == "" {
-		return fmt.Errorf("missing required SMTP configuration")
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	validateSMTP("smtp", &config.SMTP, fail)
+	for name, backend := range config.SMTPBackends {
+		if name == PrimarySMTPBackend {
+			fail("smtp_backends: the name %q is reserved", name)
+		}
+		validateSMTP("smtp_backends."+name, &backend, fail)
+	}
+
+	server := &config.Server
+	if server.InternalAddr == "" && server.InternalSocket == "" {
+		fail("server.internal_addr and server.internal_socket are both empty")
+	}
+	for _, addr := range []struct{ key, value string }{
+		{"server.internal_addr", server.InternalAddr},
+		{"server.external_addr", server.ExternalAddr},
+		{"server.grpc_addr", server.GRPCAddr},
+		{"server.http_addr", server.HTTPAddr},
+		{"server.metrics_addr", server.MetricsAddr},
+		{"server.health_addr", server.HealthAddr},
+		{"server.events_addr", server.EventsAddr},
+		{"server.admin_addr", server.AdminAddr},
+	} {
+		if addr.value == "" {
+			continue
+		}
+		if err := checkHostPort(addr.value); err != nil {
+			fail("%s %q: %v", addr.key, addr.value, err)
+		}
+	}
+	if server.AdminAddr != "" && server.AdminToken == "" {
+		fail("server.admin_token is empty, required when server.admin_addr is set")
+	}
+	if server.EventsAddr != "" && server.MaxEventSubscribers <= 0 {
+		fail("server.max_event_subscribers must be > 0 when server.events_addr is set")
+	}
+	if server.Timeout <= 0 {
+		fail("server.timeout must be > 0")
+	}
+	if server.ReadTimeout <= 0 {
+		fail("server.read_timeout must be > 0")
+	}
+	if server.IdleTimeout <= 0 {
+		fail("server.idle_timeout must be > 0")
+	}
+	if server.RetryDelay <= 0 {
+		fail("server.retry_delay must be > 0")
+	}
+	if server.GreylistDelay <= 0 {
+		fail("server.greylist_delay must be > 0")
+	}
+	if server.GreylistMaxDelay < server.GreylistDelay {
+		fail("server.greylist_max_delay must be >= server.greylist_delay")
+	}
+	if server.RetryDeadline < 0 {
+		fail("server.retry_deadline must be >= 0")
+	}
+	if server.RetryDeadline > server.Timeout {
+		fail("server.retry_deadline must be <= server.timeout, which bounds the processing of each email")
+	}
+	if server.MaxRetries < 0 {
+		fail("server.max_retries must be >= 0")
+	}
+	if server.RetryDeadline > 0 && server.MaxRetries != 0 {
+		fail("server.retry_deadline and server.max_retries are mutually exclusive, set server.max_retries = 0 to retry until the deadline")
+	}
+	if server.RetryDeadline == 0 && server.MaxRetries == 0 {
+		fail("server.max_retries must be > 0 unless server.retry_deadline is set")
+	}
+	if server.MaxAttachmentBytes <= 0 {
+		fail("server.max_attachment_bytes must be > 0")
+	}
+	if server.MaxBodyBytes <= 0 {
+		fail("server.max_body_bytes must be > 0")
+	}
+	if server.MaxRecipients < 0 {
+		fail("server.max_recipients must be >= 0 (0 disables the limit)")
+	}
+	switch server.EmptyRecipient {
+	case "reject":
+	case "default":
+		if err := validate.Address(server.DefaultRecipient); err != nil {
+			fail("server.default_recipient %q is not a valid address, required when server.empty_recipient is default: %v", server.DefaultRecipient, err)
+		}
+	default:
+		fail("server.empty_recipient %q is not one of reject, default", server.EmptyRecipient)
+	}
+	if server.MaxMessageBytes <= 0 {
+		fail("server.max_message_bytes must be > 0")
+	}
+	if server.QueueDir != "" && server.MaxQueueSize <= 0 {
+		fail("server.max_queue_size must be > 0 when server.queue_dir is set")
+	}
+	if server.IdempotencyTTL < 0 {
+		fail("server.idempotency_ttl must be >= 0")
 	}
 
-	if config.Server.InternalAddr == "" || config.Server.Timeout <= 0 ||
-		config.Server.RetryDelay <= 0 || config.Server.MaxRetries <= 0 {
-		return fmt.Errorf("invalid internal server configuration")
+	if server.RateLimitPerMinute < 0 {
+		fail("server.rate_limit_per_minute must be >= 0")
+	}
+	if server.RateLimitPerMinute > 0 && server.RateLimitBurst <= 0 {
+		fail("server.rate_limit_burst must be > 0 when rate limiting is enabled")
+	}
+	if server.EmailRateLimit < 0 {
+		fail("server.email_rate_limit must be >= 0")
+	}
+	if server.EmailRateLimit > 0 && server.EmailRateWindow <= 0 {
+		fail("server.email_rate_window must be > 0 when server.email_rate_limit is set")
 	}
 
-	if config.Logging.Directory == "" || config.Logging.BufferSize <= 0 {
-		return fmt.Errorf("invalid logging configuration")
+	if _, err := origin.NewMatcher(server.AllowedOrigins); err != nil {
+		fail("server.allowed_origins: %w", err)
+	}
+	if server.OriginReportInterval < 0 {
+		fail("server.origin_report_interval must be >= 0")
+	}
+	for _, method := range server.CORSAllowedMethods {
+		if !slices.Contains(httpMethods, method) {
+			fail("server.cors_allowed_methods: %q is not one of %s", method, strings.Join(httpMethods, ", "))
+		}
+	}
+	if !slices.Contains(server.CORSAllowedMethods, "POST") {
+		fail("server.cors_allowed_methods must include POST, the method forms are submitted with")
+	}
+	for _, header := range server.CORSAllowedHeaders {
+		if !validHeaderName(header) {
+			fail("server.cors_allowed_headers: %q is not a valid header name", header)
+		}
+	}
+
+	if server.SendRatePerMinute < 0 {
+		fail("server.send_rate_per_minute must be >= 0")
+	}
+	if server.SendRatePerMinute > 0 && server.SendBurst <= 0 {
+		fail("server.send_burst must be > 0 when outbound throttling is enabled")
+	}
+	if server.DailySendLimit < 0 {
+		fail("server.daily_send_limit must be >= 0")
+	}
+
+	if strings.ContainsAny(server.MessageIDDomain, " \t\r\n<>@") {
+		fail("server.message_id_domain %q is not a valid domain", server.MessageIDDomain)
+	}
+	if server.DKIMKeyFile != "" {
+		if server.DKIMSelector == "" || strings.ContainsAny(server.DKIMSelector, " \t\r\n;=@") {
+			fail("server.dkim_selector %q is not valid, a selector is required when server.dkim_key_file is set", server.DKIMSelector)
+		}
+		if server.DKIMDomain == "" || strings.ContainsAny(server.DKIMDomain, " \t\r\n;=@<>") {
+			fail("server.dkim_domain %q is not valid, a domain is required when server.dkim_key_file is set", server.DKIMDomain)
+		}
+	}
+
+	for _, list := range []struct {
+		key     string
+		domains []string
+	}{
+		{"allowed_recipient_domains", server.AllowedRecipientDomains},
+		{"blocked_recipient_domains", server.BlockedRecipientDomains},
+	} {
+		for _, domain := range list.domains {
+			rest := strings.TrimPrefix(domain, "*.")
+			if rest == "" || strings.ContainsAny(rest, "*@ \t") {
+				fail("server.%s: %q is not a domain or \"*.domain\" pattern", list.key, domain)
+			}
+		}
+	}
+
+	if server.TrustProxyHeaders && (server.ProxyIPHeader == "" || strings.ContainsAny(server.ProxyIPHeader, " \t:")) {
+		fail("server.proxy_ip_header %q is not a header name, required when server.trust_proxy_headers is set", server.ProxyIPHeader)
+	}
+	if server.MinFillTime < 0 {
+		fail("server.min_fill_time must be >= 0")
+	}
+	if server.CallbackWorkers <= 0 {
+		fail("server.callback_workers must be > 0")
+	}
+	if server.CallbackTimeout <= 0 {
+		fail("server.callback_timeout must be > 0")
+	}
+	if server.CallbackMaxRetries <= 0 {
+		fail("server.callback_max_retries must be > 0")
+	}
+	if server.MaxConcurrent < 0 {
+		fail("server.max_concurrent must be >= 0")
+	}
+	if server.DrainTimeout < 0 {
+		fail("server.drain_timeout must be >= 0")
 	}
 
+	if server.DeadLetterDir != "" {
+		if server.DeadLetterMaxFiles <= 0 {
+			fail("server.dead_letter_max_files must be > 0 when server.dead_letter_dir is set")
+		}
+		if server.DeadLetterMaxBytes <= 0 {
+			fail("server.dead_letter_max_bytes must be > 0 when server.dead_letter_dir is set")
+		}
+	}
+
+	if server.AuditLog != "" {
+		if server.AuditLogFormat != "json" && server.AuditLogFormat != "text" {
+			fail("server.audit_log_format %q is not one of json, text", server.AuditLogFormat)
+		}
+		if server.AuditMaxBytes < 0 {
+			fail("server.audit_max_bytes must be >= 0")
+		}
+		if server.AuditMaxBytes > 0 && server.AuditMaxFiles <= 0 {
+			fail("server.audit_max_files must be > 0 when server.audit_max_bytes is set")
+		}
+	}
+
+	if len(server.FormFields) > 0 {
+		for _, name := range server.RequiredFormFields {
+			if !slices.Contains(server.FormFields, name) {
+				fail("server.required_form_fields: %q is not listed in server.form_fields", name)
+			}
+		}
+	}
+
+	if server.SubjectTemplate != "" {
+		if _, err := template.New("subject").Parse(server.SubjectTemplate); err != nil {
+			fail("server.subject_template: %v", err)
+		}
+	}
+
+	if server.DedupWindow < 0 {
+		fail("server.dedup_window must be >= 0")
+	}
+	if server.SpamThreshold < 0 {
+		fail("server.spam_threshold must be >= 0")
+	}
+	if server.SpamMaxLinks < 0 {
+		fail("server.spam_max_links must be >= 0")
+	}
+	if server.SpamAction != "reject" && server.SpamAction != "drop" {
+		fail("server.spam_action %q is not one of reject, drop", server.SpamAction)
+	}
+	for _, entry := range server.SpamDeniedIPs {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			if _, err := netip.ParseAddr(entry); err != nil {
+				fail("server.spam_denied_ips: %q is not an IP address or CIDR range", entry)
+			}
+		}
+	}
+	if server.RelayMaxRetries <= 0 {
+		fail("server.relay_max_retries must be > 0")
+	}
+	if server.RelayRetryDelay <= 0 {
+		fail("server.relay_retry_delay must be > 0")
+	}
+	if server.RelayTimeout <= 0 || server.RelayTimeout >= server.Timeout {
+		fail("server.relay_timeout must be > 0 and < server.timeout, so submissions are answered before the HTTP write timeout")
+	}
+	if server.AutoReplyTemplate != "" {
+		if _, err := template.New("auto_reply_subject").Parse(server.AutoReplySubject); err != nil {
+			fail("server.auto_reply_subject: %v", err)
+		}
+	}
+	if server.AutoReplyFrom != "" {
+		if err := validate.Address(server.AutoReplyFrom); err != nil {
+			fail("server.auto_reply_from %q is not a valid address: %v", server.AutoReplyFrom, err)
+		}
+	}
+
+	if server.MaxUploadBytes < 0 {
+		fail("server.max_upload_bytes must be >= 0")
+	}
+	for _, pattern := range server.AllowedUploadTypes {
+		if major, minor, ok := strings.Cut(pattern, "/"); !ok || major == "" || minor == "" {
+			fail("server.allowed_upload_types: %q is not a MIME type such as application/pdf or image/*", pattern)
+		}
+	}
+
+	if server.LogFormat != "native" && server.LogFormat != "json" {
+		fail("server.log_format %q is not one of native, json", server.LogFormat)
+	}
+
+	switch server.FormTokenMode {
+	case "":
+	case "shared", "signed":
+		if server.FormTokenSecret == "" {
+			fail("server.form_token_secret is empty, required when server.form_token_mode is set")
+		}
+	default:
+		fail("server.form_token_mode %q is not one of shared, signed", server.FormTokenMode)
+	}
+
+	if server.CaptchaSecret != "" {
+		switch server.CaptchaProvider {
+		case "recaptcha", "hcaptcha":
+		default:
+			fail("server.captcha_provider %q is not one of recaptcha, hcaptcha", server.CaptchaProvider)
+		}
+	}
+	for _, name := range server.SMTPFailover {
+		if _, ok := config.SMTPBackends[name]; !ok {
+			fail("server.smtp_failover: backend %q is not defined in smtp_backends", name)
+		}
+	}
+
+	if server.CaptchaMinScore < 0 || server.CaptchaMinScore > 1 {
+		fail("server.captcha_min_score must be between 0 and 1")
+	}
+
+	if config.Logging.Directory == "" {
+		fail("logging.directory is empty")
+	}
+	if config.Logging.BufferSize <= 0 {
+		fail("logging.buffer_size must be > 0")
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateSMTP checks the settings of one SMTP server, reporting problems with keys under prefix
+func validateSMTP(prefix string, smtp *SMTPConfig, fail func(format string, args ...any)) {
+	if smtp.Host == "" {
+		fail("%s.host is empty", prefix)
+	}
+	if smtp.Port == "" {
+		fail("%s.port is empty", prefix)
+	}
+	if strings.ContainsAny(smtp.Host, "[]") || (smtp.Host != "" && strings.Count(smtp.Host, ":") == 1) {
+		fail("%s.host %q must be a host name or IP address without port or brackets", prefix, smtp.Host)
+	}
+	if smtp.Port != "" {
+		if err := checkPort(smtp.Port); err != nil {
+			fail("%s.port %q: %v", prefix, smtp.Port, err)
+		}
+	}
+	if smtp.FromAddr == "" {
+		fail("%s.from_addr is empty", prefix)
+	}
+	if strings.ContainsAny(smtp.FromName, "\r\n") {
+		fail("%s.from_name must be a single line", prefix)
+	}
+	if smtp.AuthUser == "" {
+		fail("%s.auth_user is empty", prefix)
+	}
+
+	switch smtp.Encryption {
+	case "starttls", "tls":
+	case "none":
+		// Refuse to send credentials over an unencrypted connection
+		if smtp.AuthPass != "" || smtp.AuthMethod == "xoauth2" {
+			fail("%[1]s.encryption \"none\" cannot be used with authentication, clear %[1]s.auth_pass for plaintext relays", prefix)
+		}
+	default:
+		fail("%s.encryption %q is not one of starttls, tls, none", prefix, smtp.Encryption)
+	}
+
+	switch smtp.AuthMethod {
+	case "auto", "plain", "login", "cram-md5":
+		if smtp.AuthPass == "" && smtp.Encryption != "none" {
+			fail("%s.auth_pass is empty, required for %s authentication", prefix, smtp.AuthMethod)
+		}
+	case "xoauth2":
+		if smtp.OAuthTokenURL == "" {
+			fail("%s.oauth_token_url is empty, required for xoauth2 authentication", prefix)
+		}
+		if smtp.OAuthClientID == "" {
+			fail("%s.oauth_client_id is empty, required for xoauth2 authentication", prefix)
+		}
+		if smtp.OAuthClientSecret == "" {
+			fail("%s.oauth_client_secret is empty, required for xoauth2 authentication", prefix)
+		}
+	default:
+		fail("%s.auth_method %q is not one of auto, plain, login, cram-md5, xoauth2", prefix, smtp.AuthMethod)
+	}
+
+	if _, err := TLSVersion(smtp.TLSMinVersion); err != nil {
+		fail("%s.tls_min_version: %w", prefix, err)
+	}
+	if _, err := TLSCipherSuites(smtp.TLSCipherSuites); err != nil {
+		fail("%s.tls_cipher_suites: %w", prefix, err)
+	}
+
+	if (smtp.ClientCertFile == "") != (smtp.ClientKeyFile == "") {
+		fail("%[1]s.client_cert_file and %[1]s.client_key_file must be set together", prefix)
+	} else if smtp.ClientCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(smtp.ClientCertFile, smtp.ClientKeyFile); err != nil {
+			fail("%s.client_cert_file: %w", prefix, err)
+		}
+	}
+
+	if smtp.Proxy != "" {
+		if err := checkProxyURL(smtp.Proxy); err != nil {
+			fail("%s.proxy: %w", prefix, err)
+		}
+	}
+	if smtp.HeloHost != "" {
+		if err := validate.Hostname(smtp.HeloHost); err != nil {
+			fail("%s.helo_host: %w", prefix, err)
+		}
+	}
+
+	if smtp.PoolSize < 0 {
+		fail("%s.pool_size must be >= 0", prefix)
+	}
+	if smtp.PoolSize > 0 && smtp.PoolIdleTimeout <= 0 {
+		fail("%s.pool_idle_timeout must be > 0 when pooling is enabled", prefix)
+	}
+}
+
+// checkProxyURL checks that raw is a socks5:// or http:// proxy URL with a host and port and no path
+func checkProxyURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return fmt.Errorf("scheme %q is not one of socks5, http", u.Scheme)
+	}
+	if u.Port() == "" || u.Hostname() == "" {
+		return fmt.Errorf("%q must name a host and port, e.g. socks5://proxy.internal:1080", u.Redacted())
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return fmt.Errorf("%q must not have a path or query", u.Redacted())
+	}
 	return nil
 }
 
-func Save(config *Config, name string) error {
+// httpMethods lists the request methods accepted in server.cors_allowed_methods
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// validHeaderName reports whether name is a non-empty HTTP token (RFC 9110), as header field names must be
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fillZero sets every zero-valued field of the struct v to the corresponding field of def
+func fillZero(v, def reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			v.Field(i).Set(def.Field(i))
+		}
+	}
+}
+
+// Save writes config to path, leaving out values that came from environment variables or secret files
+func Save(config *Config, path string) error {
 	if config == nil {
 		return fmt.Errorf("config cannot be nil")
 	}
 
-	defaultConfigPath := filepath.Join(defaultConfigBase, name, name+".toml")
+	fileConfig := *config
+	clearEnvOverrides(&fileConfig)
+	// A password loaded from auth_pass_file stays in that file
+	if fileConfig.SMTP.AuthPassFile != "" {
+		fileConfig.SMTP.AuthPass = ""
+	}
 
-	data, err := tinytoml.Marshal(config)
+	data, err := tinytoml.Marshal(fileConfig)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	if err := os.WriteFile(defaultConfigPath, data, 0644); err != nil {
+	if err := os.WriteFile(path, data, 0644); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
 	return nil
 }
+
+// TLSVersion maps a configured TLS version such as "1.2" to its crypto/tls constant
+func TLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q, use 1.0, 1.1, 1.2 or 1.3", version)
+	}
+}
+
+// TLSCipherSuites maps cipher suite names such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" to their IDs.
+// An empty list returns nil, leaving the crypto/tls defaults in place.
+func TLSCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// checkHostPort validates a "host:port" address; IPv6 hosts must be bracketed, e.g. "[::1]:2525".
+// The host may be empty to listen on all interfaces.
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("not a host:port address (bracket IPv6 hosts, e.g. [::1]:2525): %w", err)
+	}
+	return checkPort(port)
+}
+
+// checkPort validates a numeric TCP port
+func checkPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return errors.New("port must be a number between 0 and 65535")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		wantErr  string
+		retries  int
+		deadline time.Duration
+	}{
+		{"default count", "", "", 3, 0},
+		{"deadline with max_retries unset", "retry_deadline = 120000000000", "", 0, 2 * time.Minute},
+		{"deadline with max_retries 0", "retry_deadline = 120000000000\nmax_retries = 0", "", 0, 2 * time.Minute},
+		{"deadline with max_retries", "retry_deadline = 120000000000\nmax_retries = 3", "server.retry_deadline and server.max_retries are mutually exclusive", 0, 0},
+		{"no budget", "max_retries = 0", "server.max_retries must be > 0 unless server.retry_deadline is set", 0, 0},
+		{"negative max_retries", "retry_deadline = 120000000000\nmax_retries = -1", "server.max_retries must be >= 0", 0, 0},
+		{"deadline beyond timeout", "retry_deadline = 600000000000", "server.retry_deadline must be <= server.timeout", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadServerConfig(t, tt.server)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.MaxRetries != tt.retries || cfg.Server.RetryDeadline != tt.deadline {
+				t.Errorf("max_retries %d, retry_deadline %s, want %d and %s", cfg.Server.MaxRetries, cfg.Server.RetryDeadline, tt.retries, tt.deadline)
+			}
+		})
+	}
+}
+
+// TestRetryBudgetReportsEveryError checks that each retry misconfiguration is reported, not just the first
+func TestRetryBudgetReportsEveryError(t *testing.T) {
+	_, err := loadServerConfig(t, "retry_deadline = 600000000000\nmax_retries = -1")
+	if err == nil {
+		t.Fatal("Load accepted an invalid retry budget")
+	}
+	for _, want := range []string{
+		"server.retry_deadline must be <= server.timeout",
+		"server.max_retries must be >= 0",
+		"server.retry_deadline and server.max_retries are mutually exclusive",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Load error = %v, want it to report %q", err, want)
+		}
+	}
+}
+
+// loadServerConfig loads a config file whose [server] section holds server
+func loadServerConfig(t *testing.T, server string) (*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mhrs.toml")
+	data := "[smtp]\nencryption = \"none\"\nauth_pass = \"\"\n\n[server]\n" + server +
+		"\n\n[logging]\ndirectory = \"" + filepath.ToSlash(dir) + "\"\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := Load("mhrs", path)
+	return cfg, err
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"reflect"
+	"slices"
+)
+
+// Changed lists the settings that differ between two configurations as dotted TOML keys,
+// e.g. "server.internal_addr" or "smtp_backends.backup". Values are left out so secrets are never reported.
+func Changed(old, new *Config) []string {
+	var keys []string
+	sections := []struct {
+		name     string
+		old, new reflect.Value
+	}{
+		{"smtp", reflect.ValueOf(old.SMTP), reflect.ValueOf(new.SMTP)},
+		{"server", reflect.ValueOf(old.Server), reflect.ValueOf(new.Server)},
+		{"logging", reflect.ValueOf(old.Logging), reflect.ValueOf(new.Logging)},
+	}
+	for _, section := range sections {
+		t := section.old.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := t.Field(i).Tag.Get("toml")
+			if key == "" {
+				continue
+			}
+			if !reflect.DeepEqual(section.old.Field(i).Interface(), section.new.Field(i).Interface()) {
+				keys = append(keys, section.name+"."+key)
+			}
+		}
+	}
+
+	var backends []string
+	for name, backend := range old.SMTPBackends {
+		if other, ok := new.SMTPBackends[name]; !ok || !reflect.DeepEqual(backend, other) {
+			backends = append(backends, "smtp_backends."+name)
+		}
+	}
+	for name := range new.SMTPBackends {
+		if _, ok := old.SMTPBackends[name]; !ok {
+			backends = append(backends, "smtp_backends."+name)
+		}
+	}
+	slices.Sort(backends)
+	return append(keys, backends...)
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LixenWraith/logger"
+)
+
+// envPrefix starts every environment variable that overrides a configuration setting.
+// SMTP settings follow as SMTP_<KEY> and server settings as <KEY>, where KEY is the upper-cased TOML key,
+// e.g. MHRS_SMTP_HOST, MHRS_SMTP_AUTH_PASS and MHRS_INTERNAL_ADDR.
+const envPrefix = "MHRS_"
+
+// envLogLevel overrides logging.level with a level name (debug, info, warn, error) or its number
+const envLogLevel = envPrefix + "LOG_LEVEL"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envField is a configuration field that can be overridden from the environment
+type envField struct {
+	name  string        // Environment variable name
+	value reflect.Value // Settable field in the target config
+	def   reflect.Value // Same field in the default config
+}
+
+// envFields lists the overridable fields of config. Map settings are not supported and are skipped.
+func envFields(config *Config) []envField {
+	sections := []struct {
+		prefix string
+		value  reflect.Value
+		def    reflect.Value
+	}{
+		{"SMTP_", reflect.ValueOf(&config.SMTP).Elem(), reflect.ValueOf(defaultConfig.SMTP)},
+		{"", reflect.ValueOf(&config.Server).Elem(), reflect.ValueOf(defaultConfig.Server)},
+	}
+
+	var fields []envField
+	for _, section := range sections {
+		t := section.value.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := t.Field(i).Tag.Get("toml")
+			if key == "" || t.Field(i).Type.Kind() == reflect.Map {
+				continue
+			}
+			fields = append(fields, envField{
+				name:  envPrefix + section.prefix + strings.ToUpper(key),
+				value: section.value.Field(i),
+				def:   section.def.Field(i),
+			})
+		}
+	}
+	return fields
+}
+
+// applyEnv overrides settings of config with the values of any matching environment variables
+func applyEnv(config *Config) error {
+	for _, field := range envFields(config) {
+		raw, ok := os.LookupEnv(field.name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(field.value, raw); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", field.name, err)
+		}
+	}
+
+	if raw, ok := os.LookupEnv(envLogLevel); ok {
+		level, err := parseLogLevel(raw)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", envLogLevel, err)
+		}
+		config.Logging.Level = level
+	}
+	return nil
+}
+
+// parseLogLevel accepts a level name such as "debug" or "WARN", or the numeric level used in the config file
+func parseLogLevel(raw string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug":
+		return logger.LevelDebug, nil
+	case "info":
+		return logger.LevelInfo, nil
+	case "warn", "warning":
+		return logger.LevelWarn, nil
+	case "error":
+		return logger.LevelError, nil
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not one of debug, info, warn, error", raw)
+	}
+	return level, nil
+}
+
+// clearEnvOverrides resets settings supplied through the environment to their defaults,
+// so secrets passed as environment variables are never written to a config file
+func clearEnvOverrides(config *Config) {
+	for _, field := range envFields(config) {
+		if _, ok := os.LookupEnv(field.name); ok {
+			field.value.Set(field.def)
+		}
+	}
+	if _, ok := os.LookupEnv(envLogLevel); ok {
+		config.Logging.Level = defaultConfig.Logging.Level
+	}
+}
+
+// setFromString parses raw according to the type of v and stores the result.
+// Durations use Go duration syntax such as "30s" and lists are comma-separated.
+func setFromString(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
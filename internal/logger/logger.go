@@ -0,0 +1,139 @@
+// Package logger forwards log calls to github.com/LixenWraith/logger, or writes them as flat newline-delimited
+// JSON records to stdout when the JSON log format is selected.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+
+	base "github.com/LixenWraith/logger"
+)
+
+// Log formats
+const (
+	FormatNative = "native" // Rotated log files written by the logger package, key/value pairs nested under "args"
+	FormatJSON   = "json"   // One JSON object per line on stdout with time, level, msg and each key/value pair as a field
+)
+
+// jsonLogger is set while the JSON format is active; nil means calls go to the logger package
+var jsonLogger atomic.Pointer[slog.Logger]
+
+// minLevel is the least severe level written. Both outputs are started at debug level and records are
+// filtered here, so SetLevel can change the level at runtime without reopening log files.
+var minLevel atomic.Int64
+
+// levels lists the log levels from most to least verbose, the order NextLevel cycles through
+var levels = []int{base.LevelDebug, base.LevelInfo, base.LevelWarn, base.LevelError}
+
+// Init starts logging in the given format, replacing the format and level of an earlier Init
+func Init(ctx context.Context, cfg *base.Config, format string) error {
+	switch format {
+	case FormatJSON:
+		handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+		jsonLogger.Store(slog.New(handler).With("logger", cfg.Name))
+		minLevel.Store(int64(cfg.Level))
+		// Flush and close log files left open by a previous native Init
+		return base.Shutdown(ctx)
+	case FormatNative, "":
+		debugCfg := *cfg
+		debugCfg.Level = base.LevelDebug
+		if err := base.Init(ctx, &debugCfg); err != nil {
+			return err
+		}
+		minLevel.Store(int64(cfg.Level))
+		jsonLogger.Store(nil)
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Level returns the current log level
+func Level() int {
+	return int(minLevel.Load())
+}
+
+// SetLevel changes the log level until the next Init. The change itself is always logged, at warn level.
+func SetLevel(ctx context.Context, level int) {
+	previous := int(minLevel.Swap(int64(level)))
+	write(ctx, base.LevelWarn, "Log level changed", "from", LevelName(previous), "to", LevelName(level))
+}
+
+// NextLevel returns the level after the current one in the cycle debug, info, warn, error
+func NextLevel() int {
+	current := Level()
+	for i, level := range levels {
+		if level == current {
+			return levels[(i+1)%len(levels)]
+		}
+	}
+	return levels[0]
+}
+
+// LevelName returns the lower-case name of a log level, or its number when it is not a standard level
+func LevelName(level int) string {
+	switch level {
+	case base.LevelDebug:
+		return "debug"
+	case base.LevelInfo:
+		return "info"
+	case base.LevelWarn:
+		return "warn"
+	case base.LevelError:
+		return "error"
+	}
+	return fmt.Sprint(level)
+}
+
+// Debug logs a message at debug level with the given key/value pairs
+func Debug(ctx context.Context, msg string, args ...any) {
+	log(ctx, base.LevelDebug, msg, args...)
+}
+
+// Info logs a message at info level with the given key/value pairs
+func Info(ctx context.Context, msg string, args ...any) {
+	log(ctx, base.LevelInfo, msg, args...)
+}
+
+// Warn logs a message at warn level with the given key/value pairs
+func Warn(ctx context.Context, msg string, args ...any) {
+	log(ctx, base.LevelWarn, msg, args...)
+}
+
+// Error logs a message at error level with the given key/value pairs
+func Error(ctx context.Context, msg string, args ...any) {
+	log(ctx, base.LevelError, msg, args...)
+}
+
+// Shutdown flushes buffered records and closes log files; it is a no-op in the JSON format
+func Shutdown(ctx context.Context) error {
+	return base.Shutdown(ctx)
+}
+
+func log(ctx context.Context, level int, msg string, args ...any) {
+	if int64(level) < minLevel.Load() {
+		return
+	}
+	write(ctx, level, msg, args...)
+}
+
+// write passes a record to the active output regardless of the log level
+func write(ctx context.Context, level int, msg string, args ...any) {
+	if l := jsonLogger.Load(); l != nil {
+		l.Log(ctx, slog.Level(level), msg, args...)
+		return
+	}
+	switch level {
+	case base.LevelDebug:
+		base.Debug(ctx, msg, args...)
+	case base.LevelInfo:
+		base.Info(ctx, msg, args...)
+	case base.LevelWarn:
+		base.Warn(ctx, msg, args...)
+	default:
+		base.Error(ctx, msg, args...)
+	}
+}
@@ -0,0 +1,227 @@
+// Package metrics implements a minimal set of Prometheus-compatible metric types and an HTTP handler
+// that serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is implemented by every metric type that can be registered and exposed
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds the set of metrics exposed by a service
+type Registry struct {
+	mu      sync.RWMutex
+	metrics []metric
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+	sort.Slice(r.metrics, func(i, j int) bool {
+		return r.metrics[i].name() < r.metrics[j].name()
+	})
+}
+
+// Handler returns an http.Handler serving all registered metrics in text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		for _, m := range r.metrics {
+			m.write(w)
+		}
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	metricName string
+	help       string
+	value      atomic.Uint64
+}
+
+// NewCounter creates and registers a counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.value.Load())
+}
+
+// GaugeFunc is a value that can go up and down, read from a callback at scrape time
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge whose value is returned by fn
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+// CounterVec is a family of counters partitioned by the value of a single label
+type CounterVec struct {
+	metricName string
+	help       string
+	label      string
+
+	mu       sync.RWMutex
+	counters map[string]*atomic.Uint64
+}
+
+// NewCounterVec creates and registers a counter family keyed by label
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{
+		metricName: name,
+		help:       help,
+		label:      label,
+		counters:   make(map[string]*atomic.Uint64),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label value by one
+func (c *CounterVec) Inc(value string) {
+	c.mu.RLock()
+	counter, ok := c.counters[value]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.mu.Lock()
+		if counter, ok = c.counters[value]; !ok {
+			counter = new(atomic.Uint64)
+			c.counters[value] = counter
+		}
+		c.mu.Unlock()
+	}
+	counter.Add(1)
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	values := make([]string, 0, len(c.counters))
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", c.metricName, c.label, strconv.Quote(value), c.counters[value].Load())
+	}
+}
+
+// Histogram counts observations into cumulative buckets and tracks their sum
+type Histogram struct {
+	metricName string
+	help       string
+	bounds     []float64
+
+	mu     sync.Mutex
+	counts []uint64 // one per bound plus the +Inf bucket
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram with the given upper bucket bounds in ascending order
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		bounds:     bounds,
+		counts:     make([]uint64, len(bounds)+1),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
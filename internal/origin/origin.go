@@ -0,0 +1,79 @@
+// Package origin matches HTTP request origins against configured allow lists.
+package origin
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RegexPrefix marks an allow list entry as a regular expression
+const RegexPrefix = "re:"
+
+// Matcher checks request origins against an allow list.
+// Entries are exact origins, wildcard subdomain patterns such as "*.example.com" or "https://*.example.com",
+// or regular expressions prefixed with "re:" that must match the whole origin.
+type Matcher struct {
+	exact     map[string]bool
+	wildcards []originWildcard
+	patterns  []*regexp.Regexp
+}
+
+// originWildcard is a parsed "*.domain" entry; an empty scheme matches any scheme
+type originWildcard struct {
+	scheme string
+	suffix string // Host suffix including the leading dot
+}
+
+// NewMatcher compiles the allow list entries, rejecting malformed wildcards and invalid regular expressions
+func NewMatcher(origins []string) (*Matcher, error) {
+	m := &Matcher{exact: make(map[string]bool)}
+	for _, origin := range origins {
+		switch {
+		case strings.HasPrefix(origin, RegexPrefix):
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(origin, RegexPrefix) + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin pattern %q: %w", origin, err)
+			}
+			m.patterns = append(m.patterns, re)
+		case strings.Contains(origin, "*"):
+			scheme, host, ok := strings.Cut(origin, "://")
+			if !ok {
+				scheme, host = "", origin
+			}
+			if !strings.HasPrefix(host, "*.") || strings.Contains(host[2:], "*") || len(host) == 2 {
+				return nil, fmt.Errorf("invalid origin wildcard %q: only a leading \"*.\" is supported", origin)
+			}
+			m.wildcards = append(m.wildcards, originWildcard{scheme: scheme, suffix: host[1:]})
+		default:
+			m.exact[origin] = true
+		}
+	}
+	return m, nil
+}
+
+// Allowed reports whether origin matches any entry
+func (m *Matcher) Allowed(origin string) bool {
+	if m.exact[origin] {
+		return true
+	}
+
+	if len(m.wildcards) > 0 {
+		if u, err := url.Parse(origin); err == nil && u.Host != "" {
+			for _, w := range m.wildcards {
+				if (w.scheme == "" || w.scheme == u.Scheme) &&
+					len(u.Host) > len(w.suffix) && strings.HasSuffix(u.Host, w.suffix) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, re := range m.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
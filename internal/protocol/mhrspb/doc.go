@@ -0,0 +1,4 @@
+// Package mhrspb holds the gRPC service definition of MHRS and the code generated from it.
+package mhrspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative mhrs.proto
@@ -0,0 +1,169 @@
+// MHRS gRPC interface, an alternative to the framed JSON protocol on server.internal_addr.
+// Fields mirror protocol.EmailRequest and protocol.Ack; see the README for their semantics.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: mhrs.proto
+
+package mhrspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MailRelay_SendEmail_FullMethodName  = "/mailhubrelay.v1.MailRelay/SendEmail"
+	MailRelay_SendEmails_FullMethodName = "/mailhubrelay.v1.MailRelay/SendEmails"
+)
+
+// MailRelayClient is the client API for MailRelay service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// MailRelay sends emails through MHRS. When MHRS has a client token configured, every call must carry it
+// in the "authorization" metadata as "Bearer <token>"; calls without it fail with UNAUTHENTICATED.
+// Calls made while MHRS is at its concurrency limit fail with RESOURCE_EXHAUSTED and may be retried.
+type MailRelayClient interface {
+	// SendEmail delivers one email and returns once it was sent or has finally failed
+	SendEmail(ctx context.Context, in *SendEmailRequest, opts ...grpc.CallOption) (*SendEmailResponse, error)
+	// SendEmails delivers the emails sent on the stream one after another, answering each with a response in order
+	SendEmails(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SendEmailRequest, SendEmailResponse], error)
+}
+
+type mailRelayClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMailRelayClient(cc grpc.ClientConnInterface) MailRelayClient {
+	return &mailRelayClient{cc}
+}
+
+func (c *mailRelayClient) SendEmail(ctx context.Context, in *SendEmailRequest, opts ...grpc.CallOption) (*SendEmailResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendEmailResponse)
+	err := c.cc.Invoke(ctx, MailRelay_SendEmail_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailRelayClient) SendEmails(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SendEmailRequest, SendEmailResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &MailRelay_ServiceDesc.Streams[0], MailRelay_SendEmails_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SendEmailRequest, SendEmailResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MailRelay_SendEmailsClient = grpc.BidiStreamingClient[SendEmailRequest, SendEmailResponse]
+
+// MailRelayServer is the server API for MailRelay service.
+// All implementations must embed UnimplementedMailRelayServer
+// for forward compatibility.
+//
+// MailRelay sends emails through MHRS. When MHRS has a client token configured, every call must carry it
+// in the "authorization" metadata as "Bearer <token>"; calls without it fail with UNAUTHENTICATED.
+// Calls made while MHRS is at its concurrency limit fail with RESOURCE_EXHAUSTED and may be retried.
+type MailRelayServer interface {
+	// SendEmail delivers one email and returns once it was sent or has finally failed
+	SendEmail(context.Context, *SendEmailRequest) (*SendEmailResponse, error)
+	// SendEmails delivers the emails sent on the stream one after another, answering each with a response in order
+	SendEmails(grpc.BidiStreamingServer[SendEmailRequest, SendEmailResponse]) error
+	mustEmbedUnimplementedMailRelayServer()
+}
+
+// UnimplementedMailRelayServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMailRelayServer struct{}
+
+func (UnimplementedMailRelayServer) SendEmail(context.Context, *SendEmailRequest) (*SendEmailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendEmail not implemented")
+}
+func (UnimplementedMailRelayServer) SendEmails(grpc.BidiStreamingServer[SendEmailRequest, SendEmailResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method SendEmails not implemented")
+}
+func (UnimplementedMailRelayServer) mustEmbedUnimplementedMailRelayServer() {}
+func (UnimplementedMailRelayServer) testEmbeddedByValue()                   {}
+
+// UnsafeMailRelayServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MailRelayServer will
+// result in compilation errors.
+type UnsafeMailRelayServer interface {
+	mustEmbedUnimplementedMailRelayServer()
+}
+
+func RegisterMailRelayServer(s grpc.ServiceRegistrar, srv MailRelayServer) {
+	// If the following call pancis, it indicates UnimplementedMailRelayServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MailRelay_ServiceDesc, srv)
+}
+
+func _MailRelay_SendEmail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendEmailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailRelayServer).SendEmail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MailRelay_SendEmail_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailRelayServer).SendEmail(ctx, req.(*SendEmailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailRelay_SendEmails_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MailRelayServer).SendEmails(&grpc.GenericServerStream[SendEmailRequest, SendEmailResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MailRelay_SendEmailsServer = grpc.BidiStreamingServer[SendEmailRequest, SendEmailResponse]
+
+// MailRelay_ServiceDesc is the grpc.ServiceDesc for MailRelay service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MailRelay_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mailhubrelay.v1.MailRelay",
+	HandlerType: (*MailRelayServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendEmail",
+			Handler:    _MailRelay_SendEmail_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendEmails",
+			Handler:       _MailRelay_SendEmails_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "mhrs.proto",
+}
@@ -0,0 +1,210 @@
+// Package protocol implements the wire framing and reply types shared by MHRS and its clients.
+// Each message is a 4-byte big-endian length header followed by a JSON payload of that length.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// HeaderSize is the size in bytes of the length prefix preceding every payload
+const HeaderSize = 4
+
+// EmailRequest is the email sending request clients submit to MHRS
+type EmailRequest struct {
+	Recipient      string            `json:"recipient"`                 // Email address of the recipient
+	Cc             []string          `json:"cc,omitempty"`              // Carbon copy recipients (optional)
+	Bcc            []string          `json:"bcc,omitempty"`             // Blind carbon copy recipients, never shown in headers (optional)
+	ReplyTo        string            `json:"reply_to,omitempty"`        // Address replies should go to instead of the sender (optional)
+	From           string            `json:"from,omitempty"`            // Sender address overriding the MHRS default, honored only when enabled (optional)
+	FromName       string            `json:"from_name,omitempty"`       // Sender display name, honored only when enabled (optional)
+	EnvelopeFrom   string            `json:"envelope_from,omitempty"`   // SMTP envelope sender (MAIL FROM) receiving bounces, e.g. a VERP address; defaults to the From address (optional)
+	Subject        string            `json:"subject"`                   // Subject line of the email
+	Body           []byte            `json:"body"`                      // Plaintext body content of the email
+	HTMLBody       []byte            `json:"html_body,omitempty"`       // HTML body content, sent as multipart/alternative when Body is also set (optional)
+	Attachments    []Attachment      `json:"attachments,omitempty"`     // Files attached to the email (optional)
+	Headers        map[string]string `json:"headers,omitempty"`         // Additional message headers such as X-Priority or List-Unsubscribe (optional)
+	AuthToken      string            `json:"auth_token,omitempty"`      // Shared secret, required when MHRS has a client token configured
+	CallbackURL    string            `json:"callback_url,omitempty"`    // HTTP(S) URL that receives a CallbackResult once delivery has finished (optional)
+	SendAt         *time.Time        `json:"send_at,omitempty"`         // Time to send at, held in the persistent queue until then; absent or past sends now (optional)
+	Command        string            `json:"command,omitempty"`         // Query to answer instead of sending an email, such as CommandQueueStatus; email fields are ignored (optional)
+	IdempotencyKey string            `json:"idempotency_key,omitempty"` // Client-chosen unique key; a repeat within the server's idempotency TTL gets the earlier result instead of sending again (optional)
+	AttemptHistory bool              `json:"attempt_history,omitempty"` // Return the send attempts in Ack.Attempts, for debugging delivery (optional)
+}
+
+// MaxIdempotencyKeyLength is the maximum length in bytes of EmailRequest.IdempotencyKey
+const MaxIdempotencyKeyLength = 256
+
+// Commands a request can carry instead of an email
+const (
+	CommandQueueStatus = "queue_status" // Answered with an Ack whose Queue lists the messages waiting in the persistent queue
+)
+
+// Attachment represents a single file attached to an email request.
+// Content is carried as base64 in the JSON encoding. Inline attachments, such as a logo shown in the HTML body,
+// are sent in a multipart/related part together with the HTML.
+type Attachment struct {
+	Filename    string `json:"filename"`             // File name shown to the recipient
+	ContentType string `json:"content_type"`         // MIME type, defaults to application/octet-stream when empty
+	Content     []byte `json:"content"`              // Raw file content
+	Inline      bool   `json:"inline,omitempty"`     // Embed in the HTML body as a related part instead of attaching (optional)
+	ContentID   string `json:"content_id,omitempty"` // Identifier the HTML body references as cid:<ContentID>, required when Inline is set
+}
+
+// Acknowledgement statuses
+const (
+	StatusOK           = "ok"
+	StatusError        = "error"
+	StatusBusy         = "busy"         // The server is at its concurrency limit; the request was not processed and may be retried
+	StatusUnauthorized = "unauthorized" // The request's AuthToken did not match the server's client token; it was not processed
+)
+
+// Ack is the reply MHRS sends once a request has been delivered or has permanently failed
+type Ack struct {
+	Status    string       `json:"status"`               // One of the Status constants
+	Message   string       `json:"message,omitempty"`    // Failure reason when Status is not StatusOK
+	RequestID string       `json:"request_id,omitempty"` // Identifier MHRS logged the request under, for reference in bug reports
+	Queue     *QueueStatus `json:"queue,omitempty"`      // Queue contents, set in reply to CommandQueueStatus
+	Bounce    *Bounce      `json:"bounce,omitempty"`     // SMTP rejection behind a failure, when the SMTP server refused the email
+	Duplicate bool         `json:"duplicate,omitempty"`  // Set when the request repeated the IdempotencyKey of an earlier successful one and was not sent again; RequestID is the earlier request's
+	Attempts  []Attempt    `json:"attempts,omitempty"`   // Send attempts, oldest first, when the request set AttemptHistory; at most server max_retries, or the 20 most recent under server retry_deadline
+}
+
+// Attempt describes one try at sending an email to the SMTP server
+type Attempt struct {
+	Number   int       `json:"number"`             // Attempt number, counting from 1
+	Time     time.Time `json:"time"`               // Time the attempt started
+	Error    string    `json:"error,omitempty"`    // Why the attempt failed; empty when the email was sent
+	Response string    `json:"response,omitempty"` // SMTP reply that accepted or rejected the email, e.g. "250 2.0.0 Ok: queued as 4F2A1"; empty when there was none
+}
+
+// Bounce categories
+const (
+	BounceUserUnknown     = "user_unknown"      // The mailbox or its domain does not exist or is disabled
+	BounceMailboxFull     = "mailbox_full"      // The mailbox is over its storage quota
+	BouncePolicy          = "policy"            // Refused by a security or spam policy, or the sender is not permitted
+	BounceMessageTooLarge = "message_too_large" // The message exceeds a size limit
+	BounceOther           = "other"             // Any other rejection
+)
+
+// Bounce describes an SMTP reply that rejected an email at send time. Bounces reported later by the
+// receiving system as delivery status notifications are not covered.
+type Bounce struct {
+	Category     string `json:"category"`                // One of the Bounce constants
+	Code         int    `json:"code"`                    // SMTP reply code, e.g. 550
+	EnhancedCode string `json:"enhanced_code,omitempty"` // RFC 3463 status code from the reply text, e.g. "5.1.1"
+	Permanent    bool   `json:"permanent"`               // Whether the reply was a 5xx permanent failure
+	Response     string `json:"response"`                // Full reply text without the code, lines joined by newlines
+}
+
+// Queued message states
+const (
+	QueueStateQueued    = "queued"    // Waiting for its first send attempt
+	QueueStateSending   = "sending"   // A send attempt is in progress
+	QueueStateRetrying  = "retrying"  // An attempt failed and the next one is pending
+	QueueStateScheduled = "scheduled" // Held until its SendAt time
+)
+
+// QueueStatus describes the messages held in the MHRS persistent queue
+type QueueStatus struct {
+	Enabled  bool            `json:"enabled"`  // Whether MHRS runs with a persistent queue
+	Count    int             `json:"count"`    // Number of queued messages, which may exceed len(Messages)
+	Messages []QueuedMessage `json:"messages"` // Summaries of the oldest queued messages
+}
+
+// QueuedMessage summarizes one message in the persistent queue
+type QueuedMessage struct {
+	ID         string     `json:"id"`                   // Queue entry identifier
+	RequestID  string     `json:"request_id,omitempty"` // Identifier of the request that submitted the message
+	QueuedAt   time.Time  `json:"queued_at"`            // Time the message was accepted
+	Size       int64      `json:"size"`                 // Size of the body, HTML body and attachments in bytes
+	Sender     string     `json:"sender"`               // Envelope sender
+	Recipients []string   `json:"recipients"`           // To, Cc and Bcc recipients
+	Subject    string     `json:"subject"`              // Subject line
+	State      string     `json:"state"`                // One of the QueueState constants
+	Attempts   int        `json:"attempts"`             // Send attempts made so far, including those of earlier runs of MHRS
+	LastError  string     `json:"last_error,omitempty"` // Reason the last attempt failed
+	SendAt     *time.Time `json:"send_at,omitempty"`    // Time the message is scheduled for, absent when it is sent right away
+}
+
+// Callback outcomes
+const (
+	OutcomeSent   = "sent"
+	OutcomeFailed = "failed"
+)
+
+// CallbackResult is the JSON body MHRS posts to a request's CallbackURL once the email was delivered or has failed for good
+type CallbackResult struct {
+	RequestID string    `json:"request_id"`       // Identifier from the request's acknowledgement
+	Recipient string    `json:"recipient"`        // Recipient field of the request
+	Outcome   string    `json:"outcome"`          // OutcomeSent or OutcomeFailed
+	Attempts  int       `json:"attempts"`         // Send attempts made, 0 when the request was rejected before sending
+	Error     string    `json:"error,omitempty"`  // Failure reason when Outcome is OutcomeFailed
+	Bounce    *Bounce   `json:"bounce,omitempty"` // SMTP rejection behind the failure, if any
+	Timestamp time.Time `json:"timestamp"`        // Time processing finished
+}
+
+// Network returns the network used to reach an MHRS address: "unix" for socket paths and "tcp" for host:port
+func Network(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Dial connects to MHRS at addr, which is either host:port or the path of a Unix domain socket
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.Dial(Network(addr), addr)
+}
+
+// ErrFrameTooLarge is returned when a frame exceeds the allowed payload size
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// WriteFrame writes payload to w prefixed with its length.
+// The header and payload are written in a single call so small frames are not split.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[HeaderSize:], payload)
+
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// ReadFrame reads a single length-prefixed frame from r and returns its payload.
+// Frames announcing more than maxBytes are rejected before the payload is allocated,
+// and a stream that ends before the announced length is reported as truncated.
+func ReadFrame(r io.Reader, maxBytes int64) ([]byte, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if size > maxBytes {
+		return nil, fmt.Errorf("%w: %d bytes announced, limit is %d", ErrFrameTooLarge, size, maxBytes)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated frame: expected %d bytes: %w", size, io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendAtEncoding(t *testing.T) {
+	data, err := json.Marshal(EmailRequest{Recipient: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "send_at") {
+		t.Errorf("request without SendAt encodes as %s, want send_at left out", data)
+	}
+
+	sendAt := time.Date(2026, 11, 1, 9, 0, 0, 0, time.UTC)
+	data, err = json.Marshal(EmailRequest{Recipient: "a@example.com", SendAt: &sendAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req EmailRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.SendAt == nil || !req.SendAt.Equal(sendAt) {
+		t.Errorf("SendAt round trip = %v, want %v", req.SendAt, sendAt)
+	}
+}
@@ -0,0 +1,129 @@
+// Package ratelimit provides token-bucket rate limiters, both single and keyed by an arbitrary string
+// such as a client IP address.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled continuously at a fixed rate up to its burst capacity
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full bucket that refills at rate tokens per second and holds at most burst tokens
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow consumes a token if one is available.
+// When the bucket is empty it returns false and the time until the next token becomes available.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.allow(time.Now())
+}
+
+// Wait blocks until a token can be consumed or ctx is done
+func (b *Bucket) Wait(ctx context.Context) error {
+	for {
+		ok, wait := b.Allow()
+		if ok {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// allow is the lock-free core of Allow; the caller must hold b.mu
+func (b *Bucket) allow(now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if b.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Keyed maintains an independent bucket per key.
+// Buckets idle for longer than the configured TTL are discarded to bound memory use.
+type Keyed struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	idleTTL   time.Duration
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewKeyed creates a keyed limiter whose buckets refill at rate tokens per second with the given burst
+func NewKeyed(rate float64, burst int, idleTTL time.Duration) *Keyed {
+	return &Keyed{
+		rate:      rate,
+		burst:     burst,
+		idleTTL:   idleTTL,
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow consumes a token from the bucket for key, creating it on first use
+func (k *Keyed) Allow(key string) (bool, time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(k.lastSweep) > k.idleTTL {
+		k.sweep(now)
+	}
+
+	b, ok := k.buckets[key]
+	if !ok {
+		b = NewBucket(k.rate, k.burst)
+		k.buckets[key] = b
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allow(now)
+}
+
+// sweep removes buckets that have not been used within the idle TTL; the caller must hold k.mu
+func (k *Keyed) sweep(now time.Time) {
+	for key, b := range k.buckets {
+		b.mu.Lock()
+		idle := now.Sub(b.last) > k.idleTTL
+		b.mu.Unlock()
+		if idle {
+			delete(k.buckets, key)
+		}
+	}
+	k.lastSweep = now
+}
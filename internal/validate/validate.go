@@ -0,0 +1,75 @@
+// Package validate provides input validation helpers shared by MHRS and its clients.
+package validate
+
+import (
+	"fmt"
+	"net/mail"
+	"net/netip"
+	"strings"
+)
+
+// Address checks that addr is a single well-formed email address, optionally with a display name
+func Address(addr string) error {
+	if strings.TrimSpace(addr) == "" {
+		return fmt.Errorf("empty email address")
+	}
+	if _, err := mail.ParseAddress(addr); err != nil {
+		return fmt.Errorf("invalid email address %q: %w", addr, err)
+	}
+	return nil
+}
+
+// AddressList validates a comma-separated list of email addresses and returns them individually.
+// Entries with a display name are returned in RFC 5322 form, bare addresses are returned as is.
+func AddressList(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, fmt.Errorf("no email address specified")
+	}
+
+	parsed, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email address list %q: %w", list, err)
+	}
+
+	addrs := make([]string, len(parsed))
+	for i, a := range parsed {
+		if a.Name == "" {
+			addrs[i] = a.Address
+		} else {
+			addrs[i] = a.String()
+		}
+	}
+	return addrs, nil
+}
+
+// Hostname checks that name can be sent in an SMTP EHLO or HELO command: a fully qualified domain name of
+// letters, digits and hyphens (RFC 1123), or an IP address literal such as [192.0.2.1] or [IPv6:2001:db8::1]
+func Hostname(name string) error {
+	if literal, ok := strings.CutPrefix(name, "["); ok {
+		literal, ok = strings.CutSuffix(literal, "]")
+		ip, err := netip.ParseAddr(strings.TrimPrefix(literal, "IPv6:"))
+		if !ok || err != nil || ip.Is4() == strings.HasPrefix(literal, "IPv6:") {
+			return fmt.Errorf("invalid address literal %q", name)
+		}
+		return nil
+	}
+
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("host name %q must be 1 to 253 characters", name)
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("host name %q is not fully qualified", name)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("host name %q has an invalid label %q", name, label)
+		}
+		for _, c := range []byte(label) {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("host name %q contains the invalid character %q", name, c)
+			}
+		}
+	}
+	return nil
+}